@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"fastcdc-backup/pkg/chunkserver"
+	"fastcdc-backup/pkg/lock"
+	"fastcdc-backup/pkg/repository"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// loopback reports whether address only accepts local connections
+func loopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	} else if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func main() {
+	defer func() {
+		if str := recover(); str != nil {
+			fmt.Println(str)
+			os.Exit(1)
+		}
+	}()
+
+	listen := flag.String("listen", "127.0.0.1:8080", "address to serve on, other than loopback only with a token")
+	token := flag.String("token", os.Getenv(chunkserver.TokenEnv), "shared token clients have to send, "+chunkserver.TokenEnv+" by default")
+	root := flag.String("root", "./server", "repository the server stores chunks in")
+	appendOnly := flag.Bool("append-only", false, "refuse deletes and keep released chunks until pruned")
+	prune := flag.Bool("prune", false, "remove the chunks nothing references anymore and exit")
+	flag.Parse()
+
+	config, err := repository.Open(*root)
+	check(err)
+
+	var held *lock.Handle
+	if *prune {
+		config, err = repository.Maintain(config)
+		check(err)
+
+		held, err = repository.Lock(*root, config, true, "prune")
+	} else {
+		if *appendOnly {
+			config.AppendOnly = true
+		}
+
+		// held while serving so gc and prune wait for the server to stop
+		held, err = repository.Lock(*root, config, false, "chunkserver")
+	}
+	check(err)
+	defer held.Release()
+
+	// refcounts and the snapshot cache live next to the repository's own index
+	db, err := repository.OpenIndex(*root)
+	check(err)
+	defer db.Close()
+
+	store, err := repository.OpenStore(*root, config, db)
+	check(err)
+
+	server, err := chunkserver.NewServer(store, db)
+	check(err)
+
+	locks, err := repository.OpenLocks(*root, config)
+	check(err)
+	// clients locking through the server don't see its own lock
+	server.EnableLocks(lock.Hide(locks, held))
+
+	if *prune {
+		removed, err := server.Prune()
+		check(err)
+
+		fmt.Printf("Pruned %d chunks from %s\n", removed, *root)
+		return
+	}
+
+	var handler http.Handler = server
+	if *token != "" {
+		handler = chunkserver.RequireToken(*token, server)
+	} else if !loopback(*listen) {
+		check(fmt.Errorf("refusing to serve on %s without a token", *listen))
+	}
+
+	fmt.Printf("Serving chunks from %s on %s\n", *root, *listen)
+	check(http.ListenAndServe(*listen, handler))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"fastcdc-backup/pkg/check"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runCheck(args []string) error {
+	opt := check.Options{}
+	opt.SetDefaults()
+
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	chunklists := fs.String("chunklists", "", "directory holding the chunklists, every host's by default")
+	fs.BoolVar(&opt.ReadData, "read-data", opt.ReadData, "rehash every stored chunk")
+	sample := fs.Float64("read-data-subset", 0, "rehash this fraction of the stored chunks, between 0 and 1")
+	quarantine := fs.Bool("quarantine", false, "move corrupt objects into ./quarantine")
+	fs.BoolVar(&opt.Repair, "repair", opt.Repair, "rewrite damaged packs from their parity, with -read-data")
+	fs.Parse(args)
+
+	if *sample < 0 || *sample > 1 {
+		return errors.New("-read-data-subset must be between 0 and 1")
+	} else if *sample > 0 {
+		opt.ReadData = true
+		opt.Sample = *sample
+	}
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	if *quarantine || opt.Repair {
+		config, err = repository.Maintain(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	// quarantine and repair change the store, plain checks only read it
+	held, err := repository.Lock(".", config, *quarantine || opt.Repair, "check")
+	if err != nil {
+		return err
+	}
+	defer held.Release()
+
+	db, err := repository.OpenIndex(".")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	opt.ID, err = repository.ChunkIDFunc(".", config)
+	if err != nil {
+		return err
+	}
+
+	if *chunklists != "" {
+		opt.Namespaces = []node.Namespace{{Chunklists: *chunklists}}
+	} else {
+		opt.Namespaces, err = config.Namespaces(".")
+		if err != nil {
+			return err
+		}
+	}
+	opt.Collected = config.Collected()
+
+	// read what the backend holds, not local copies of it
+	if opt.ReadData {
+		config.Cache = nil
+	}
+
+	if err := flushOutbox(config, db); err != nil {
+		return err
+	}
+
+	store, err := repository.OpenStore(".", config, db)
+	if err != nil {
+		return err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if *quarantine {
+		opt.Quarantine, err = chunkstore.NewFSStore(filepath.Join(".", "quarantine"), chunkstore.FlatLayout)
+		if err != nil {
+			return err
+		}
+	}
+
+	report, err := check.Run(store, db, opt)
+	if err != nil {
+		return err
+	}
+
+	printReport(report)
+
+	if !report.OK() {
+		return errors.New("repository has errors")
+	}
+
+	return nil
+}
+
+func printReport(report *check.Report) {
+	fmt.Printf("Checked %d chunklists and %d stored chunks, read %d\n", report.Chunklists, report.Stored, report.Read)
+
+	for _, path := range report.BadChunklists {
+		fmt.Printf("unreadable chunklist %s\n", path)
+	}
+
+	for _, problem := range report.Missing {
+		fmt.Printf("missing %s\n", problem.ID)
+		for _, file := range problem.Files {
+			fmt.Printf("  used by %s\n", file)
+		}
+	}
+
+	for _, problem := range report.Corrupt {
+		fmt.Printf("corrupt %s: %s\n", problem.ID, problem.Err)
+		for _, file := range problem.Files {
+			fmt.Printf("  used by %s\n", file)
+		}
+	}
+
+	for _, id := range report.Orphaned {
+		fmt.Printf("orphaned %s\n", id)
+	}
+
+	for _, id := range report.Unreferenced {
+		fmt.Printf("unreferenced %s, left for gc\n", id)
+	}
+
+	for _, count := range report.BadCounts {
+		fmt.Printf("instance_count of %s is %d, chunklists reference it %d times\n", count.ID, count.Indexed, count.Referenced)
+	}
+
+	for _, damage := range report.Packs {
+		switch {
+		case damage.Err != "":
+			fmt.Printf("damaged pack %s: %s\n", damage.PackID, damage.Err)
+		case damage.Repaired:
+			fmt.Printf("repaired %d shards of pack %s\n", damage.Shards, damage.PackID)
+		default:
+			fmt.Printf("pack %s has %d damaged shards, run with -repair to rewrite it\n", damage.PackID, damage.Shards)
+		}
+	}
+
+	for _, id := range report.Quarantined {
+		fmt.Printf("quarantined %s\n", id)
+	}
+}
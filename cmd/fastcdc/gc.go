@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"fastcdc-backup/pkg/gc"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runGC(args []string) error {
+	opt := gc.Options{}
+	opt.SetDefaults()
+
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	fs.DurationVar(&opt.Grace, "grace", opt.Grace, "how long a chunk has to be unreferenced before it is deleted")
+	fs.BoolVar(&opt.DryRun, "dry-run", opt.DryRun, "report what would be deleted and recounted without changing anything")
+	fs.Parse(args)
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	if config.Server != "" {
+		return errors.New("chunks are collected by the chunk server, which tracks every client's references")
+	}
+
+	if !opt.DryRun {
+		config, err = repository.Maintain(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	// nothing may add references while marking or rewrite what is swept
+	held, err := repository.Lock(".", config, true, "gc")
+	if err != nil {
+		return err
+	}
+	defer held.Release()
+
+	// listed under the lock so a new host waits
+	opt.Namespaces, err = config.Namespaces(".")
+	if err != nil {
+		return err
+	}
+
+	db, err := repository.OpenIndex(".")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// queued uploads are stored chunks as far as marking goes
+	if err := flushOutbox(config, db); err != nil {
+		return err
+	}
+
+	store, err := repository.OpenStore(".", config, db)
+	if err != nil {
+		return err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	result, err := gc.Run(store, db, opt)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range result.Unlisted {
+		fmt.Printf("no chunklist for %s\n", path)
+	}
+	for _, path := range result.StaleChunklists {
+		fmt.Printf("chunklist %s is not in the hierarchy, keeping its chunks\n", path)
+	}
+	for _, id := range result.Missing {
+		fmt.Printf("missing %s\n", id)
+	}
+
+	verb := "Deleted"
+	if opt.DryRun {
+		verb = "Would delete"
+	}
+	fmt.Printf("Marked %d of %d stored chunks from %d chunklists\n", result.Marked, result.Stored, result.Chunklists)
+	fmt.Printf("%s %d unreferenced chunks, %d more are within the %s grace period\n", verb, len(result.Swept), result.Pending, opt.Grace)
+	fmt.Printf("%d index entries were out of date\n", result.Recounted)
+
+	return nil
+}
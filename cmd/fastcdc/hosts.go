@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runHosts(args []string) error {
+	fs := flag.NewFlagSet("hosts", flag.ExitOnError)
+	adopt := fs.Bool("adopt", false, "share the repository between hosts, its current backup becomes this host's, every host must reach this directory and its index")
+	host := fs.String("host", "", "name of this host's namespace, the hostname by default")
+	fs.Parse(args)
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	if *adopt {
+		if *host == "" {
+			*host, err = os.Hostname()
+			if err != nil {
+				return err
+			}
+		}
+
+		// no watcher may be writing chunklists while they move
+		held, err := repository.Lock(".", config, true, "hosts")
+		if err != nil {
+			return err
+		}
+		defer held.Release()
+
+		if err := repository.AdoptHosts(".", *host); err != nil {
+			return err
+		}
+		fmt.Printf("The repository is now shared between hosts, its backup belongs to %s\n", *host)
+
+		return nil
+	}
+
+	if !config.Hosts {
+		fmt.Println("The repository belongs to a single host, run with -adopt to share it")
+		return nil
+	}
+
+	namespaces, err := config.Namespaces(".")
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces {
+		fmt.Printf("%-24s %s\n", namespace.Host, hierarchyRecorded(namespace))
+	}
+
+	return nil
+}
+
+// hierarchyRecorded describes when a host recorded its hierarchy
+func hierarchyRecorded(namespace node.Namespace) string {
+	bytes, err := os.ReadFile(namespace.Hierarchy)
+	if os.IsNotExist(err) {
+		return "no backup yet"
+	} else if err != nil {
+		return err.Error()
+	}
+
+	tree := node.Tree{}
+	if err := json.Unmarshal(bytes, &tree); err != nil {
+		return fmt.Sprintf("hierarchy can't be read: %s", err)
+	}
+
+	return "hierarchy recorded " + time.Unix(tree.TimeAccessed, 0).Format(time.RFC3339)
+}
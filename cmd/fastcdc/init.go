@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runInit(args []string) error {
+	config := &repository.Config{}
+	config.SetDefaults()
+
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	root := fs.String("root", ".", "directory to create the repository in")
+	levels := fs.Int("levels", 0, "directory levels of the chunk layout, 0 for a flat store")
+	width := fs.Int("width", 2, "characters of the chunk ID per directory level")
+	fs.Int64Var(&config.PackSize, "pack-size", config.PackSize, "target size of pack files, 0 to store chunks as individual files")
+	fs.IntVar(&config.Chunker.MinSize, "min-size", config.Chunker.MinSize, "smallest chunk size")
+	fs.IntVar(&config.Chunker.NormalSize, "normal-size", config.Chunker.NormalSize, "chunk size the chunker aims for")
+	fs.IntVar(&config.Chunker.MaxSize, "max-size", config.Chunker.MaxSize, "largest chunk size")
+	fs.IntVar(&config.Chunker.Normalization, "normalization", config.Chunker.Normalization, "how tightly chunk sizes cluster around the normal size")
+	fs.BoolVar(&config.Hosts, "hosts", config.Hosts, "share the repository between hosts, each backing up into its own namespace, every host must reach this directory and its index")
+	fs.StringVar(&config.Compression, "compression", config.Compression, "compress chunks before they are stored, deflate or empty for none")
+	fs.BoolVar(&config.AppendOnly, "append-only", config.AppendOnly, "clients may only add to the store, pruning needs the maintenance file")
+	fs.Parse(args)
+
+	if *levels > 0 {
+		config.Layout = chunkstore.Layout{Levels: *levels, Width: *width}
+	}
+
+	adopted, err := repository.Init(*root, config)
+	if err != nil {
+		return err
+	}
+
+	if adopted {
+		fmt.Printf("Adopted the existing repository in %s as format version %d, keeping its settings\n", *root, repository.FormatVersion)
+	} else {
+		fmt.Printf("Created a repository in %s, format version %d\n", *root, repository.FormatVersion)
+	}
+
+	return nil
+}
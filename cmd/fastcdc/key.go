@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"fastcdc-backup/pkg/encryption"
+	"fastcdc-backup/pkg/repository"
+)
+
+// runKey manages the key, passphrases come from the environment
+func runKey(args []string) error {
+	fs := flag.NewFlagSet("key", flag.ExitOnError)
+	hmacIDs := fs.Bool("hmac-ids", false, "name chunks by a keyed hash so stored IDs don't reveal content")
+	fs.Parse(args)
+
+	passphrase := os.Getenv(repository.PassphraseEnv)
+	if passphrase == "" {
+		return fmt.Errorf("set %s to the passphrase", repository.PassphraseEnv)
+	}
+
+	switch fs.Arg(0) {
+	case "init":
+		if err := repository.InitEncryption(".", passphrase, *hmacIDs); err != nil {
+			return err
+		}
+		fmt.Printf("Created %s, keep a copy of it: without it the repository can't be read\n", repository.KeyFile)
+
+	case "passwd":
+		newPassphrase := os.Getenv("FASTCDC_NEW_PASSPHRASE")
+		if newPassphrase == "" {
+			return errors.New("set FASTCDC_NEW_PASSPHRASE to the new passphrase")
+		}
+
+		path := filepath.Join(".", repository.KeyFile)
+
+		keyFile, err := encryption.LoadKeyFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err := keyFile.ChangePassphrase(passphrase, newPassphrase); err != nil {
+			return err
+		}
+
+		if err := keyFile.Save(path); err != nil {
+			return err
+		}
+		fmt.Println("Changed passphrase")
+
+	default:
+		return errors.New("usage: fastcdc key [-hmac-ids] init | key passwd")
+	}
+
+	return nil
+}
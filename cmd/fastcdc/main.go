@@ -2,12 +2,19 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"fastcdc-backup/pkg/chunkstore"
 	"fastcdc-backup/pkg/fastcdc"
+	"fastcdc-backup/pkg/ingest"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/repository"
 )
 
 // func check(e error) {
@@ -16,70 +23,98 @@ import (
 // 	}
 // }
 
-func createChunkDir() error {
-	if _, err := os.Stat("./chunks"); err != nil {
-		if os.IsNotExist(err) {
-			err = os.Mkdir("chunks", 0755)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		err = os.RemoveAll("./chunks")
-		if err != nil {
-			return err
-		}
+func writeFile(filePath string, host string) error {
+	fi, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
 
-		err = os.Mkdir("chunks", 0755)
+	if host == "" {
+		host, err = os.Hostname()
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
-}
+	namespace, err := config.Namespace(".", host)
+	if err != nil {
+		return err
+	}
 
-func writeChunk(chunk *fastcdc.Chunk) error {
-	filename := fmt.Sprintf("%x", chunk.Checksum())
-	path := filepath.Join("./chunks", filename)
+	// chunklists are kept by the file's path within the repository
+	rel, err := filepath.Rel(".", filePath)
+	if err != nil {
+		return err
+	} else if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside the repository", filePath)
+	}
+	chunklistPath := filepath.Join(namespace.Chunklists, rel)
+
+	// buffered reader is more efficient for many small reads
+	br := bufio.NewReaderSize(fi, 4096)
+	chunker := fastcdc.NewChunker(br, config.Chunker)
 
-	fo, err := os.Create(path)
+	held, err := repository.Lock(".", config, false, "chunk")
 	if err != nil {
 		return err
 	}
-	defer fo.Close()
+	defer held.Release()
 
-	n, err := fo.Write(chunk.Data)
+	db, err := repository.OpenIndex(".")
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Wrote %d bytes to %s\n", n, filename)
+	defer db.Close()
 
-	return nil
-}
+	opt := ingest.Options{}
+	opt.SetDefaults()
+	opt.Collected = config.Collected()
 
-func writeFile(filePath string) error {
-	fi, err := os.Open(filePath)
+	opt.ChunkID, err = repository.ChunkIDFunc(".", config)
 	if err != nil {
 		return err
 	}
-	defer fi.Close()
 
-	// set options
-	opt := fastcdc.Options{}
-	opt.SetDefaults()
+	if config.Quota != nil {
+		opt.Quota = *config.Quota
+	}
 
-	// buffered reader is more efficient for many small reads
-	br := bufio.NewReaderSize(fi, 4096)
-	chunker := fastcdc.NewChunker(br, opt)
+	store, err := repository.OpenStore(".", config, db)
+	if err != nil {
+		return err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
 
-	err = createChunkDir()
+	writer, err := ingest.NewWriter(db, store, opt)
 	if err != nil {
 		return err
 	}
 
+	// the previous chunklist is released once the new references are in place
+	var old *node.FNode
+	if bytes, err := os.ReadFile(chunklistPath); err == nil {
+		old = &node.FNode{}
+		if err := json.Unmarshal(bytes, old); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	fnode := &node.FNode{
+		Path:   rel,
+		Size:   0,
+		Chunks: []string{},
+	}
+
 	for {
 		chunk, err := chunker.NextChunk()
 
@@ -90,15 +125,131 @@ func writeFile(filePath string) error {
 			return err
 		}
 
-		err = writeChunk(&chunk)
-		if err != nil {
+		checksum := writer.ID(chunk.Data)
+		if ok, err := store.Has(checksum); err != nil {
+			return err
+		} else if !ok {
+			if _, err := writer.WriteChunk(&chunk); err != nil {
+				return err
+			}
+		}
+
+		if err := writer.AddReference(checksum); err != nil {
+			return err
+		}
+
+		fnode.Chunks = append(fnode.Chunks, checksum)
+		fnode.Size += int64(chunk.Size)
+	}
+
+	if flusher, ok := store.(chunkstore.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
 			return err
 		}
 	}
 
+	chunklistJSON, err := json.Marshal(fnode)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(chunklistPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(chunklistPath, chunklistJSON, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote chunklist to %s\n", chunklistPath)
+
+	if old != nil {
+		for _, checksum := range old.References() {
+			if err := writer.Release(checksum); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
+func runChunk(args []string) error {
+	fs := flag.NewFlagSet("chunk", flag.ExitOnError)
+	host := fs.String("host", "", "this host's namespace in a repository shared between hosts, the hostname by default")
+	fs.Parse(args)
+
+	path := "./shakespeare.txt"
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	return writeFile(path, *host)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: fastcdc <command> [arguments]
+
+commands:
+  init [-root dir] [options]       create a repository, or adopt one from before format versions
+  chunk [-host name] [file]        chunk a file into the repository
+  migrate -levels N -width N       move ./chunks into a fan-out layout
+  repack [-threshold F]            rewrite packs that are mostly dead chunks
+  serve [-root dir] [-append-only] serve the repository over stdin and stdout
+  key [-hmac-ids] init|passwd      set up or rewrap the encryption key
+  restore <chunklist> <output>     rebuild a file, verifying every chunk
+  check [-read-data] [-repair]     verify the chunklists, index and stored chunks
+  mirror -to dir [-verify]         copy new chunks and the manifests into another repository
+  outbox [-drain]                  show or send changes queued for the store
+  usage [-backfill]                show logical, unique and stored bytes per backup root
+  gc [-grace D] [-dry-run]         delete unreferenced chunks and fix instance counts
+  unlock [-all] [-list]            remove locks left behind by crashed processes
+  hosts [-adopt] [-host name]      list the hosts sharing the repository, or start sharing it`)
+}
+
 func main() {
-	_ = writeFile("./shakespeare.txt")
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"chunk"}
+	}
+
+	var err error
+
+	switch args[0] {
+	case "init":
+		err = runInit(args[1:])
+	case "chunk":
+		err = runChunk(args[1:])
+	case "migrate":
+		err = runMigrate(args[1:])
+	case "repack":
+		err = runRepack(args[1:])
+	case "serve":
+		err = runServe(args[1:])
+	case "key":
+		err = runKey(args[1:])
+	case "restore":
+		err = runRestore(args[1:])
+	case "check":
+		err = runCheck(args[1:])
+	case "mirror":
+		err = runMirror(args[1:])
+	case "outbox":
+		err = runOutbox(args[1:])
+	case "usage":
+		err = runUsage(args[1:])
+	case "gc":
+		err = runGC(args[1:])
+	case "unlock":
+		err = runUnlock(args[1:])
+	case "hosts":
+		err = runHosts(args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
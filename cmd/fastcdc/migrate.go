@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	levels := fs.Int("levels", 2, "number of directory levels, 0 for a flat store")
+	width := fs.Int("width", 2, "characters of the chunk ID per directory level")
+	fs.Parse(args)
+
+	layout := chunkstore.Layout{Levels: *levels, Width: *width}
+	if *levels == 0 {
+		layout = chunkstore.FlatLayout
+	}
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	held, err := repository.Lock(".", config, true, "migrate")
+	if err != nil {
+		return err
+	}
+	defer held.Release()
+
+	moved, err := repository.MigrateLayout(".", layout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Moved %d chunks into layout %s\n", moved, layout)
+
+	return nil
+}
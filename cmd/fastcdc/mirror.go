@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"fastcdc-backup/pkg/mirror"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runMirror(args []string) error {
+	opt := mirror.Options{}
+	opt.SetDefaults()
+
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	to := fs.String("to", "", "root of the repository to copy into, its config.json picks the backend")
+	verify := fs.Bool("verify", false, "rehash every chunk before copying it")
+	fs.IntVar(&opt.BatchBytes, "batch-bytes", opt.BatchBytes, "upload and flush chunks in batches of this many bytes")
+	fs.Parse(args)
+
+	if *to == "" {
+		return errors.New("usage: fastcdc mirror -to <dir> [-verify]")
+	}
+
+	srcConfig, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	dstConfig, err := repository.Open(*to)
+	if err != nil {
+		return err
+	}
+
+	// a replica must name chunks the same way to deduplicate
+	srcID, err := repository.ChunkIDFunc(".", srcConfig)
+	if err != nil {
+		return err
+	}
+
+	dstID, err := repository.ChunkIDFunc(*to, dstConfig)
+	if err != nil {
+		return err
+	}
+
+	probe := []byte("fastcdc mirror")
+	if srcID(probe) != dstID(probe) {
+		return errors.New("repositories name chunks differently, the destination needs the same chunk id scheme and key")
+	}
+
+	if *verify {
+		opt.Verify = srcID
+	}
+
+	// the copied manifests have to be where the destination looks for them
+	if srcConfig.Hosts != dstConfig.Hosts {
+		return errors.New("only one of the repositories is shared between hosts, run fastcdc hosts -adopt in the other")
+	}
+
+	srcHeld, err := repository.Lock(".", srcConfig, false, "mirror")
+	if err != nil {
+		return err
+	}
+	defer srcHeld.Release()
+
+	// the destination's index and manifests are replaced wholesale
+	dstHeld, err := repository.Lock(*to, dstConfig, true, "mirror")
+	if err != nil {
+		return err
+	}
+	defer dstHeld.Release()
+
+	srcDB, err := repository.OpenIndex(".")
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+
+	dstDB, err := repository.OpenIndex(*to)
+	if err != nil {
+		return err
+	}
+	defer dstDB.Close()
+
+	src, err := repository.OpenStore(".", srcConfig, srcDB)
+	if err != nil {
+		return err
+	}
+	if closer, ok := src.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// batches are flushed to the destination so a mirror can resume
+	dstConfig.Outbox = nil
+
+	dst, err := repository.OpenStore(*to, dstConfig, dstDB)
+	if err != nil {
+		return err
+	}
+	if closer, ok := dst.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// chunks first so chunklists never point at missing chunks
+	result, err := mirror.Chunks(src, dst, opt)
+	fmt.Printf("Copied %d of %d missing chunks (%d bytes), %d already present\n", result.Copied, result.Missing, result.Bytes, result.Listed-result.Missing)
+	if err != nil {
+		return err
+	}
+
+	// chunklists referencing a corrupt chunk would point at nothing in the mirror
+	if len(result.Corrupt) > 0 {
+		for _, id := range result.Corrupt {
+			fmt.Printf("corrupt %s, not copied\n", id)
+		}
+		return fmt.Errorf("%d chunks failed verification, the index and manifests were not mirrored", len(result.Corrupt))
+	}
+
+	if err := mirror.Index(srcDB, dstDB); err != nil {
+		return err
+	}
+
+	written, err := mirrorManifests(srcConfig, *to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated %d manifests\n", written)
+
+	return nil
+}
+
+// mirrorManifests copies every namespace's hierarchy and chunklists
+func mirrorManifests(config *repository.Config, to string) (int, error) {
+	if config.Hosts {
+		return mirror.Files(repository.HostsDir, filepath.Join(to, repository.HostsDir))
+	}
+
+	written, err := mirror.Files("chunklists", filepath.Join(to, "chunklists"))
+	if err != nil {
+		return written, err
+	}
+
+	if changed, err := mirror.File("hierarchy.json", filepath.Join(to, "hierarchy.json")); err != nil {
+		return written, err
+	} else if changed {
+		written++
+	}
+
+	return written, nil
+}
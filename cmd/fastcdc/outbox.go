@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"time"
+
+	"fastcdc-backup/pkg/outbox"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runOutbox(args []string) error {
+	fs := flag.NewFlagSet("outbox", flag.ExitOnError)
+	drain := fs.Bool("drain", false, "send queued changes now, without waiting out the backoff")
+	fs.Parse(args)
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	if config.Outbox == nil {
+		fmt.Println("Repository has no outbox")
+		return nil
+	}
+
+	held, err := repository.Lock(".", config, false, "outbox")
+	if err != nil {
+		return err
+	}
+	defer held.Release()
+
+	db, err := repository.OpenIndex(".")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	store, err := repository.OpenStore(".", config, db)
+	if err != nil {
+		return err
+	}
+
+	queue := outbox.Find(store)
+	defer queue.Close()
+
+	if *drain {
+		if err := queue.Retry(); err != nil {
+			return err
+		}
+
+		applied, err := queue.Drain()
+		fmt.Printf("Applied %d queued changes\n", applied)
+		if err != nil {
+			return err
+		}
+	}
+
+	backlog, err := queue.Backlog()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Queued: %d uploads, %d deletes, %d bytes\n", backlog.Puts, backlog.Deletes, backlog.Bytes)
+	if backlog.Puts+backlog.Deletes == 0 {
+		return nil
+	}
+
+	fmt.Printf("Oldest: %s\n", time.Unix(backlog.Oldest, 0).Format(time.RFC3339))
+	if backlog.Attempts > 0 {
+		fmt.Printf("Failed attempts: %d, next at %s\n", backlog.Attempts, time.Unix(backlog.NextAttempt, 0).Format(time.RFC3339))
+		fmt.Printf("Last error: %s\n", backlog.LastError)
+	}
+
+	return nil
+}
+
+// flushOutbox drains the outbox before commands that bypass it
+func flushOutbox(config *repository.Config, db *sql.DB) error {
+	if config.Outbox == nil {
+		return nil
+	}
+
+	store, err := repository.OpenStore(".", config, db)
+	if err != nil {
+		return err
+	}
+
+	queue := outbox.Find(store)
+	defer queue.Close()
+
+	if err := queue.Retry(); err != nil {
+		return err
+	}
+
+	if _, err := queue.Drain(); err != nil {
+		return err
+	}
+
+	backlog, err := queue.Backlog()
+	if err != nil {
+		return err
+	} else if backlog.Puts+backlog.Deletes > 0 {
+		return fmt.Errorf("outbox still holds %d changes, run fastcdc outbox -drain", backlog.Puts+backlog.Deletes)
+	}
+
+	config.Outbox = nil
+
+	return nil
+}
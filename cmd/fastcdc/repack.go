@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"fastcdc-backup/pkg/pack"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runRepack(args []string) error {
+	opt := pack.RepackOptions{}
+	opt.SetDefaults()
+
+	fs := flag.NewFlagSet("repack", flag.ExitOnError)
+	fs.Float64Var(&opt.Threshold, "threshold", opt.Threshold, "rewrite packs with a larger fraction of dead bytes")
+	fs.Int64Var(&opt.MaxBytes, "max-bytes", opt.MaxBytes, "maximum live bytes to rewrite in one run, 0 for no limit")
+	fs.IntVar(&opt.MaxPacks, "max-packs", opt.MaxPacks, "maximum packs to rewrite in one run, 0 for no limit")
+	fs.Parse(args)
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	// rewritten packs replace ones that are deleted
+	config, err = repository.Maintain(config)
+	if err != nil {
+		return err
+	}
+
+	held, err := repository.Lock(".", config, true, "repack")
+	if err != nil {
+		return err
+	}
+	defer held.Release()
+
+	db, err := repository.OpenIndex(".")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := flushOutbox(config, db); err != nil {
+		return err
+	}
+
+	store, err := repository.OpenStore(".", config, db)
+	if err != nil {
+		return err
+	}
+
+	packStore, ok := store.(*pack.Store)
+	if !ok {
+		return errors.New("repository does not store chunks in packs")
+	}
+
+	result, err := packStore.Repack(opt)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rewrote %d packs, copied %d live bytes and reclaimed %d bytes\n", result.Packs, result.Rewritten, result.Reclaimed)
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"fastcdc-backup/pkg/cache"
+	"fastcdc-backup/pkg/chunkid"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return errors.New("usage: fastcdc restore <chunklist> <output>")
+	}
+
+	bytes, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fnode := &node.FNode{}
+	if err := json.Unmarshal(bytes, fnode); err != nil {
+		return err
+	}
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	db, err := repository.OpenIndex(".")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	chunkID, err := repository.ChunkIDFunc(".", config)
+	if err != nil {
+		return err
+	}
+
+	store, err := repository.OpenStore(".", config, db)
+	if err != nil {
+		return err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	fo, err := os.Create(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer fo.Close()
+
+	err = fnode.Restore(fo, func(checksum string) ([]byte, error) {
+		data, err := loadVerified(store, chunkID, checksum)
+
+		// a bad copy in the local cache is dropped and fetched again
+		if c := cache.Find(store); err != nil && c != nil {
+			c.Invalidate(checksum)
+			data, err = loadVerified(store, chunkID, checksum)
+		}
+
+		return data, err
+	})
+	if err != nil {
+		os.Remove(fs.Arg(1))
+		return err
+	}
+	fmt.Printf("Restored %s to %s\n", fnode.Path, fs.Arg(1))
+
+	if c := cache.Find(store); c != nil {
+		stats := c.Stats()
+		fmt.Printf("Cache: %d hits, %d misses, %d corrupt entries dropped, %d evicted, %d bytes in %d entries\n",
+			stats.Hits, stats.Misses, stats.Corrupt, stats.Evictions, stats.Bytes, stats.Entries)
+	}
+
+	return fo.Sync()
+}
+
+// loadVerified rehashes a chunk before it is written out
+func loadVerified(store chunkstore.ChunkStore, chunkID chunkid.Func, checksum string) ([]byte, error) {
+	data, err := store.Get(checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chunkid.Verify(chunkID, checksum, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
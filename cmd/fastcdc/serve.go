@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/lock"
+	"fastcdc-backup/pkg/repository"
+	"fastcdc-backup/pkg/serve"
+)
+
+// runServe owns stdout, nothing else may print to it
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	root := fs.String("root", ".", "repository to serve")
+	appendOnly := fs.Bool("append-only", false, "refuse deletes whatever the repository config says, for commands forced on backup clients")
+	fs.Parse(args)
+
+	config, err := repository.Open(*root)
+	if err != nil {
+		return err
+	}
+
+	if *appendOnly {
+		config.AppendOnly = true
+	}
+
+	db, err := repository.OpenIndex(*root)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// one command per process so sessions don't conflict, hidden from clients locking through it
+	held, err := repository.Lock(*root, config, false, fmt.Sprintf("serve %d", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer held.Release()
+
+	store, err := repository.OpenStore(*root, config, db)
+	if err != nil {
+		return err
+	}
+
+	locks, err := repository.OpenLocks(*root, config)
+	if err != nil {
+		return err
+	}
+
+	server := serve.NewServer(store, db)
+	server.EnableLocks(lock.Hide(locks, held))
+	err = server.Serve(os.Stdin, os.Stdout)
+
+	// anything still buffered in a pack has to reach the store before exiting
+	if flusher, ok := store.(chunkstore.Flusher); ok {
+		if flushErr := flusher.Flush(); err == nil {
+			err = flushErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"fastcdc-backup/pkg/lock"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runUnlock(args []string) error {
+	opt := lock.Options{}
+	opt.SetDefaults()
+
+	fs := flag.NewFlagSet("unlock", flag.ExitOnError)
+	all := fs.Bool("all", false, "also remove live locks, only when their holders are known to be gone")
+	list := fs.Bool("list", false, "only list the locks")
+	fs.DurationVar(&opt.StaleAfter, "stale-after", opt.StaleAfter, "remove locks whose heartbeat is older than this")
+	fs.Parse(args)
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	store, err := repository.OpenLocks(".", config)
+	if err != nil {
+		return err
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	locks, err := lock.List(store)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, held := range locks {
+		state := "live"
+		if held.Stale(now, opt) {
+			state = "stale"
+		}
+		fmt.Printf("%s %s\n", state, held)
+	}
+
+	if *list {
+		return nil
+	}
+
+	if !*all {
+		removed, err := lock.RemoveStale(store, opt)
+		fmt.Printf("Removed %d stale locks\n", len(removed))
+		return err
+	}
+
+	for _, held := range locks {
+		if err := lock.Remove(store, held.ID); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Removed %d locks\n", len(locks))
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"fastcdc-backup/pkg/accounting"
+	"fastcdc-backup/pkg/repository"
+)
+
+func runUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	backfill := fs.Bool("backfill", false, "ask the store for the sizes of chunks indexed before sizes were recorded")
+	fs.Parse(args)
+
+	config, err := repository.Open(".")
+	if err != nil {
+		return err
+	}
+
+	db, err := repository.OpenIndex(".")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *backfill {
+		if err := flushOutbox(config, db); err != nil {
+			return err
+		}
+
+		store, err := repository.OpenStore(".", config, db)
+		if err != nil {
+			return err
+		}
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		sized, err := accounting.Backfill(store, db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Recorded the sizes of %d chunks\n", sized)
+	}
+
+	namespaces, err := config.Namespaces(".")
+	if err != nil {
+		return err
+	}
+
+	report, err := accounting.Scan(db, namespaces)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-24s %8s %8s %14s %14s %14s\n", "", "files", "chunks", "logical", "unique", "stored")
+	printTotals("repository", report.Repository)
+	for _, root := range report.Roots {
+		printTotals(root.Name, root.Totals)
+	}
+
+	if report.Unsized > 0 {
+		fmt.Printf("%d chunks have no recorded size, run with -backfill to count them\n", report.Unsized)
+	}
+
+	if config.Quota != nil {
+		stored := report.Repository.Stored
+		if config.Quota.Soft > 0 {
+			fmt.Printf("Soft quota: %d bytes, %.1f%% used\n", config.Quota.Soft, 100*float64(stored)/float64(config.Quota.Soft))
+		}
+		if config.Quota.Hard > 0 {
+			fmt.Printf("Hard quota: %d bytes, %.1f%% used\n", config.Quota.Hard, 100*float64(stored)/float64(config.Quota.Hard))
+		}
+	}
+
+	return nil
+}
+
+func printTotals(name string, totals accounting.Totals) {
+	fmt.Printf("%-24s %8d %8d %14d %14d %14d\n", name, totals.Files, totals.Chunks, totals.Logical, totals.Unique, totals.Stored)
+}
@@ -4,41 +4,97 @@ import (
 	"bufio"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"fastcdc-backup/pkg/chunkstore"
 	"fastcdc-backup/pkg/fastcdc"
+	"fastcdc-backup/pkg/gzipcdc"
+	"fastcdc-backup/pkg/ingest"
+	"fastcdc-backup/pkg/lock"
 	"fastcdc-backup/pkg/node"
-	"fastcdc-backup/pkg/sqlite-chunks"
+	"fastcdc-backup/pkg/outbox"
+	"fastcdc-backup/pkg/repository"
+	"fastcdc-backup/pkg/throttle"
 
 	"github.com/radovskyb/watcher"
 )
 
+// files below this size are fed into one shared chunk stream when spanning is enabled
+const smallFileSize = 8 * 1000
+
+// small file chunks are uploaded in batches of about this many bytes
+const smallFileBatch = 16 << 20
+
+var spanSmallFiles = flag.Bool("span-small-files", false, "chunk small files as one continuous stream")
+var gzipAware = flag.Bool("gzip-aware", false, "chunk the decompressed content of .gz files written by Go's compress/gzip, others are chunked as they are")
+var hostName = flag.String("host", "", "this host's namespace in a repository shared between hosts, the hostname by default")
+
+// override the repository's limits outside its throttle schedules
+var uploadLimit = flag.Int64("upload-limit", 0, "upload bytes per second outside throttle schedules, 0 keeps the repository's limit")
+var downloadLimit = flag.Int64("download-limit", 0, "download bytes per second outside throttle schedules, 0 keeps the repository's limit")
+var maxRequests = flag.Int("max-requests", 0, "parallel requests to the store outside throttle schedules, 0 keeps the repository's limit")
+
+// where the tree under dataDir is backed up, set once opened
+const dataDir = "./data"
+
+var namespace node.Namespace
+
+// chunkerOptions holds the repository's chunk boundaries, set once it is opened
+var chunkerOptions fastcdc.Options
+
+// writer puts chunks into the repository, set once its store is opened
+var writer *ingest.Writer
+
 func check(e error) {
 	if e != nil {
 		panic(e)
 	}
 }
 
-func getFileChunks(path string) ([]fastcdc.Chunk, error) {
-	fi, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// getFileChunks also returns gzip recompression parameters when used
+func getFileChunks(path string) ([]fastcdc.Chunk, *gzipcdc.Params, error) {
+	var fi io.ReadCloser
+	var params *gzipcdc.Params
+
+	if *gzipAware && gzipcdc.IsGzip(path) {
+		var err error
+
+		params, err = gzipcdc.Analyze(path)
+		if err == gzipcdc.ErrNotReproducible { // fall back to chunking the raw bytes
+			params = nil
+		} else if err != nil {
+			return nil, nil, err
+		}
 	}
-	defer fi.Close()
 
-	// set options
-	opt := fastcdc.Options{}
-	opt.SetDefaults()
+	if params != nil {
+		zr, err := gzipcdc.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		fi = zr
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		fi = f
+	}
+	defer fi.Close()
 
 	// buffered reader is more efficient for many small reads
 	br := bufio.NewReaderSize(fi, 4096)
-	chunker := fastcdc.NewChunker(br, opt)
+	chunker := fastcdc.NewChunker(br, chunkerOptions)
 
 	chunks := []fastcdc.Chunk{}
 
@@ -49,82 +105,196 @@ func getFileChunks(path string) ([]fastcdc.Chunk, error) {
 			fmt.Printf("Finished chunking %s\n", path)
 			break
 		} else if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		chunks = append(chunks, chunk)
 	}
 
-	return chunks, nil
+	return chunks, params, nil
 }
 
-func writeChunk(chunk *fastcdc.Chunk) error {
-	filename := fmt.Sprintf("%x", chunk.Checksum())
-	path := filepath.Join("./chunks", filename)
-
-	fo, err := os.Create(path)
+// chunklistPath returns where the chunklist of a file under dataDir is kept
+func chunklistPath(filePath string) (string, error) {
+	rel, err := filepath.Rel(dataDir, filePath)
 	if err != nil {
-		return err
-	}
-	defer fo.Close()
-
-	n, err := fo.Write(chunk.Data)
-	if err != nil {
-		return err
+		return "", err
 	}
-	fmt.Printf("Wrote %d bytes to %s\n", n, filename)
 
-	return nil
+	return filepath.Join(namespace.Chunklists, rel), nil
 }
 
+// writeChunklist replaces the chunklist atomically, a failed write leaves the previous one
 func writeChunklist(fnode *node.FNode) error {
 	chunklistJSON, err := json.Marshal(fnode)
 	if err != nil {
 		return err
 	}
 
-	path := strings.Replace(fnode.Path, "data", "chunklists", 1)
+	path, err := chunklistPath(fnode.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
 
-	fo, err := os.Create(path)
+	// a fixed temp name could be another file's chunklist
+	fo, err := os.CreateTemp(filepath.Dir(path), ".chunklist-*")
 	if err != nil {
 		return err
 	}
-	defer fo.Close()
+	defer os.Remove(fo.Name())
 
 	_, err = fo.Write(chunklistJSON)
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
+
+	if err := os.Chmod(fo.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(fo.Name(), path); err != nil {
+		return err
+	}
 	fmt.Printf("Wrote chunklist to %s\n", path)
 
 	return nil
 }
 
-func processNewChunk(db *sql.DB, checksum string, newChunk *fastcdc.Chunk) error {
-	if sqlitechunks.Exists(db, checksum) { // chunk entry exists in internal db
-		// increase instance count of chunk entry
-		sqlitechunks.IncreaseCount(db, checksum)
+// releaseChunklist drops every reference a chunklist holds
+func releaseChunklist(fnode *node.FNode) error {
+	for _, checksum := range fnode.References() {
+		if err := writer.Release(checksum); err != nil {
+			return err
+		}
+	}
 
-	} else {
-		// write to chunk directory and send it to server for addition to r2 bucket
-		writeChunk(newChunk)
+	return nil
+}
 
-		// TODO: send chunk to server for addition to R2
+// replaceChunklist writes fnode, whose references are already added, then releases
+// old's. If the write fails fnode's references are released instead.
+func replaceChunklist(fnode, old *node.FNode) error {
+	if err := writeChunklist(fnode); err != nil {
+		if releaseErr := releaseChunklist(fnode); releaseErr != nil {
+			fmt.Printf("Failed to release the references of %s: %v\n", fnode.Path, releaseErr)
+		}
+		return err
+	}
+
+	if old == nil {
+		return nil
+	}
+
+	return releaseChunklist(old)
+}
+
+func readChunklist(filePath string) (*node.FNode, error) {
+	path, err := chunklistPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	bytes, err := io.ReadAll(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	chunklist := &node.FNode{}
+	if err := json.Unmarshal(bytes, chunklist); err != nil {
+		return nil, err
+	}
+
+	return chunklist, nil
+}
+
+// hasChunklist finds chunklists left by a run that failed before saving
+func hasChunklist(filePath string) bool {
+	path, err := chunklistPath(filePath)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(path)
+
+	return err == nil
+}
+
+// uploadChunks uploads the chunks the store doesn't hold as one batch, returning their IDs
+func uploadChunks(store chunkstore.ChunkStore, chunks []fastcdc.Chunk) ([]string, error) {
+	checksums := []string{}
+	for _, chunk := range chunks {
+		checksums = append(checksums, writer.ID(chunk.Data))
+	}
+
+	// the index may count chunks whose pack never made it out
+	missing, err := chunkstore.Missing(store, checksums)
+	if err != nil {
+		return nil, err
+	}
+
+	isMissing := map[string]bool{}
+	for _, checksum := range missing {
+		isMissing[checksum] = true
+	}
+
+	uploads := []chunkstore.Object{}
+	for i, chunk := range chunks {
+		if isMissing[checksums[i]] {
+			uploads = append(uploads, chunkstore.Object{ID: checksums[i], Data: chunk.Data})
+			delete(isMissing, checksums[i])
+		}
+	}
+
+	// the store only transfers what it doesn't already hold
+	err = writer.Upload(uploads)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Stored %d new chunks\n", len(uploads))
+
+	return checksums, nil
+}
+
+// storeChunks uploads unindexed chunks as a batch, then references them all
+func storeChunks(db *sql.DB, store chunkstore.ChunkStore, chunks []fastcdc.Chunk) error {
+	checksums, err := uploadChunks(store, chunks)
+	if err != nil {
+		return err
+	}
+
+	for _, checksum := range checksums {
+		if err := writer.AddReference(checksum); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func processNewFile(db *sql.DB, file *node.Node) error {
+func processNewFile(db *sql.DB, store chunkstore.ChunkStore, file *node.Node) error {
 	if file.IsDir {
 		for _, child := range file.Children {
-			err := processNewFile(db, child)
+			err := processNewFile(db, store, child)
 			if err != nil {
 				return err
 			}
 		}
+	} else if hasChunklist(file.Path) {
+		return processModifiedFile(db, store, file)
 	} else {
-		chunks, err := getFileChunks(file.Path)
+		chunks, params, err := getFileChunks(file.Path)
 		if err != nil {
 			return err
 		}
@@ -133,57 +303,52 @@ func processNewFile(db *sql.DB, file *node.Node) error {
 		checksums := []string{}
 
 		for _, chunk := range chunks {
-			checksum := fmt.Sprintf("%x", chunk.Checksum())
+			checksum := writer.ID(chunk.Data)
 			checksums = append(checksums, checksum)
 
 			size += int64(chunk.Size)
+		}
 
-			err := processNewChunk(db, checksum, &chunk)
-			if err != nil {
-				return err
-			}
+		err = storeChunks(db, store, chunks)
+		if err != nil {
+			return err
 		}
 
 		// write chunklist to node.Path, replacing "data" with "chunklists" as the path base
 		path := file.Path
 
+		if params != nil {
+			size = params.Size
+		}
+
 		fnode := &node.FNode{
 			Path:   path,
 			Size:   size,
 			Chunks: checksums,
+			Gzip:   params,
 		}
-		writeChunklist(fnode)
+
+		return replaceChunklist(fnode, nil)
 	}
 
 	return nil
 }
 
-func processModifiedFile(db *sql.DB, file *node.Node) error {
+func processModifiedFile(db *sql.DB, store chunkstore.ChunkStore, file *node.Node) error {
 	if file.IsDir {
 		for _, child := range file.Children {
-			err := processModifiedFile(db, child)
+			err := processModifiedFile(db, store, child)
 			if err != nil {
 				return err
 			}
 		}
 	} else {
-		path := strings.Replace(file.Path, "data", "chunklists", 1)
-
-		fi, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer fi.Close()
-
-		bytes, err := io.ReadAll(fi)
+		oldChunkList, err := readChunklist(file.Path)
 		if err != nil {
 			return err
 		}
 
-		oldChunkList := node.FNode{}
-		json.Unmarshal(bytes, &oldChunkList)
-
-		newChunkList, err := getFileChunks(file.Path)
+		newChunkList, params, err := getFileChunks(file.Path)
 		if err != nil {
 			return err
 		}
@@ -191,112 +356,216 @@ func processModifiedFile(db *sql.DB, file *node.Node) error {
 		size := int64(0)
 		checksums := []string{}
 
-		newChunks := []fastcdc.Chunk{}
-
-		chunks := map[string]bool{}
-
-		for _, chunk := range oldChunkList.Chunks {
-			chunks[chunk] = false
-		}
-
 		for _, chunk := range newChunkList {
-			checksum := fmt.Sprintf("%x", chunk.Checksum())
-			checksums = append(checksums, checksum)
+			checksums = append(checksums, writer.ID(chunk.Data))
 
 			size += int64(chunk.Size)
-
-			if _, ok := chunks[checksum]; ok { // same chunk persists between both list versions
-				chunks[checksum] = true
-			} else { // introduction of a new chunk
-				newChunks = append(newChunks, chunk)
-			}
 		}
 
-		for checksum, inNew := range chunks {
-			if !inNew { // chunk in previous list was not encountered
-				err := processDeletedChunk(db, checksum)
-				if err != nil {
-					return err
-				}
-			}
+		// add every new reference before releasing the old ones
+		err = storeChunks(db, store, newChunkList)
+		if err != nil {
+			return err
 		}
 
-		// add new chunks
-		for _, newChunk := range newChunks {
-			checksum := fmt.Sprintf("%x", newChunk.Checksum())
-
-			err := processNewChunk(db, checksum, &newChunk)
-			if err != nil {
-				return err
-			}
+		if params != nil {
+			size = params.Size
 		}
 
 		fnode := &node.FNode{
 			Path:   file.Path,
 			Size:   size,
 			Chunks: checksums,
+			Gzip:   params,
 		}
-		// replace old chunklist
-		writeChunklist(fnode)
+
+		return replaceChunklist(fnode, oldChunkList)
 	}
 
 	return nil
 }
 
-func processDeletedChunk(db *sql.DB, checksum string) error {
-	// decrease chunk instance_count in db
-	sqlitechunks.DecreaseCount(db, checksum)
-	instances := sqlitechunks.GetCount(db, checksum)
+func processDeletedFile(db *sql.DB, store chunkstore.ChunkStore, file *node.Node) error {
+	if file.IsDir {
+		for _, child := range file.Children {
+			err := processDeletedFile(db, store, child)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		oldChunklist, err := readChunklist(file.Path)
+		if err != nil {
+			return err
+		}
+
+		if err := releaseChunklist(oldChunklist); err != nil {
+			return err
+		}
 
-	if instances == 0 { // instance_count reaches 0 after decrease
-		path := filepath.Join("./chunks", checksum)
-		err := os.Remove(path)
+		path, err := chunklistPath(file.Path)
 		if err != nil {
 			return err
 		}
 
-		// TODO: remove chunk from db, request server for R2 removal of chunk
-		// SERVER: if chunk does not exist in snapshot cache, proceed with removal
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func processDeletedFile(db *sql.DB, file *node.Node) error {
-	if file.IsDir {
-		for _, child := range file.Children {
-			err := processDeletedFile(db, child)
+// splitSmallFiles flattens directories and separates out files below smallFileSize
+func splitSmallFiles(files []*node.Node) ([]*node.Node, []*node.Node, error) {
+	large, small := []*node.Node{}, []*node.Node{}
+
+	for _, file := range files {
+		if file.IsDir {
+			tmpL, tmpS, err := splitSmallFiles(file.Children)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
+
+			large = append(large, tmpL...)
+			small = append(small, tmpS...)
+			continue
 		}
-	} else {
-		path := strings.Replace(file.Path, "data", "chunklists", 1)
 
-		fi, err := os.Open(path)
+		fileInfo, err := os.Stat(file.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if fileInfo.Size() < smallFileSize {
+			small = append(small, file)
+		} else {
+			large = append(large, file)
+		}
+	}
+
+	return large, small, nil
+}
+
+// processSmallFiles chunks small files as one stream of shared chunks
+func processSmallFiles(db *sql.DB, store chunkstore.ChunkStore, newFiles, modifiedFiles []*node.Node) error {
+	// previous chunklists are released only once the new references are in place
+	oldChunklists := map[string]*node.FNode{}
+	for _, file := range newFiles {
+		if !hasChunklist(file.Path) {
+			continue
+		}
+
+		chunklist, err := readChunklist(file.Path)
 		if err != nil {
 			return err
 		}
-		defer fi.Close()
 
-		bytes, err := io.ReadAll(fi)
+		oldChunklists[file.Path] = chunklist
+	}
+	for _, file := range modifiedFiles {
+		chunklist, err := readChunklist(file.Path)
 		if err != nil {
 			return err
 		}
 
-		oldChunklist := node.FNode{}
-		json.Unmarshal(bytes, &oldChunklist)
+		oldChunklists[file.Path] = chunklist
+	}
+
+	paths := []string{}
+	for _, file := range newFiles {
+		paths = append(paths, file.Path)
+	}
+	for _, file := range modifiedFiles {
+		paths = append(paths, file.Path)
+	}
+
+	if len(paths) == 0 {
+		return nil
+	}
 
-		for _, checksum := range oldChunklist.Chunks {
-			err := processDeletedChunk(db, checksum)
-			if err != nil {
+	stream := fastcdc.NewFileStream(paths)
+	defer stream.Close()
+
+	br := bufio.NewReaderSize(stream, 4096)
+	chunker := fastcdc.NewChunker(br, chunkerOptions)
+
+	chunks := []fastcdc.Chunk{}
+	checksums := []string{}
+
+	// chunks are uploaded in batches, references follow per slice
+	batch := []fastcdc.Chunk{}
+	batchBytes := 0
+
+	upload := func() error {
+		ids, err := uploadChunks(store, batch)
+		if err != nil {
+			return err
+		}
+
+		for _, chunk := range batch {
+			// only the chunk boundaries are needed from here on
+			chunk.Data = nil
+			chunks = append(chunks, chunk)
+		}
+		checksums = append(checksums, ids...)
+
+		batch = []fastcdc.Chunk{}
+		batchBytes = 0
+
+		return nil
+	}
+
+	for {
+		chunk, err := chunker.NextChunk()
+
+		if err == io.EOF {
+			fmt.Printf("Finished chunking %d small files\n", len(paths))
+			break
+		} else if err != nil {
+			return err
+		}
+
+		batch = append(batch, chunk)
+		batchBytes += len(chunk.Data)
+
+		if batchBytes >= smallFileBatch {
+			if err := upload(); err != nil {
 				return err
 			}
 		}
+	}
 
-		// delete chunklist at node.Path, replacing "data" with "chunklists" as the path base
-		err = os.Remove(path)
-		if err != nil {
+	if err := upload(); err != nil {
+		return err
+	}
+
+	extents := stream.Extents()
+	slices := fastcdc.SplitExtents(extents, chunks)
+
+	for i, extent := range extents {
+		fnode := &node.FNode{
+			Path:   extent.Path,
+			Size:   int64(extent.Size),
+			Chunks: []string{},
+			Slices: []node.Slice{},
+		}
+
+		for _, slice := range slices[i] {
+			checksum := checksums[slice.Chunk]
+			if err := writer.AddReference(checksum); err != nil {
+				return err
+			}
+
+			fnode.Slices = append(fnode.Slices, node.Slice{
+				Chunk:  checksum,
+				Offset: int64(slice.Offset),
+				Length: int64(slice.Length),
+			})
+		}
+
+		if err := replaceChunklist(fnode, oldChunklists[extent.Path]); err != nil {
 			return err
 		}
 	}
@@ -352,36 +621,58 @@ func walk(rootOld, rootNew *node.Node, timeOld int64) ([]*node.Node, []*node.Nod
 	return newFiles, modifiedFiles, deletedFiles
 }
 
-func initHierarchy() error {
-	_, err := os.Stat("./hierarchy.json")
-	if os.IsNotExist(err) {
-		rootNode, err := node.LoadHierarchy("./data")
-		if err != nil {
-			return err
-		}
+// saveHierarchy records the tree as backed up at accessed
+func saveHierarchy(root *node.Node, accessed int64) error {
+	tree := node.Tree{
+		Root:         root,
+		TimeAccessed: accessed,
+	}
 
-		tree := node.Tree{
-			Root:         rootNode,
-			TimeAccessed: time.Now().Unix(),
-		}
+	hierarchyJSON, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
 
-		hierarchyJSON, err := json.Marshal(tree)
-		if err != nil {
-			return err
-		}
+	if err := os.MkdirAll(filepath.Dir(namespace.Hierarchy), 0755); err != nil {
+		return err
+	}
 
-		fo, err := os.Create("./hierarchy.json")
-		if err != nil {
-			return err
+	// a crash mid-write must not lose the previous tree
+	tmp := namespace.Hierarchy + ".tmp"
+	if err := os.WriteFile(tmp, hierarchyJSON, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, namespace.Hierarchy)
+}
+
+// withoutPaths copies a tree leaving out the nodes at paths
+func withoutPaths(n *node.Node, paths map[string]bool) *node.Node {
+	pruned := &node.Node{Path: n.Path, IsDir: n.IsDir, Children: []*node.Node{}}
+
+	for _, child := range n.Children {
+		if !paths[child.Path] {
+			pruned.Children = append(pruned.Children, withoutPaths(child, paths))
 		}
-		defer fo.Close()
+	}
+
+	return pruned
+}
+
+func initHierarchy(config *repository.Config) error {
+	// changes made while this run reads the tree are picked up by the next
+	started := time.Now().Unix()
 
-		_, err = fo.Write(hierarchyJSON)
+	_, err := os.Stat(namespace.Hierarchy)
+	if os.IsNotExist(err) {
+		rootNode, err := node.LoadHierarchy(dataDir)
 		if err != nil {
 			return err
 		}
+
+		return saveHierarchy(rootNode, started)
 	} else { // compare tracked hierarchy with previous version
-		fi, err := os.Open("./hierarchy.json")
+		fi, err := os.Open(namespace.Hierarchy)
 		if err != nil {
 			return err
 		}
@@ -397,38 +688,251 @@ func initHierarchy() error {
 
 		rootOld, timeOld := treeOld.Root, treeOld.TimeAccessed
 
-		rootNew, err := node.LoadHierarchy("./data")
+		rootNew, err := node.LoadHierarchy(dataDir)
 		if err != nil {
 			return err
 		}
 
 		newFiles, modifiedFiles, deletedFiles := walk(rootOld, rootNew, timeOld)
 
-		db, err := sqlitechunks.OpenDB("./db/chunks.sqlite")
+		db, err := repository.OpenIndex(".")
 		if err != nil {
 			return err
 		}
 		defer db.Close()
 
+		opt := ingest.Options{}
+		opt.SetDefaults()
+		opt.Collected = config.Collected()
+
+		opt.ChunkID, err = repository.ChunkIDFunc(".", config)
+		if err != nil {
+			return err
+		}
+
+		if config.Quota != nil {
+			opt.Quota = *config.Quota
+		}
+
+		store, err := repository.OpenStore(".", config, db)
+		if err != nil {
+			return err
+		}
+
+		writer, err = ingest.NewWriter(db, store, opt)
+		if err != nil {
+			return err
+		}
+
+		// stores talking to a remote process hold it open until closed
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		// packed chunks are only written out once the pack is flushed
+		if flusher, ok := store.(chunkstore.Flusher); ok {
+			defer func() {
+				if err := flusher.Flush(); err != nil {
+					fmt.Println(err)
+				}
+			}()
+		}
+
+		if *spanSmallFiles {
+			var smallNew, smallModified []*node.Node
+
+			newFiles, smallNew, err = splitSmallFiles(newFiles)
+			if err != nil {
+				return err
+			}
+
+			modifiedFiles, smallModified, err = splitSmallFiles(modifiedFiles)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println("small files")
+			err = processSmallFiles(db, store, smallNew, smallModified)
+			if err != nil {
+				return err
+			}
+		}
+
+		// files over quota are left out of the tree to retry next run
+		failed := map[string]bool{}
+
 		fmt.Println("new files")
 		for _, newFile := range newFiles {
-			processNewFile(db, newFile)
+			if err := processNewFile(db, store, newFile); err != nil {
+				fmt.Println(err)
+				failed[newFile.Path] = true
+			}
 		}
 
 		fmt.Println("modified files")
 		for _, modifiedFile := range modifiedFiles {
-			processModifiedFile(db, modifiedFile)
+			if err := processModifiedFile(db, store, modifiedFile); err != nil {
+				fmt.Println(err)
+				failed[modifiedFile.Path] = true
+			}
 		}
 
 		fmt.Println("deleted files")
 		for _, deletedFile := range deletedFiles {
-			processDeletedFile(db, deletedFile)
+			if err := processDeletedFile(db, store, deletedFile); err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		if queue := outbox.Find(store); queue != nil {
+			backlog, err := queue.Backlog()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d uploads and %d deletes (%d bytes) queued in the outbox\n", backlog.Puts, backlog.Deletes, backlog.Bytes)
+		}
+
+		// the tree is only saved once the chunks it refers to are written out
+		if flusher, ok := store.(chunkstore.Flusher); ok {
+			if err := flusher.Flush(); err != nil {
+				return err
+			}
 		}
+
+		return saveHierarchy(withoutPaths(rootNew, failed), started)
 	}
+}
+
+// startOutbox drains the outbox in the background, if there is one
+func startOutbox(config *repository.Config) error {
+	if config.Outbox == nil {
+		return nil
+	}
+
+	db, err := repository.OpenIndex(".")
+	if err != nil {
+		return err
+	}
+
+	store, err := repository.OpenStore(".", config, db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	go outbox.Find(store).Run(nil, func(err error) {
+		fmt.Println(err)
+	})
 
 	return nil
 }
 
+// cacheSnapshot keeps the backup's chunks on the chunk server until the next run
+func cacheSnapshot(config *repository.Config) error {
+	if config.Server == "" {
+		return nil
+	}
+
+	ids := []string{}
+	seen := map[string]bool{}
+
+	err := filepath.WalkDir(namespace.Chunklists, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == namespace.Chunklists {
+				return filepath.SkipDir
+			}
+			return err
+		} else if entry.IsDir() {
+			return nil
+		}
+
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		chunklist := &node.FNode{}
+		if err := json.Unmarshal(bytes, chunklist); err != nil {
+			return err
+		}
+
+		for _, checksum := range chunklist.References() {
+			if !seen[checksum] {
+				seen[checksum] = true
+				ids = append(ids, checksum)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	client := repository.ServerClient(config)
+	name := namespace.Qualify("backup")
+
+	if len(ids) == 0 {
+		err := client.DeleteSnapshot(name)
+		if err != nil && err != chunkstore.ErrNotFound {
+			return err
+		}
+
+		return nil
+	}
+
+	return client.PutSnapshot(name, ids)
+}
+
+func applyThrottle(config *repository.Config) error {
+	if *uploadLimit == 0 && *downloadLimit == 0 && *maxRequests == 0 {
+		return nil
+	}
+
+	if config.Throttle == nil {
+		config.Throttle = &throttle.Options{}
+		config.Throttle.SetDefaults()
+	}
+
+	if *uploadLimit != 0 {
+		config.Throttle.UploadBytesPerSec = *uploadLimit
+	}
+	if *downloadLimit != 0 {
+		config.Throttle.DownloadBytesPerSec = *downloadLimit
+	}
+	if *maxRequests != 0 {
+		config.Throttle.MaxRequests = *maxRequests
+	}
+
+	return config.Throttle.Validate()
+}
+
+// the lock of the running backup pass, if any
+var passMu sync.Mutex
+var passLock *lock.Handle
+
+// backupPass runs a pass under a shared lock, so gc waits for passes but not for an idle watcher
+func backupPass(config *repository.Config, run func() error) error {
+	held, err := repository.Lock(".", config, false, "watcher")
+	if err != nil {
+		return err
+	}
+
+	passMu.Lock()
+	passLock = held
+	passMu.Unlock()
+
+	defer func() {
+		passMu.Lock()
+		passLock = nil
+		passMu.Unlock()
+
+		held.Release()
+	}()
+
+	return run()
+}
+
 func main() {
 	defer func() {
 		if str := recover(); str != nil {
@@ -436,12 +940,51 @@ func main() {
 		}
 	}()
 
-	err := initHierarchy()
+	flag.Parse()
+
+	config, err := repository.Open(".")
+	check(err)
+	chunkerOptions = config.Chunker
+
+	err = applyThrottle(config)
+	check(err)
+
+	if *hostName == "" {
+		*hostName, err = os.Hostname()
+		check(err)
+	}
+	namespace, err = config.Namespace(".", *hostName)
+	check(err)
+
+	// the watcher only stops when killed, release the lock on the way out
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+
+		passMu.Lock()
+		if passLock != nil {
+			passLock.Release()
+		}
+		os.Exit(1)
+	}()
+
+	// chunks queued while offline start going out straight away
+	err = startOutbox(config)
+	check(err)
+
+	err = backupPass(config, func() error {
+		if err := initHierarchy(config); err != nil {
+			return err
+		}
+
+		return cacheSnapshot(config)
+	})
 	check(err)
 	w := watcher.New()
 
 	rules := []string{}
-	directories := []string{"./data"}
+	directories := []string{dataDir}
 
 	// set regular expression rules
 	for _, rule := range rules {
@@ -4,4 +4,14 @@ go 1.19
 
 require github.com/radovskyb/watcher v1.0.7
 
-require github.com/mattn/go-sqlite3 v1.14.17 // indirect
+require (
+	github.com/klauspost/reedsolomon v1.10.0
+	github.com/mattn/go-sqlite3 v1.14.17
+)
+
+require github.com/klauspost/cpuid/v2 v2.1.0 // indirect
+
+require (
+	golang.org/x/crypto v0.28.0
+	golang.org/x/sys v0.26.0 // indirect
+)
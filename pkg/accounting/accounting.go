@@ -0,0 +1,217 @@
+package accounting
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+var ErrQuotaExceeded = errors.New("repository is over its hard quota")
+
+// Quota limits the bytes the store holds for a repository, 0 means no limit
+type Quota struct {
+	// passing it only warns
+	Soft int64
+
+	// uploads that would take the repository past it are refused
+	Hard int64
+}
+
+func (q Quota) Validate() error {
+	if q.Soft < 0 || q.Hard < 0 {
+		return fmt.Errorf("quotas can't be negative")
+	} else if q.Soft > 0 && q.Hard > 0 && q.Soft > q.Hard {
+		return fmt.Errorf("soft quota %d is above the hard quota %d", q.Soft, q.Hard)
+	}
+
+	return nil
+}
+
+// OverSoft reports whether stored bytes are past the soft quota
+func (q Quota) OverSoft(stored int64) bool {
+	return q.Soft > 0 && stored > q.Soft
+}
+
+// Check returns ErrQuotaExceeded past the hard quota
+func (q Quota) Check(stored, adding int64) error {
+	if q.Hard > 0 && stored+adding > q.Hard {
+		return fmt.Errorf("%w: it holds %d bytes, storing %d more would pass the limit of %d", ErrQuotaExceeded, stored, adding, q.Hard)
+	}
+
+	return nil
+}
+
+// Totals are file bytes, distinct chunk bytes and bytes the store holds
+type Totals struct {
+	Files   int
+	Chunks  int
+	Logical int64
+	Unique  int64
+	Stored  int64
+}
+
+// Root is a top level entry, named after the host when shared
+type Root struct {
+	Name string
+	Totals
+}
+
+type Report struct {
+	Repository Totals
+
+	// chunks shared between roots count towards each of them
+	Roots []Root
+
+	// chunks without recorded sizes, left out until backfilled
+	Unsized int
+}
+
+// Scan adds up every namespace's chunklists
+func Scan(db *sql.DB, namespaces []node.Namespace) (*Report, error) {
+	sizes, err := sqlitechunks.ListSizes(db)
+	if err != nil {
+		return nil, err
+	}
+
+	unsized, err := sqlitechunks.Unsized(db)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Roots:   []Root{},
+		Unsized: len(unsized),
+	}
+
+	for _, size := range sizes {
+		report.Repository.Chunks++
+		report.Repository.Unique += size.Size
+		report.Repository.Stored += size.Stored
+	}
+	report.Repository.Chunks += len(unsized)
+
+	roots := map[string]*Root{}
+	seen := map[string]map[string]bool{}
+
+	for _, namespace := range namespaces {
+		if err := scanChunklists(namespace, sizes, roots, seen, report); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, root := range roots {
+		report.Roots = append(report.Roots, *root)
+	}
+	sort.Slice(report.Roots, func(i, j int) bool {
+		return report.Roots[i].Name < report.Roots[j].Name
+	})
+
+	return report, nil
+}
+
+// scanChunklists adds up one host's chunklists into its roots
+func scanChunklists(namespace node.Namespace, sizes map[string]sqlitechunks.ChunkSize, roots map[string]*Root, seen map[string]map[string]bool, report *Report) error {
+	dir := namespace.Chunklists
+
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		} else if entry.IsDir() {
+			return nil
+		}
+
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		fnode := &node.FNode{}
+		if err := json.Unmarshal(bytes, fnode); err != nil {
+			// check reports these
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := namespace.Qualify(strings.SplitN(filepath.ToSlash(rel), "/", 2)[0])
+
+		root, ok := roots[name]
+		if !ok {
+			root = &Root{Name: name}
+			roots[name] = root
+			seen[name] = map[string]bool{}
+		}
+
+		root.Files++
+		root.Logical += fnode.Size
+		report.Repository.Files++
+		report.Repository.Logical += fnode.Size
+
+		for _, checksum := range fnode.References() {
+			if seen[name][checksum] {
+				continue
+			}
+			seen[name][checksum] = true
+
+			root.Chunks++
+			root.Unique += sizes[checksum].Size
+			root.Stored += sizes[checksum].Stored
+		}
+
+		return nil
+	})
+}
+
+// Measure returns the sizes to record for chunks just put into a store
+func Measure(objects []chunkstore.Object) []sqlitechunks.ChunkSize {
+	sizes := []sqlitechunks.ChunkSize{}
+	for _, object := range objects {
+		sizes = append(sizes, sqlitechunks.ChunkSize{Checksum: object.ID, Size: int64(len(object.Data)), Stored: object.StoredSize()})
+	}
+
+	return sizes
+}
+
+// Backfill records missing sizes from the store, skipping absent chunks
+func Backfill(store chunkstore.ChunkStore, db *sql.DB) (int, error) {
+	unsized, err := sqlitechunks.Unsized(db)
+	if err != nil {
+		return 0, err
+	}
+
+	base := chunkstore.Base(store)
+
+	sizes := []sqlitechunks.ChunkSize{}
+	for _, checksum := range unsized {
+		info, err := store.Stat(checksum)
+		if err == chunkstore.ErrNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		stored, err := base.Stat(checksum)
+		if err != nil {
+			return 0, err
+		}
+
+		sizes = append(sizes, sqlitechunks.ChunkSize{Checksum: checksum, Size: info.Size, Stored: stored.Size})
+	}
+
+	return len(sizes), sqlitechunks.SetSizes(db, sizes)
+}
@@ -0,0 +1,132 @@
+package accounting
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+func TestQuotaValidate(t *testing.T) {
+	for _, quota := range []Quota{{Soft: -1}, {Hard: -1}, {Soft: 200, Hard: 100}} {
+		if quota.Validate() == nil {
+			t.Fatalf("%+v passed validation", quota)
+		}
+	}
+
+	for _, quota := range []Quota{{}, {Soft: 100}, {Hard: 100}, {Soft: 100, Hard: 100}} {
+		if err := quota.Validate(); err != nil {
+			t.Fatalf("%+v: %v", quota, err)
+		}
+	}
+}
+
+func TestQuotaCheck(t *testing.T) {
+	quota := Quota{Soft: 50, Hard: 100}
+
+	if err := quota.Check(60, 40); err != nil {
+		t.Fatalf("filling the quota exactly failed: %v", err)
+	}
+	if err := quota.Check(60, 41); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("passing the hard quota returned %v, want ErrQuotaExceeded", err)
+	}
+	if err := (Quota{Soft: 50}).Check(1<<40, 1<<40); err != nil {
+		t.Fatalf("a soft quota refused an upload: %v", err)
+	}
+
+	if quota.OverSoft(50) || !quota.OverSoft(51) {
+		t.Fatal("the soft quota is only passed above its limit")
+	}
+	if (Quota{}).OverSoft(1 << 40) {
+		t.Fatal("no soft quota was reported as passed")
+	}
+}
+
+func writeChunklist(t *testing.T, dir string, fnode *node.FNode) {
+	data, err := json.Marshal(fnode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, fnode.Path+".json")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := sqlitechunks.OpenDB(filepath.Join(dir, "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := sqlitechunks.CreateTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitechunks.CreateSizeTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, checksum := range []string{"shared", "alpha", "beta", "unsized"} {
+		if err := sqlitechunks.AddReference(db, checksum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sqlitechunks.SetSizes(db, []sqlitechunks.ChunkSize{
+		{Checksum: "shared", Size: 100, Stored: 60},
+		{Checksum: "alpha", Size: 50, Stored: 30},
+		{Checksum: "beta", Size: 20, Stored: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces := []node.Namespace{
+		{Host: "a", Chunklists: filepath.Join(dir, "a")},
+		{Host: "b", Chunklists: filepath.Join(dir, "b")},
+	}
+
+	// a chunk repeated within a root counts once
+	writeChunklist(t, namespaces[0].Chunklists, &node.FNode{Path: "docs/x", Size: 250, Chunks: []string{"shared", "alpha", "shared"}})
+	writeChunklist(t, namespaces[1].Chunklists, &node.FNode{Path: "docs/y", Size: 130, Chunks: []string{"shared", "beta", "unsized"}})
+
+	if err := os.WriteFile(filepath.Join(namespaces[0].Chunklists, "docs", "bad.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Scan(db, namespaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Totals{Files: 2, Chunks: 4, Logical: 380, Unique: 170, Stored: 110}
+	if report.Repository != want {
+		t.Fatalf("repository totals %+v, want %+v", report.Repository, want)
+	}
+	if report.Unsized != 1 {
+		t.Fatalf("%d unsized chunks, want 1", report.Unsized)
+	}
+
+	roots := []Root{
+		{Name: "a:docs", Totals: Totals{Files: 1, Chunks: 2, Logical: 250, Unique: 150, Stored: 90}},
+		{Name: "b:docs", Totals: Totals{Files: 1, Chunks: 3, Logical: 130, Unique: 120, Stored: 80}},
+	}
+	if len(report.Roots) != len(roots) {
+		t.Fatalf("roots %+v, want %+v", report.Roots, roots)
+	}
+	for i, root := range roots {
+		if report.Roots[i] != root {
+			t.Fatalf("root %+v, want %+v", report.Roots[i], root)
+		}
+	}
+}
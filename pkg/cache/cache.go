@@ -0,0 +1,394 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// cache entries are written under a temporary name and renamed into place
+const tempPrefix = ".tmp-"
+
+// younger temp files may belong to another process filling the cache
+const staleTemp = time.Hour
+
+type Options struct {
+	Dir string
+
+	// least recently used objects are evicted to stay under this many bytes
+	MaxBytes int64
+}
+
+func (o *Options) SetDefaults() {
+	o.Dir = "./cache"
+	o.MaxBytes = 1 << 30
+}
+
+type Stats struct {
+	Hits      int64
+	Misses    int64
+	Corrupt   int64
+	Evictions int64
+	Entries   int
+	Bytes     int64
+}
+
+type entry struct {
+	id   string
+	size int64
+}
+
+// Store is a checksummed read-through disk cache, writes aren't cached
+type Store struct {
+	inner chunkstore.ChunkStore
+	dir   string
+	max   int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   Stats
+}
+
+// NewStore opens the cache in opt.Dir, keeping earlier entries
+func NewStore(inner chunkstore.ChunkStore, opt Options) (*Store, error) {
+	if err := os.MkdirAll(opt.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		inner:   inner,
+		dir:     opt.Dir,
+		max:     opt.MaxBytes,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	store.evict()
+	store.mu.Unlock()
+
+	return store, nil
+}
+
+func (s *Store) load() error {
+	type found struct {
+		entry
+		used time.Time
+	}
+	files := []found{}
+
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			if time.Since(info.ModTime()) < staleTemp {
+				return nil
+			}
+
+			err := os.Remove(path)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		// too short for the checksum or somewhere lookup won't find it
+		if info.Size() < sha256.Size || path != s.path(d.Name()) {
+			err := os.Remove(path)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		files = append(files, found{entry{d.Name(), info.Size() - sha256.Size}, info.ModTime()})
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].used.After(files[j].used)
+	})
+
+	for _, file := range files {
+		e := file.entry
+		s.entries[e.id] = s.lru.PushBack(&e)
+		s.stats.Entries++
+		s.stats.Bytes += file.size
+	}
+
+	return nil
+}
+
+func (s *Store) path(id string) string {
+	if len(id) < 2 {
+		return filepath.Join(s.dir, id)
+	}
+
+	return filepath.Join(s.dir, id[:2], id)
+}
+
+// evict drops least recently used entries until the cache fits, s.mu held
+func (s *Store) evict() {
+	for s.stats.Bytes > s.max && s.lru.Len() > 0 {
+		s.remove(s.lru.Back().Value.(*entry).id)
+		s.stats.Evictions++
+	}
+}
+
+// remove drops an entry from the index and disk, s.mu held
+func (s *Store) remove(id string) {
+	element, ok := s.entries[id]
+	if !ok {
+		return
+	}
+
+	e := element.Value.(*entry)
+	s.lru.Remove(element)
+	delete(s.entries, id)
+	s.stats.Entries--
+	s.stats.Bytes -= e.size
+
+	os.Remove(s.path(id))
+}
+
+// lookup returns nil when uncached or damaged
+func (s *Store) lookup(id string) []byte {
+	s.mu.Lock()
+	element, ok := s.entries[id]
+	if ok {
+		s.lru.MoveToFront(element)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	raw, err := os.ReadFile(s.path(id))
+	if err == nil && len(raw) >= sha256.Size {
+		sum := sha256.Sum256(raw[sha256.Size:])
+		if bytes.Equal(sum[:], raw[:sha256.Size]) {
+			// keeps the order across runs
+			now := time.Now()
+			os.Chtimes(s.path(id), now, now)
+
+			return raw[sha256.Size:]
+		}
+	}
+
+	s.mu.Lock()
+	s.remove(id)
+	s.stats.Corrupt++
+	s.mu.Unlock()
+
+	return nil
+}
+
+// add caches an object, failures only mean it isn't cached
+func (s *Store) add(id string, data []byte) {
+	size := int64(len(data))
+	if size > s.max {
+		return
+	}
+
+	path := s.path(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+
+	fo, err := os.CreateTemp(filepath.Dir(path), tempPrefix+"*")
+	if err != nil {
+		return
+	}
+	tmp := fo.Name()
+
+	sum := sha256.Sum256(data)
+	_, err = fo.Write(sum[:])
+	if err == nil {
+		_, err = fo.Write(data)
+	}
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	if element, ok := s.entries[id]; ok {
+		s.stats.Bytes -= element.Value.(*entry).size
+		element.Value.(*entry).size = size
+		s.lru.MoveToFront(element)
+	} else {
+		s.entries[id] = s.lru.PushFront(&entry{id, size})
+		s.stats.Entries++
+	}
+	s.stats.Bytes += size
+
+	s.evict()
+}
+
+func (s *Store) Get(id string) ([]byte, error) {
+	if data := s.lookup(id); data != nil {
+		s.mu.Lock()
+		s.stats.Hits++
+		s.mu.Unlock()
+
+		return data, nil
+	}
+
+	s.mu.Lock()
+	s.stats.Misses++
+	s.mu.Unlock()
+
+	data, err := s.inner.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.add(id, data)
+
+	return data, nil
+}
+
+// GetRange passes ranges of uncached objects through
+func (s *Store) GetRange(id string, offset, length int64) ([]byte, error) {
+	if data := s.lookup(id); data != nil {
+		s.mu.Lock()
+		s.stats.Hits++
+		s.mu.Unlock()
+
+		if offset < 0 || length < 0 || offset+length > int64(len(data)) {
+			return nil, fmt.Errorf("range [%d, %d) is out of bounds for %s", offset, offset+length, id)
+		}
+
+		return data[offset : offset+length], nil
+	}
+
+	s.mu.Lock()
+	s.stats.Misses++
+	s.mu.Unlock()
+
+	return chunkstore.GetRange(s.inner, id, offset, length)
+}
+
+func (s *Store) Put(id string, data []byte) error {
+	return s.inner.Put(id, data)
+}
+
+func (s *Store) Has(id string) (bool, error) {
+	return s.inner.Has(id)
+}
+
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	s.remove(id)
+	s.mu.Unlock()
+
+	return s.inner.Delete(id)
+}
+
+func (s *Store) List() ([]string, error) {
+	return s.inner.List()
+}
+
+func (s *Store) Stat(id string) (chunkstore.ChunkInfo, error) {
+	return s.inner.Stat(id)
+}
+
+// Invalidate drops a cached object found to be wrong
+func (s *Store) Invalidate(id string) {
+	s.mu.Lock()
+	s.remove(id)
+	s.mu.Unlock()
+}
+
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+func (s *Store) Missing(ids []string) ([]string, error) {
+	return chunkstore.Missing(s.inner, ids)
+}
+
+func (s *Store) PutBatch(objects []chunkstore.Object) error {
+	return chunkstore.PutBatch(s.inner, objects)
+}
+
+func (s *Store) Flush() error {
+	if flusher, ok := s.inner.(chunkstore.Flusher); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+func (s *Store) Close() error {
+	if closer, ok := s.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (s *Store) Unwrap() chunkstore.ChunkStore {
+	return s.inner
+}
+
+// Find returns the cache somewhere in a stack of wrapping stores, or nil
+func Find(store chunkstore.ChunkStore) *Store {
+	for {
+		if cache, ok := store.(*Store); ok {
+			return cache
+		}
+
+		wrapper, ok := store.(chunkstore.Wrapper)
+		if !ok {
+			return nil
+		}
+
+		store = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+func newStore(t *testing.T, dir string, maxBytes int64, chunks map[string]string) (*Store, *chunkstore.MemoryStore) {
+	inner := chunkstore.NewMemoryStore()
+	for id, data := range chunks {
+		if err := inner.Put(id, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Dir = dir
+	opt.MaxBytes = maxBytes
+
+	store, err := NewStore(inner, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, inner
+}
+
+func get(t *testing.T, store *Store, id, want string) {
+	data, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Fatalf("%s read %q, want %q", id, data, want)
+	}
+}
+
+func TestHitsAndMisses(t *testing.T) {
+	store, _ := newStore(t, t.TempDir(), 1<<20, map[string]string{"a1": "aaaa"})
+
+	get(t, store, "a1", "aaaa")
+	get(t, store, "a1", "aaaa")
+
+	if _, err := store.Get("b2"); err != chunkstore.ErrNotFound {
+		t.Fatalf("reading a missing chunk returned %v", err)
+	}
+
+	stats := store.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 1 || stats.Bytes != 4 {
+		t.Fatalf("stats %+v, want 1 hit, 2 misses and one 4 byte entry", stats)
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	store, _ := newStore(t, t.TempDir(), 10, map[string]string{"a1": "aaaa", "b2": "bbbb", "c3": "cccc"})
+
+	get(t, store, "a1", "aaaa")
+	get(t, store, "b2", "bbbb")
+	get(t, store, "a1", "aaaa")
+	get(t, store, "c3", "cccc")
+
+	stats := store.Stats()
+	if stats.Evictions != 1 || stats.Entries != 2 || stats.Bytes != 8 {
+		t.Fatalf("stats %+v, want one eviction leaving 8 bytes", stats)
+	}
+	if _, err := os.Stat(store.path("b2")); !os.IsNotExist(err) {
+		t.Fatalf("the least recently used entry is still on disk: %v", err)
+	}
+
+	get(t, store, "a1", "aaaa")
+	if hits := store.Stats().Hits; hits != 2 {
+		t.Fatalf("%d hits, the recently used entry was evicted", hits)
+	}
+}
+
+func TestCorruptEntryIsRefetched(t *testing.T) {
+	store, _ := newStore(t, t.TempDir(), 1<<20, map[string]string{"a1": "aaaa"})
+
+	get(t, store, "a1", "aaaa")
+
+	raw, err := os.ReadFile(store.path("a1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0xff
+	if err := os.WriteFile(store.path("a1"), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get(t, store, "a1", "aaaa")
+
+	stats := store.Stats()
+	if stats.Corrupt != 1 || stats.Hits != 0 || stats.Misses != 2 {
+		t.Fatalf("stats %+v, want the damaged entry dropped and refetched", stats)
+	}
+
+	get(t, store, "a1", "aaaa")
+	if hits := store.Stats().Hits; hits != 1 {
+		t.Fatal("the refetched chunk was not cached again")
+	}
+}
+
+func TestEntriesPersist(t *testing.T) {
+	dir := t.TempDir()
+
+	store, _ := newStore(t, dir, 1<<20, map[string]string{"a1": "aaaa"})
+	get(t, store, "a1", "aaaa")
+
+	// a truncated entry and a file outside the layout
+	for _, path := range []string{filepath.Join(dir, "b2", "b2"), filepath.Join(dir, "zz", "c3")} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b2", "b2"), []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "zz", "c3"), make([]byte, 64), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new inner store is empty, so reads can only be served from disk
+	reopened, _ := newStore(t, dir, 1<<20, map[string]string{})
+
+	stats := reopened.Stats()
+	if stats.Entries != 1 || stats.Bytes != 4 {
+		t.Fatalf("reopened with %+v, want the one valid entry", stats)
+	}
+	for _, path := range []string{filepath.Join(dir, "b2", "b2"), filepath.Join(dir, "zz", "c3")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s was kept: %v", path, err)
+		}
+	}
+
+	get(t, reopened, "a1", "aaaa")
+}
@@ -0,0 +1,282 @@
+package check
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"fastcdc-backup/pkg/chunkid"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/pack"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+type Options struct {
+	// where each host keeps one chunklist per backed up file
+	Namespaces []node.Namespace
+
+	// how the repository names chunks, used to rehash data
+	ID chunkid.Func
+
+	// rehash stored chunks, a Sample below 1 reads only that fraction of them
+	ReadData bool
+	Sample   float64
+
+	// corrupt objects are moved here as stored, still sealed when encrypted
+	Quarantine chunkstore.ChunkStore
+
+	// packs damaged within what their parity covers are rewritten in place
+	Repair bool
+
+	// unreferenced chunks are left for gc, not an error
+	Collected bool
+}
+
+func (o *Options) SetDefaults() {
+	o.Namespaces = []node.Namespace{{Hierarchy: "./hierarchy.json", Chunklists: "./chunklists"}}
+	o.ID = chunkid.SHA512
+	o.ReadData = false
+	o.Sample = 1
+	o.Quarantine = nil
+	o.Repair = false
+	o.Collected = false
+}
+
+// Problem is a chunk that failed a check and the files that reference it
+type Problem struct {
+	ID    string
+	Files []string
+	Err   string `json:",omitempty"`
+}
+
+// Count is an index entry that disagrees with the chunklists
+type Count struct {
+	ID         string
+	Indexed    int64
+	Referenced int64
+}
+
+type Report struct {
+	Chunklists int
+	Stored     int
+	Read       int
+
+	// referenced by a chunklist but not in the store
+	Missing []Problem
+	// stored but its data doesn't match its ID or can't be read back
+	Corrupt []Problem
+	// stored but no chunklist references it
+	Orphaned []string
+	// the same when Collected, waiting for gc
+	Unreferenced []string
+	// chunklists that couldn't be parsed
+	BadChunklists []string
+	BadCounts     []Count
+	Quarantined   []string
+	// packs whose data or parity failed its hashes, only scrubbed with ReadData
+	Packs []pack.Damage
+}
+
+// OK reports whether the check found nothing wrong
+func (r *Report) OK() bool {
+	for _, damage := range r.Packs {
+		if !damage.Repaired {
+			return false
+		}
+	}
+
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0 && len(r.Orphaned) == 0 &&
+		len(r.BadChunklists) == 0 && len(r.BadCounts) == 0
+}
+
+// Run cross-checks chunklists, index and store, reading data with ReadData
+func Run(store chunkstore.ChunkStore, db *sql.DB, opt Options) (*Report, error) {
+	report := &Report{
+		Missing:       []Problem{},
+		Corrupt:       []Problem{},
+		Orphaned:      []string{},
+		Unreferenced:  []string{},
+		BadChunklists: []string{},
+		BadCounts:     []Count{},
+		Quarantined:   []string{},
+		Packs:         []pack.Damage{},
+	}
+
+	// checksum -> files referencing it, once per reference
+	references := map[string][]string{}
+
+	for _, namespace := range opt.Namespaces {
+		if err := readChunklists(namespace, references, report); err != nil {
+			return nil, err
+		}
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	report.Stored = len(ids)
+
+	stored := map[string]bool{}
+	for _, id := range ids {
+		stored[id] = true
+
+		if _, ok := references[id]; ok {
+			continue
+		} else if opt.Collected {
+			report.Unreferenced = append(report.Unreferenced, id)
+		} else {
+			report.Orphaned = append(report.Orphaned, id)
+		}
+	}
+
+	for _, checksum := range sortedKeys(references) {
+		if !stored[checksum] {
+			report.Missing = append(report.Missing, Problem{ID: checksum, Files: uniqueFiles(references[checksum])})
+		}
+	}
+
+	counts, err := sqlitechunks.ListCounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for checksum, indexed := range counts {
+		if referenced := int64(len(references[checksum])); indexed != referenced {
+			report.BadCounts = append(report.BadCounts, Count{ID: checksum, Indexed: indexed, Referenced: referenced})
+		}
+	}
+	for _, checksum := range sortedKeys(references) {
+		if _, ok := counts[checksum]; !ok {
+			report.BadCounts = append(report.BadCounts, Count{ID: checksum, Indexed: 0, Referenced: int64(len(references[checksum]))})
+		}
+	}
+	sort.Slice(report.BadCounts, func(i, j int) bool {
+		return report.BadCounts[i].ID < report.BadCounts[j].ID
+	})
+
+	if !opt.ReadData {
+		return report, nil
+	}
+
+	// damage past repair shows up as corrupt chunks below
+	if packStore, ok := chunkstore.Base(store).(*pack.Store); ok {
+		report.Packs, err = packStore.Scrub(opt.Repair)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range ids {
+		if opt.Sample < 1 && rand.Float64() >= opt.Sample {
+			continue
+		}
+		report.Read++
+
+		data, err := store.Get(id)
+		if err == nil {
+			err = chunkid.Verify(opt.ID, id, data)
+		}
+		if err == nil {
+			continue
+		}
+
+		report.Corrupt = append(report.Corrupt, Problem{ID: id, Files: uniqueFiles(references[id]), Err: err.Error()})
+
+		if opt.Quarantine != nil {
+			if err := quarantine(store, opt.Quarantine, id); err != nil {
+				return nil, err
+			}
+			report.Quarantined = append(report.Quarantined, id)
+		}
+	}
+
+	return report, nil
+}
+
+// quarantine moves the raw object out, the index is left alone
+func quarantine(store chunkstore.ChunkStore, target chunkstore.ChunkStore, id string) error {
+	base := chunkstore.Base(store)
+
+	data, err := base.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := target.Put(id, data); err != nil {
+		return err
+	}
+
+	if err := base.Delete(id); err != nil {
+		return err
+	}
+
+	// deletes may only become durable once flushed, as with packs
+	if flusher, ok := base.(chunkstore.Flusher); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+func sortedKeys(references map[string][]string) []string {
+	keys := []string{}
+	for key := range references {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func uniqueFiles(files []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+
+	for _, file := range files {
+		if !seen[file] {
+			unique = append(unique, file)
+			seen[file] = true
+		}
+	}
+
+	return unique
+}
+
+// readChunklists adds a host's references, files named as the host sees them
+func readChunklists(namespace node.Namespace, references map[string][]string, report *Report) error {
+	return filepath.WalkDir(namespace.Chunklists, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == namespace.Chunklists {
+				return filepath.SkipDir
+			}
+			return err
+		} else if entry.IsDir() {
+			return nil
+		}
+
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		fnode := &node.FNode{}
+		if err := json.Unmarshal(bytes, fnode); err != nil {
+			report.BadChunklists = append(report.BadChunklists, path)
+			return nil
+		}
+		report.Chunklists++
+
+		for _, checksum := range fnode.References() {
+			references[checksum] = append(references[checksum], namespace.Qualify(fnode.Path))
+		}
+
+		return nil
+	})
+}
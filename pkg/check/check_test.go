@@ -0,0 +1,141 @@
+package check
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkid"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+// newRepo stores one chunk per file, with its chunklist and index count
+func newRepo(t *testing.T, files map[string]string) (*chunkstore.MemoryStore, *sql.DB, Options, map[string]string) {
+	dir := t.TempDir()
+
+	db, err := sqlitechunks.OpenDB(filepath.Join(dir, "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := sqlitechunks.CreateTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Namespaces = []node.Namespace{{Chunklists: filepath.Join(dir, "chunklists")}}
+	opt.ReadData = true
+
+	store := chunkstore.NewMemoryStore()
+	ids := map[string]string{}
+
+	for path, content := range files {
+		id := chunkid.SHA512([]byte(content))
+		ids[path] = id
+
+		if err := store.Put(id, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := sqlitechunks.AddReference(db, id); err != nil {
+			t.Fatal(err)
+		}
+
+		fnode := &node.FNode{Path: path, Size: int64(len(content)), Chunks: []string{id}}
+		data, err := json.Marshal(fnode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeChunklist(t, opt, path, data)
+	}
+
+	return store, db, opt, ids
+}
+
+func writeChunklist(t *testing.T, opt Options, path string, data []byte) {
+	path = filepath.Join(opt.Namespaces[0].Chunklists, path+".json")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCleanRepository(t *testing.T) {
+	store, db, opt, _ := newRepo(t, map[string]string{"a.txt": "first file", "b.txt": "second file"})
+
+	report, err := Run(store, db, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("a clean repository failed its check: %+v", report)
+	}
+	if report.Chunklists != 2 || report.Stored != 2 || report.Read != 2 {
+		t.Fatalf("checked %d chunklists, %d stored and %d read, want 2 each", report.Chunklists, report.Stored, report.Read)
+	}
+}
+
+func TestReadDataQuarantinesCorruption(t *testing.T) {
+	store, db, opt, ids := newRepo(t, map[string]string{"a.txt": "first file", "b.txt": "second file"})
+
+	// the stored object no longer hashes to its ID
+	if err := store.Delete(ids["a.txt"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ids["a.txt"], []byte("bit rot")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeChunklist(t, opt, "c.txt", []byte("{not json"))
+
+	quarantine := chunkstore.NewMemoryStore()
+	opt.Quarantine = quarantine
+
+	report, err := Run(store, db, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Fatal("a corrupt repository passed its check")
+	}
+
+	if len(report.Corrupt) != 1 || report.Corrupt[0].ID != ids["a.txt"] {
+		t.Fatalf("corrupt chunks %+v, want only a.txt's", report.Corrupt)
+	}
+	if files := report.Corrupt[0].Files; len(files) != 1 || files[0] != "a.txt" {
+		t.Fatalf("corrupt chunk is referenced by %v, want [a.txt]", files)
+	}
+	if len(report.BadChunklists) != 1 || filepath.Base(report.BadChunklists[0]) != "c.txt.json" {
+		t.Fatalf("bad chunklists %v, want c.txt's", report.BadChunklists)
+	}
+
+	if len(report.Quarantined) != 1 || report.Quarantined[0] != ids["a.txt"] {
+		t.Fatalf("quarantined %v, want a.txt's chunk", report.Quarantined)
+	}
+	if ok, _ := store.Has(ids["a.txt"]); ok {
+		t.Fatal("the corrupt chunk was left in the store")
+	}
+	if data, err := quarantine.Get(ids["a.txt"]); err != nil || string(data) != "bit rot" {
+		t.Fatalf("quarantine holds %q, %v", data, err)
+	}
+
+	// without ReadData the corruption isn't seen
+	opt.ReadData = false
+	opt.Quarantine = nil
+
+	report, err = Run(store, db, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 0 || report.Read != 0 {
+		t.Fatalf("read %d chunks without ReadData", report.Read)
+	}
+}
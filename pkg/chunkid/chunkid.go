@@ -0,0 +1,37 @@
+package chunkid
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+)
+
+// Func names a chunk by its content
+type Func func(data []byte) string
+
+// SHA512 is the plain content hash
+func SHA512(data []byte) string {
+	sum := sha512.Sum512(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HMAC IDs reveal nothing about the content without the key
+func HMAC(key []byte) Func {
+	return func(data []byte) string {
+		mac := hmac.New(sha512.New, key)
+		mac.Write(data)
+
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+}
+
+// Verify checks that data is what id names
+func Verify(id Func, expected string, data []byte) error {
+	actual := id(data)
+	if !hmac.Equal([]byte(actual), []byte(expected)) {
+		return fmt.Errorf("chunk %s hashes to %s", expected, actual)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package chunkid
+
+import (
+	"testing"
+)
+
+func TestSHA512(t *testing.T) {
+	want := "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"
+
+	if got := SHA512([]byte("abc")); got != want {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	// RFC 4231 test case 2
+	id := HMAC([]byte("Jefe"))
+	want := "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea2505549758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737"
+
+	data := []byte("what do ya want for nothing?")
+	if got := id(data); got != want {
+		t.Fatalf("got %s", got)
+	}
+
+	// equal chunks have to keep getting equal IDs for deduplication
+	if id(data) != HMAC([]byte("Jefe"))(data) {
+		t.Fatal("IDs changed between calls")
+	}
+
+	if HMAC([]byte("other key"))(data) == want {
+		t.Fatal("a different key gave the same ID")
+	}
+	if id(data) == SHA512(data) {
+		t.Fatal("keyed ID matches the plain content hash")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	data := []byte("chunk")
+
+	if err := Verify(SHA512, SHA512(data), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(SHA512, SHA512(data), []byte("chunK")); err == nil {
+		t.Fatal("changed data verified")
+	}
+}
@@ -0,0 +1,23 @@
+package chunkserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// TokenEnv holds the token when not given otherwise
+const TokenEnv = "FASTCDC_SERVER_TOKEN"
+
+// RequireToken only passes requests carrying token as a bearer token on to next
+func RequireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,119 @@
+package chunkserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// frames of uint16 ID length, ID, uint32 data length, data, big-endian
+
+// uploads are split so no single request grows past these
+const (
+	maxBatchIDs    = 5000
+	maxBatchBytes  = 8 << 20
+	maxBatchChunks = 1000
+)
+
+var errInvalidBatch = errors.New("invalid batch")
+
+func encodeBatch(w io.Writer, objects []chunkstore.Object) error {
+	bw := bufio.NewWriter(w)
+
+	for _, object := range objects {
+		header := make([]byte, 0, 2+len(object.ID)+4)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(object.ID)))
+		header = append(header, object.ID...)
+		header = binary.BigEndian.AppendUint32(header, uint32(len(object.Data)))
+
+		if _, err := bw.Write(header); err != nil {
+			return err
+		}
+		if _, err := bw.Write(object.Data); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// decodeBatch refuses frames that would take the batch past maxBytes
+func decodeBatch(r io.Reader, maxBytes int64) ([]chunkstore.Object, error) {
+	br := bufio.NewReader(r)
+	objects := []chunkstore.Object{}
+	total := int64(0)
+
+	for {
+		var idLength uint16
+		if err := binary.Read(br, binary.BigEndian, &idLength); err == io.EOF {
+			return objects, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		id := make([]byte, idLength)
+		if _, err := io.ReadFull(br, id); err != nil {
+			return nil, errInvalidBatch
+		}
+
+		var dataLength uint32
+		if err := binary.Read(br, binary.BigEndian, &dataLength); err != nil {
+			return nil, errInvalidBatch
+		}
+
+		total += int64(dataLength)
+		if total > maxBytes {
+			return nil, errInvalidBatch
+		}
+
+		data := make([]byte, dataLength)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, errInvalidBatch
+		}
+
+		objects = append(objects, chunkstore.Object{ID: string(id), Data: data})
+	}
+}
+
+// splitIDs cuts ids into groups of at most size
+func splitIDs(ids []string, size int) [][]string {
+	groups := [][]string{}
+
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		groups = append(groups, ids[start:end])
+	}
+
+	return groups
+}
+
+// splitObjects cuts objects into batches, oversized ones get their own
+func splitObjects(objects []chunkstore.Object) [][]chunkstore.Object {
+	batches := [][]chunkstore.Object{}
+	batch := []chunkstore.Object{}
+	size := 0
+
+	for _, object := range objects {
+		if len(batch) > 0 && (len(batch) == maxBatchChunks || size+len(object.Data) > maxBatchBytes) {
+			batches = append(batches, batch)
+			batch = []chunkstore.Object{}
+			size = 0
+		}
+
+		batch = append(batch, object)
+		size += len(object.Data)
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
@@ -0,0 +1,259 @@
+package chunkserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// Client is a ChunkStore on a chunk server, Delete releases a reference
+type Client struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewClient sends token as a bearer token on every request, unless empty
+func NewClient(url string, token string) *Client {
+	client := &Client{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+	return client
+}
+
+func (c *Client) do(method, path string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, c.url+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, chunkstore.ErrNotFound
+	} else if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		message, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("chunk server: %s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	return resp, nil
+}
+
+func (c *Client) Put(id string, data []byte) error {
+	resp, err := c.do(http.MethodPut, "/chunks/"+id, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return c.acquire([]string{id})
+}
+
+// acquire references chunks that were just uploaded
+func (c *Client) acquire(ids []string) error {
+	for _, group := range splitIDs(ids, maxBatchIDs) {
+		missing, err := c.postIDs("/chunks/acquire", group)
+		if err != nil {
+			return err
+		} else if len(missing) > 0 {
+			return fmt.Errorf("chunk server: %d uploaded chunks are missing", len(missing))
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) Get(id string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, "/chunks/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+func (c *Client) Has(id string) (bool, error) {
+	_, err := c.Stat(id)
+	if err == chunkstore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (c *Client) Delete(id string) error {
+	_, err := c.Release(id)
+
+	return err
+}
+
+// Release drops one reference to id on the server
+func (c *Client) Release(id string) (ReleaseResult, error) {
+	result := ReleaseResult{}
+
+	resp, err := c.do(http.MethodPost, "/chunks/"+id+"/release", nil)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	return result, err
+}
+
+func (c *Client) List() ([]string, error) {
+	resp, err := c.do(http.MethodGet, "/chunks", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ids := []string{}
+	err = json.NewDecoder(resp.Body).Decode(&ids)
+
+	return ids, err
+}
+
+func (c *Client) Stat(id string) (chunkstore.ChunkInfo, error) {
+	resp, err := c.do(http.MethodHead, "/chunks/"+id, nil)
+	if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	}
+	resp.Body.Close()
+
+	return chunkstore.ChunkInfo{ID: id, Size: resp.ContentLength}, nil
+}
+
+// PutSnapshot keeps a snapshot's chunks on the server while cached
+func (c *Client) PutSnapshot(name string, ids []string) error {
+	body, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(http.MethodPut, "/snapshots/"+url.PathEscape(name), body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (c *Client) DeleteSnapshot(name string) error {
+	resp, err := c.do(http.MethodDelete, "/snapshots/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (c *Client) postIDs(path string, ids []string) ([]string, error) {
+	body, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(http.MethodPost, path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	missing := []string{}
+	err = json.NewDecoder(resp.Body).Decode(&missing)
+
+	return missing, err
+}
+
+// Missing asks the server which ids it doesn't hold, thousands at a time
+func (c *Client) Missing(ids []string) ([]string, error) {
+	missing := []string{}
+
+	for _, group := range splitIDs(ids, maxBatchIDs) {
+		m, err := c.postIDs("/chunks/missing", group)
+		if err != nil {
+			return nil, err
+		}
+
+		missing = append(missing, m...)
+	}
+
+	return missing, nil
+}
+
+// PutBatch references chunks the server has and uploads the rest
+func (c *Client) PutBatch(objects []chunkstore.Object) error {
+	byID := map[string]chunkstore.Object{}
+	ids := []string{}
+
+	for _, object := range objects {
+		if _, ok := byID[object.ID]; !ok {
+			byID[object.ID] = object
+			ids = append(ids, object.ID)
+		}
+	}
+
+	uploads := []chunkstore.Object{}
+
+	for _, group := range splitIDs(ids, maxBatchIDs) {
+		missing, err := c.postIDs("/chunks/acquire", group)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range missing {
+			uploads = append(uploads, byID[id])
+		}
+	}
+
+	for _, batch := range splitObjects(uploads) {
+		var body bytes.Buffer
+		if err := encodeBatch(&body, batch); err != nil {
+			return err
+		}
+
+		resp, err := c.do(http.MethodPost, "/chunks/batch", body.Bytes())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	uploaded := []string{}
+	for _, object := range uploads {
+		uploaded = append(uploaded, object.ID)
+	}
+
+	return c.acquire(uploaded)
+}
@@ -0,0 +1,151 @@
+package chunkserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// EnableLocks serves the repository's locks under /locks
+func (s *Server) EnableLocks(locks chunkstore.ChunkStore) {
+	s.locks = locks
+}
+
+func (s *Server) serveLocks(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 && r.Method == http.MethodGet {
+		names, err := s.locks.List()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, names)
+		return
+	} else if len(parts) != 1 || !chunkstore.ValidID(parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[0]
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.locks.Put(name, data); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodHead:
+		info, err := s.locks.Stat(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		data, err := s.locks.Get(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+
+	case http.MethodDelete:
+		if err := s.locks.Delete(name); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// lockStore is the server's lock store
+type lockStore struct {
+	c *Client
+}
+
+// Locks returns the lock store of the repository behind the server
+func (c *Client) Locks() chunkstore.ChunkStore {
+	return &lockStore{c: c}
+}
+
+func (s *lockStore) Put(id string, data []byte) error {
+	resp, err := s.c.do(http.MethodPut, "/locks/"+id, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *lockStore) Get(id string) ([]byte, error) {
+	resp, err := s.c.do(http.MethodGet, "/locks/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s *lockStore) Has(id string) (bool, error) {
+	_, err := s.Stat(id)
+	if err == chunkstore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *lockStore) Delete(id string) error {
+	resp, err := s.c.do(http.MethodDelete, "/locks/"+id, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *lockStore) List() ([]string, error) {
+	resp, err := s.c.do(http.MethodGet, "/locks", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	names := []string{}
+	err = json.NewDecoder(resp.Body).Decode(&names)
+
+	return names, err
+}
+
+func (s *lockStore) Stat(id string) (chunkstore.ChunkInfo, error) {
+	resp, err := s.c.do(http.MethodHead, "/locks/"+id, nil)
+	if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	}
+	resp.Body.Close()
+
+	return chunkstore.ChunkInfo{ID: id, Size: resp.ContentLength}, nil
+}
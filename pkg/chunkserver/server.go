@@ -0,0 +1,450 @@
+package chunkserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+// reject anything but hex digests before it reaches a path or key
+var validID = regexp.MustCompile(`^[0-9a-f]{1,128}$`)
+
+// ReleaseResult is returned when a client drops its reference to a chunk
+type ReleaseResult struct {
+	Count   int64
+	Deleted bool
+}
+
+// Server exposes a ChunkStore over HTTP, refcounting chunks across clients and snapshots
+type Server struct {
+	mu    sync.Mutex
+	store chunkstore.ChunkStore
+	db    *sql.DB
+
+	// the repository's lock store, so clients lock it through the server
+	locks chunkstore.ChunkStore
+}
+
+func NewServer(store chunkstore.ChunkStore, db *sql.DB) (*Server, error) {
+	if err := sqlitechunks.CreateTable(db); err != nil {
+		return nil, err
+	}
+
+	if err := sqlitechunks.CreateSnapshotTables(db); err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		store: store,
+		db:    db,
+	}
+	return server, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if err == chunkstore.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == chunkstore.ErrAppendOnly {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "chunks" && r.Method == http.MethodGet:
+		s.list(w)
+
+	case len(parts) == 2 && parts[0] == "chunks" && parts[1] == "missing" && r.Method == http.MethodPost:
+		s.missing(w, r, false)
+
+	case len(parts) == 2 && parts[0] == "chunks" && parts[1] == "acquire" && r.Method == http.MethodPost:
+		s.missing(w, r, true)
+
+	case len(parts) == 2 && parts[0] == "chunks" && parts[1] == "batch" && r.Method == http.MethodPost:
+		s.uploadBatch(w, r)
+
+	case len(parts) == 2 && parts[0] == "chunks" && validID.MatchString(parts[1]):
+		switch r.Method {
+		case http.MethodPut:
+			s.upload(w, r, parts[1])
+		case http.MethodGet, http.MethodHead:
+			s.fetch(w, r, parts[1])
+		case http.MethodDelete:
+			s.delete(w, parts[1])
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case len(parts) == 3 && parts[0] == "chunks" && validID.MatchString(parts[1]) && parts[2] == "release" && r.Method == http.MethodPost:
+		s.release(w, parts[1])
+
+	case len(parts) == 1 && parts[0] == "snapshots" && r.Method == http.MethodGet:
+		snapshots, err := sqlitechunks.ListSnapshots(s.db)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+
+	case len(parts) == 2 && parts[0] == "snapshots" && parts[1] != "":
+		switch r.Method {
+		case http.MethodPut:
+			s.putSnapshot(w, r, parts[1])
+		case http.MethodDelete:
+			s.deleteSnapshot(w, parts[1])
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case parts[0] == "locks" && s.locks != nil:
+		s.serveLocks(w, r, parts[1:])
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter) {
+	ids, err := s.store.List()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ids)
+}
+
+// upload holds no reference, clients acquire what they upload. The content is
+// not checked against the ID, the server can't compute IDs of encrypted chunks
+func (s *Server) upload(w http.ResponseWriter, r *http.Request, id string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.store.Put(id, data); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// the pack has to be written out before the index counts the chunk
+	if flusher, ok := s.store.(chunkstore.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if err := sqlitechunks.InsertUnreferenced(s.db, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func readIDs(r *http.Request) ([]string, error) {
+	ids := []string{}
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		return nil, err
+	}
+
+	if len(ids) > maxBatchIDs {
+		return nil, fmt.Errorf("at most %d ids per request", maxBatchIDs)
+	}
+
+	for _, id := range ids {
+		if !validID.MatchString(id) {
+			return nil, fmt.Errorf("invalid chunk id %s", id)
+		}
+	}
+
+	return ids, nil
+}
+
+// missing returns the posted IDs not held, acquire references the rest
+func (s *Server) missing(w http.ResponseWriter, r *http.Request, acquire bool) {
+	ids, err := readIDs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	missing, err := sqlitechunks.Missing(s.db, ids)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if acquire {
+		isMissing := map[string]bool{}
+		for _, id := range missing {
+			isMissing[id] = true
+		}
+
+		for _, id := range ids {
+			if !isMissing[id] {
+				sqlitechunks.IncreaseCount(s.db, id)
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, missing)
+}
+
+func (s *Server) uploadBatch(w http.ResponseWriter, r *http.Request) {
+	objects, err := decodeBatch(r.Body, maxBatchBytes*2)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, object := range objects {
+		if !validID.MatchString(object.ID) {
+			http.Error(w, "invalid chunk id "+object.ID, http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, object := range objects {
+		if err := s.store.Put(object.ID, object.Data); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	// one flush per batch rather than per chunk keeps packs full
+	if flusher, ok := s.store.(chunkstore.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	for _, object := range objects {
+		if err := sqlitechunks.InsertUnreferenced(s.db, object.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) fetch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method == http.MethodHead {
+		info, err := s.store.Stat(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	data, err := s.store.Get(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// removable is called with s.mu held
+func (s *Server) removable(id string) (bool, string, error) {
+	if sqlitechunks.GetCount(s.db, id) > 0 {
+		return false, "chunk is still referenced by clients", nil
+	}
+
+	inSnapshot, err := sqlitechunks.InSnapshot(s.db, id)
+	if err != nil {
+		return false, "", err
+	} else if inSnapshot {
+		return false, "chunk is referenced by a cached snapshot", nil
+	}
+
+	return true, "", nil
+}
+
+func (s *Server) release(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !sqlitechunks.Exists(s.db, id) {
+		http.Error(w, chunkstore.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	if sqlitechunks.GetCount(s.db, id) > 0 {
+		sqlitechunks.DecreaseCount(s.db, id)
+	}
+
+	result := ReleaseResult{Count: sqlitechunks.GetCount(s.db, id)}
+
+	ok, _, err := s.removable(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if ok {
+		// an append-only store keeps the chunk until it is pruned
+		err := s.store.Delete(id)
+		if err != nil && err != chunkstore.ErrNotFound && err != chunkstore.ErrAppendOnly {
+			writeError(w, err)
+			return
+		}
+
+		if err != chunkstore.ErrAppendOnly {
+			sqlitechunks.Delete(s.db, id)
+			result.Deleted = true
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) delete(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, reason, err := s.removable(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	} else if !ok {
+		http.Error(w, reason, http.StatusConflict)
+		return
+	}
+
+	if err := s.store.Delete(id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sqlitechunks.Delete(s.db, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) putSnapshot(w http.ResponseWriter, r *http.Request, name string) {
+	ids := []string{}
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, id := range ids {
+		if !validID.MatchString(id) {
+			http.Error(w, "invalid chunk id "+id, http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := sqlitechunks.ReplaceSnapshot(s.db, name, ids); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := s.collect(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteSnapshot(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := sqlitechunks.DeleteSnapshot(s.db, name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := s.collect(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// collect removes released chunks no snapshot keeps anymore, s.mu held
+func (s *Server) collect() (int, error) {
+	ids, err := sqlitechunks.ListUnreferenced(s.db)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, id := range ids {
+		err := s.store.Delete(id)
+		if err == chunkstore.ErrAppendOnly {
+			return removed, nil
+		} else if err != nil && err != chunkstore.ErrNotFound {
+			return removed, err
+		}
+
+		sqlitechunks.Delete(s.db, id)
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Prune removes unreferenced chunks an append-only server kept
+func (s *Server) Prune() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed, err := s.collect()
+	if err != nil {
+		return removed, err
+	}
+
+	// a pack store only records deletions in memory until flushed
+	if flusher, ok := s.store.(chunkstore.Flusher); ok {
+		return removed, flusher.Flush()
+	}
+
+	return removed, nil
+}
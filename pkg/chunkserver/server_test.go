@@ -0,0 +1,196 @@
+package chunkserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+func startServer(t *testing.T, token string) (*chunkstore.MemoryStore, string) {
+	db, err := sqlitechunks.OpenDB(filepath.Join(t.TempDir(), "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := chunkstore.NewMemoryStore()
+	server, err := NewServer(store, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := RequireToken(token, server)
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	return store, ts.URL
+}
+
+func TestToken(t *testing.T) {
+	_, url := startServer(t, "secret")
+
+	if err := NewClient(url, "wrong").Put("a1", []byte("data")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got %v with a wrong token, want a 401", err)
+	}
+	if _, err := NewClient(url, "").List(); err == nil {
+		t.Fatal("request without a token succeeded")
+	}
+
+	client := NewClient(url, "secret")
+	if err := client.Put("a1", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := client.Get("a1"); err != nil || string(data) != "data" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestReleaseKeepsSnapshotChunks(t *testing.T) {
+	store, url := startServer(t, "secret")
+	client := NewClient(url, "secret")
+
+	err := client.PutBatch([]chunkstore.Object{{ID: "a1", Data: []byte("a")}, {ID: "b2", Data: []byte("b")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.PutSnapshot("host:backup", []string{"a1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a1", "b2"} {
+		if err := client.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ok, _ := store.Has("a1"); !ok {
+		t.Fatal("chunk in a cached snapshot was removed")
+	}
+	if ok, _ := store.Has("b2"); ok {
+		t.Fatal("released chunk outside any snapshot was kept")
+	}
+
+	if err := client.DeleteSnapshot("host:backup"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Has("a1"); ok {
+		t.Fatal("chunk kept after its snapshot left the cache")
+	}
+}
+
+func TestReferencesAreCounted(t *testing.T) {
+	store, url := startServer(t, "secret")
+	client := NewClient(url, "secret")
+
+	for i := 0; i < 2; i++ {
+		if err := client.PutBatch([]chunkstore.Object{{ID: "a1", Data: []byte("a")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := client.Release("a1")
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Count != 1 || result.Deleted {
+		t.Fatalf("first release returned %+v", result)
+	}
+
+	result, err = client.Release("a1")
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Count != 0 || !result.Deleted {
+		t.Fatalf("second release returned %+v", result)
+	}
+
+	if ok, _ := store.Has("a1"); ok {
+		t.Fatal("chunk kept after its last reference was released")
+	}
+}
+
+func TestUploadsHoldNoReference(t *testing.T) {
+	_, url := startServer(t, "secret")
+	client := NewClient(url, "secret")
+
+	// a retried upload outside the acquire flow
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodPut, url+"/chunks/a1", strings.NewReader("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("upload returned %d", resp.StatusCode)
+		}
+	}
+
+	if err := client.PutBatch([]chunkstore.Object{{ID: "a1", Data: []byte("a")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := client.Release("a1")
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Count != 0 || !result.Deleted {
+		t.Fatalf("releasing the only acquired reference returned %+v", result)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	db, err := sqlitechunks.OpenDB(filepath.Join(t.TempDir(), "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	server, err := NewServer(chunkstore.NewMemoryStore(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := chunkstore.NewMemoryStore()
+	server.EnableLocks(locks)
+
+	ts := httptest.NewServer(RequireToken("secret", server))
+	t.Cleanup(ts.Close)
+
+	remote := NewClient(ts.URL, "secret").Locks()
+
+	if err := remote.Put("a1b2-1", []byte("lock")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := locks.Get("a1b2-1"); string(data) != "lock" {
+		t.Fatalf("server's lock store holds %q", data)
+	}
+
+	if names, err := remote.List(); err != nil || len(names) != 1 || names[0] != "a1b2-1" {
+		t.Fatalf("listed %v, %v", names, err)
+	}
+	if data, err := remote.Get("a1b2-1"); err != nil || string(data) != "lock" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if info, err := remote.Stat("a1b2-1"); err != nil || info.Size != 4 {
+		t.Fatalf("stat returned %+v, %v", info, err)
+	}
+
+	if err := remote.Delete("a1b2-1"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := remote.Has("a1b2-1"); err != nil || ok {
+		t.Fatalf("deleted lock is still there: %v, %v", ok, err)
+	}
+
+	if err := remote.Put("not a lock", []byte("lock")); err == nil {
+		t.Fatal("invalid lock name was accepted")
+	}
+}
@@ -0,0 +1,106 @@
+package chunkstore
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrAppendOnly = errors.New("store is append-only, deletes are refused")
+
+// AppendOnlyStore refuses deletes and overwrites, no Unwrap so Base can't bypass it
+type AppendOnlyStore struct {
+	inner ChunkStore
+}
+
+func NewAppendOnlyStore(inner ChunkStore) *AppendOnlyStore {
+	store := &AppendOnlyStore{
+		inner: inner,
+	}
+	return store
+}
+
+// Put leaves an existing object alone, as some backends would overwrite it
+func (s *AppendOnlyStore) Put(id string, data []byte) error {
+	if ok, err := s.inner.Has(id); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	return s.inner.Put(id, data)
+}
+
+func (s *AppendOnlyStore) Get(id string) ([]byte, error) {
+	return s.inner.Get(id)
+}
+
+func (s *AppendOnlyStore) GetRange(id string, offset, length int64) ([]byte, error) {
+	return GetRange(s.inner, id, offset, length)
+}
+
+func (s *AppendOnlyStore) Has(id string) (bool, error) {
+	return s.inner.Has(id)
+}
+
+func (s *AppendOnlyStore) Delete(id string) error {
+	return ErrAppendOnly
+}
+
+func (s *AppendOnlyStore) List() ([]string, error) {
+	return s.inner.List()
+}
+
+func (s *AppendOnlyStore) Stat(id string) (ChunkInfo, error) {
+	return s.inner.Stat(id)
+}
+
+func (s *AppendOnlyStore) Missing(ids []string) ([]string, error) {
+	return Missing(s.inner, ids)
+}
+
+func (s *AppendOnlyStore) PutBatch(objects []Object) error {
+	ids := []string{}
+	for _, object := range objects {
+		ids = append(ids, object.ID)
+	}
+
+	missing, err := Missing(s.inner, ids)
+	if err != nil {
+		return err
+	}
+
+	isMissing := map[string]bool{}
+	for _, id := range missing {
+		isMissing[id] = true
+	}
+
+	added := []Object{}
+	for _, object := range objects {
+		if isMissing[object.ID] {
+			added = append(added, object)
+			isMissing[object.ID] = false
+		}
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+
+	return PutBatch(s.inner, added)
+}
+
+func (s *AppendOnlyStore) Flush() error {
+	if flusher, ok := s.inner.(Flusher); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+func (s *AppendOnlyStore) Close() error {
+	if closer, ok := s.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package chunkstore
+
+import (
+	"testing"
+)
+
+func TestAppendOnlyStore(t *testing.T) {
+	inner := NewMemoryStore()
+	inner.Put("a1", []byte("kept"))
+	store := NewAppendOnlyStore(inner)
+
+	if err := store.Delete("a1"); err != ErrAppendOnly {
+		t.Fatalf("delete returned %v, want ErrAppendOnly", err)
+	}
+
+	// existing objects aren't replaced
+	if err := store.PutBatch([]Object{{ID: "a1", Data: []byte("replaced")}, {ID: "b2", Data: []byte("added")}}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := inner.Get("a1"); string(data) != "kept" {
+		t.Fatalf("existing object was replaced with %q", data)
+	}
+	if data, _ := inner.Get("b2"); string(data) != "added" {
+		t.Fatalf("new object holds %q", data)
+	}
+
+	// nothing below it can be reached to delete through
+	if base := Base(store); base != store {
+		t.Fatal("Base went around the append-only store")
+	}
+}
@@ -0,0 +1,129 @@
+package chunkstore
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNotFound = errors.New("chunk not found")
+
+type ChunkInfo struct {
+	ID   string
+	Size int64
+}
+
+// ChunkStore holds chunk data keyed by chunk ID
+type ChunkStore interface {
+	Put(id string, data []byte) error
+	Get(id string) ([]byte, error)
+	Has(id string) (bool, error)
+	Delete(id string) error
+	List() ([]string, error)
+	Stat(id string) (ChunkInfo, error)
+}
+
+// RangeReader reads part of an object without fetching all of it
+type RangeReader interface {
+	GetRange(id string, offset, length int64) ([]byte, error)
+}
+
+// Flusher makes buffered writes durable
+type Flusher interface {
+	Flush() error
+}
+
+// GetRange falls back to a full Get
+func GetRange(store ChunkStore, id string, offset, length int64) ([]byte, error) {
+	if rr, ok := store.(RangeReader); ok {
+		return rr.GetRange(id, offset, length)
+	}
+
+	data, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 || length < 0 || offset+length > int64(len(data)) {
+		return nil, fmt.Errorf("range [%d, %d) is out of bounds for %s", offset, offset+length, id)
+	}
+
+	return data[offset : offset+length], nil
+}
+
+// Object is a chunk and its ID, as passed around in batches
+type Object struct {
+	ID   string
+	Data []byte
+
+	// set by PutBatch of stores that change the size of what they store
+	Stored int64
+}
+
+// StoredSize is the size the object was stored at
+func (o Object) StoredSize() int64 {
+	if o.Stored > 0 {
+		return o.Stored
+	}
+
+	return int64(len(o.Data))
+}
+
+// BatchChecker is implemented by stores that can check many IDs in one round trip
+type BatchChecker interface {
+	Missing(ids []string) ([]string, error)
+}
+
+// BatchPutter is implemented by stores that can upload many chunks at once
+type BatchPutter interface {
+	PutBatch(objects []Object) error
+}
+
+// Missing falls back to one Has per ID
+func Missing(store ChunkStore, ids []string) ([]string, error) {
+	if bc, ok := store.(BatchChecker); ok {
+		return bc.Missing(ids)
+	}
+
+	missing := []string{}
+	for _, id := range ids {
+		ok, err := store.Has(id)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			missing = append(missing, id)
+		}
+	}
+
+	return missing, nil
+}
+
+func PutBatch(store ChunkStore, objects []Object) error {
+	if bp, ok := store.(BatchPutter); ok {
+		return bp.PutBatch(objects)
+	}
+
+	for _, object := range objects {
+		if err := store.Put(object.ID, object.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Wrapper is implemented by stores layered on another store
+type Wrapper interface {
+	Unwrap() ChunkStore
+}
+
+// Base returns the innermost store, stopping at outbox and append-only stores
+func Base(store ChunkStore) ChunkStore {
+	for {
+		wrapper, ok := store.(Wrapper)
+		if !ok {
+			return store
+		}
+
+		store = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,102 @@
+package chunkstore
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testStore runs the behaviour every ChunkStore shares against an empty store
+func testStore(t *testing.T, store ChunkStore) {
+	data := []byte("some chunk data")
+
+	if _, err := store.Get("a1"); err != ErrNotFound {
+		t.Fatalf("get of a missing chunk returned %v, want ErrNotFound", err)
+	}
+	if err := store.Delete("a1"); err != ErrNotFound {
+		t.Fatalf("delete of a missing chunk returned %v, want ErrNotFound", err)
+	}
+
+	buf := append([]byte(nil), data...)
+	if err := store.Put("a1", buf); err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = 'X'
+
+	got, err := store.Get("a1")
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatalf("got %q, want %q", got, data)
+	}
+
+	part, err := GetRange(store, "a1", 5, 5)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(part) != "chunk" {
+		t.Fatalf("range read %q", part)
+	}
+	if _, err := GetRange(store, "a1", 10, 10); err == nil {
+		t.Fatal("range past the end succeeded")
+	}
+
+	ok, err := store.Has("a1")
+	if err != nil || !ok {
+		t.Fatalf("has returned %v, %v", ok, err)
+	}
+
+	info, err := store.Stat("a1")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.ID != "a1" || info.Size != int64(len(data)) {
+		t.Fatalf("stat returned %+v", info)
+	}
+
+	err = PutBatch(store, []Object{{ID: "b2", Data: []byte("b")}, {ID: "c3", Data: []byte("c")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []string{"a1", "b2", "c3"}) {
+		t.Fatalf("listed %v", ids)
+	}
+
+	missing, err := Missing(store, []string{"a1", "d4", "c3", "e5"})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(missing, []string{"d4", "e5"}) {
+		t.Fatalf("missing %v", missing)
+	}
+
+	if err := store.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Has("a1"); ok {
+		t.Fatal("deleted chunk is still there")
+	}
+	if _, err := store.Stat("a1"); err != ErrNotFound {
+		t.Fatalf("stat of a deleted chunk returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestMemoryStoreCopiesOnGet(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.Put("a", []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := store.Get("a")
+	got[0] = 'X'
+
+	again, _ := store.Get("a")
+	if string(again) != "abc" {
+		t.Fatalf("changing a returned chunk changed the store, got %q", again)
+	}
+}
@@ -0,0 +1,389 @@
+package chunkstore
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// temp files left by a crash carry this prefix
+const tempPrefix = ".tmp-"
+
+// younger temp files may belong to a writer in another process
+const staleTemp = time.Hour
+
+// FSStore keeps chunks as files under root, reading older layouts through fallback
+type FSStore struct {
+	root     string
+	layout   Layout
+	fallback []Layout
+}
+
+func NewFSStore(root string, layout Layout, fallback ...Layout) (*FSStore, error) {
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	store := &FSStore{
+		root:     root,
+		layout:   layout,
+		fallback: fallback,
+	}
+
+	if err := store.sweep(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// walk calls fn for every chunk file where a layout puts it
+func (s *FSStore) walk(fn func(path, id string) error) error {
+	return filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || !ValidID(entry.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		} else if !s.placed(rel, entry.Name()) {
+			return nil
+		}
+
+		return fn(path, entry.Name())
+	})
+}
+
+// placed reports whether rel is where the current or a fallback layout keeps id
+func (s *FSStore) placed(rel, id string) bool {
+	if s.layout.Path(id) == rel {
+		return true
+	}
+
+	for _, layout := range s.fallback {
+		if layout.Path(id) == rel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sweep removes temp files left over from interrupted writes
+func (s *FSStore) sweep() error {
+	cutoff := time.Now().Add(-staleTemp)
+
+	return filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), tempPrefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (s *FSStore) path(id string) string {
+	return filepath.Join(s.root, s.layout.Path(id))
+}
+
+// locate finds id in the current or a fallback layout
+func (s *FSStore) locate(id string) (string, os.FileInfo, error) {
+	path := s.path(id)
+
+	fileInfo, err := os.Stat(path)
+	if err == nil {
+		return path, fileInfo, nil
+	} else if !os.IsNotExist(err) {
+		return "", nil, err
+	}
+
+	for _, layout := range s.fallback {
+		path := filepath.Join(s.root, layout.Path(id))
+
+		fileInfo, err := os.Stat(path)
+		if err == nil {
+			return path, fileInfo, nil
+		} else if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+	}
+
+	return "", nil, ErrNotFound
+}
+
+// Put syncs to a temp file and renames it into place
+func (s *FSStore) Put(id string, data []byte) error {
+	// chunks are content addressed, an existing file already holds this data
+	if _, _, err := s.locate(id); err == nil {
+		return nil
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	path := s.path(id)
+	dir := filepath.Dir(path)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	fo, err := os.CreateTemp(dir, tempPrefix+"*")
+	if os.IsNotExist(err) { // directory pruned by a concurrent Relocate
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		fo, err = os.CreateTemp(dir, tempPrefix+"*")
+	}
+	if err != nil {
+		return err
+	}
+	tmp := fo.Name()
+
+	if err := writeSynced(fo, data); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func writeSynced(fo *os.File, data []byte) error {
+	if _, err := fo.Write(data); err != nil {
+		fo.Close()
+		return err
+	}
+
+	if err := fo.Chmod(0644); err != nil {
+		fo.Close()
+		return err
+	}
+
+	if err := fo.Sync(); err != nil {
+		fo.Close()
+		return err
+	}
+
+	return fo.Close()
+}
+
+// syncDir makes a rename within dir durable
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return fd.Sync()
+}
+
+func (s *FSStore) Get(id string) ([]byte, error) {
+	path, _, err := s.locate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) { // moved by a concurrent migration
+		path, _, err = s.locate(id)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = os.ReadFile(path)
+	}
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *FSStore) GetRange(id string, offset, length int64) ([]byte, error) {
+	path, fileInfo, err := s.locate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 || length < 0 || offset+length > fileInfo.Size() {
+		return nil, fmt.Errorf("range [%d, %d) is out of bounds for %s", offset, offset+length, id)
+	}
+
+	fi, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	data := make([]byte, length)
+	if _, err := fi.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *FSStore) Has(id string) (bool, error) {
+	_, _, err := s.locate(id)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *FSStore) Delete(id string) error {
+	path, _, err := s.locate(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+func (s *FSStore) List() ([]string, error) {
+	seen := map[string]bool{}
+	ids := []string{}
+
+	err := s.walk(func(path, id string) error {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (s *FSStore) Stat(id string) (ChunkInfo, error) {
+	_, fileInfo, err := s.locate(id)
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+
+	return ChunkInfo{ID: id, Size: fileInfo.Size()}, nil
+}
+
+// Relocate renames misplaced chunks into the current layout
+func (s *FSStore) Relocate() (int, error) {
+	moved := 0
+
+	err := s.walk(func(path, id string) error {
+		target := s.path(id)
+		if path == target {
+			return nil
+		}
+
+		dir := filepath.Dir(target)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(target); err == nil { // already copied, drop the stale one
+			return os.Remove(path)
+		}
+
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+
+		moved++
+		return nil
+	})
+	if err != nil {
+		return moved, err
+	}
+
+	return moved, s.pruneDirs()
+}
+
+// pruneDirs removes directories left empty by Relocate
+func (s *FSStore) pruneDirs() error {
+	dirs := []string{}
+
+	err := filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() && path != s.root {
+			dirs = append(dirs, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// deepest first so parents empty out as their children go
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			if err := os.Remove(dirs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
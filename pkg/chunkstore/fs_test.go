@@ -0,0 +1,144 @@
+package chunkstore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFSStore(t *testing.T) {
+	for _, layout := range []Layout{FlatLayout, {Levels: 1, Width: 1}} {
+		store, err := NewFSStore(t.TempDir(), layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testStore(t, store)
+	}
+}
+
+func TestFSStoreListSkipsStrayFiles(t *testing.T) {
+	root := t.TempDir()
+	layout := Layout{Levels: 1, Width: 2}
+
+	store, err := NewFSStore(root, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"abcd", "abcd.parity", "ab12-3"} {
+		if err := store.Put(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stray := []string{
+		"README.md",
+		filepath.Join("ab", "abcd"+RepairSuffix),
+		filepath.Join("ab", "notes.txt"),
+		filepath.Join("cd", "abce"),
+	}
+	for _, name := range stray {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("stray"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(ids, []string{"ab12-3", "abcd", "abcd.parity"}) {
+		t.Fatalf("listed %v", ids)
+	}
+}
+
+func TestFSStoreSweepsTempFiles(t *testing.T) {
+	root := t.TempDir()
+	tmp := filepath.Join(root, tempPrefix+"123")
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleTemp)
+	if err := os.Chtimes(tmp, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// another process may still be writing this one
+	fresh := filepath.Join(root, tempPrefix+"456")
+	if err := os.WriteFile(fresh, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFSStore(root, FlatLayout); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatal("temp file left over from a crash was not removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("temp file of a running write was removed: %v", err)
+	}
+}
+
+func TestFSStoreRelocate(t *testing.T) {
+	root := t.TempDir()
+
+	flat, err := NewFSStore(root, FlatLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"aa01", "bb02"} {
+		if err := flat.Put(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layout := Layout{Levels: 2, Width: 1}
+	store, err := NewFSStore(root, layout, FlatLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, _ := store.List(); !reflect.DeepEqual(ids, []string{"aa01", "bb02"}) {
+		t.Fatalf("listed %v through the fallback layout", ids)
+	}
+
+	moved, err := store.Relocate()
+	if err != nil {
+		t.Fatal(err)
+	} else if moved != 2 {
+		t.Fatalf("moved %d chunks, want 2", moved)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "a", "a", "aa01")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := store.Get("bb02")
+	if err != nil || string(data) != "bb02" {
+		t.Fatalf("got %q, %v after relocating", data, err)
+	}
+}
+
+func TestValidID(t *testing.T) {
+	valid := []string{"0a", "deadbeef", "abcd-12", "abcd.parity"}
+	invalid := []string{"", "ABCD", "abcd" + RepairSuffix, "abcd-", "abcd-x", "abcd.", "notes.txt", ".tmp-1", "-1"}
+
+	for _, name := range valid {
+		if !ValidID(name) {
+			t.Errorf("%q should be a valid ID", name)
+		}
+	}
+	for _, name := range invalid {
+		if ValidID(name) {
+			t.Errorf("%q should not be a valid ID", name)
+		}
+	}
+}
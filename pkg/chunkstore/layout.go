@@ -0,0 +1,77 @@
+package chunkstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// RepairSuffix names the backup kept while an object is replaced
+const RepairSuffix = ".repair"
+
+// Layout nests chunk files by ID prefix, Levels 2 Width 2 puts abcdef at ab/cd/abcdef
+type Layout struct {
+	Levels int
+	Width  int
+}
+
+// FlatLayout keeps every chunk directly under the store root
+var FlatLayout = Layout{Levels: 0, Width: 0}
+
+func (l Layout) Validate() error {
+	if l.Levels < 0 || l.Width < 0 {
+		return fmt.Errorf("invalid layout %d/%d", l.Levels, l.Width)
+	} else if l.Levels > 0 && l.Width == 0 {
+		return fmt.Errorf("layout with %d levels needs a non-zero width", l.Levels)
+	}
+
+	return nil
+}
+
+func (l Layout) String() string {
+	if l.Levels == 0 {
+		return "flat"
+	}
+
+	return fmt.Sprintf("%d/%d", l.Levels, l.Width)
+}
+
+// Path returns where id lives relative to the store root
+func (l Layout) Path(id string) string {
+	if len(id) < l.Levels*l.Width { // too short to fan out
+		return id
+	}
+
+	parts := []string{}
+	for i := 0; i < l.Levels; i++ {
+		parts = append(parts, id[i*l.Width:(i+1)*l.Width])
+	}
+	parts = append(parts, id)
+
+	return filepath.Join(parts...)
+}
+
+// ValidID accepts a hex digest with an optional -number or .suffix
+func ValidID(name string) bool {
+	if strings.HasSuffix(name, RepairSuffix) {
+		return false
+	}
+
+	digest, suffix := name, ""
+	if i := strings.IndexAny(name, "-."); i >= 0 {
+		digest, suffix = name[:i], name[i:]
+	}
+
+	if digest == "" || strings.Trim(digest, "0123456789abcdef") != "" {
+		return false
+	}
+
+	switch {
+	case suffix == "":
+		return true
+	case suffix[0] == '-':
+		return len(suffix) > 1 && strings.Trim(suffix[1:], "0123456789") == ""
+	default:
+		return len(suffix) > 1 && strings.Trim(suffix[1:], "abcdefghijklmnopqrstuvwxyz") == ""
+	}
+}
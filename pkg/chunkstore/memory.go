@@ -0,0 +1,104 @@
+package chunkstore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps chunks in a map, mostly useful for tests
+type MemoryStore struct {
+	mu     sync.RWMutex
+	chunks map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	store := &MemoryStore{
+		chunks: map[string][]byte{},
+	}
+	return store
+}
+
+func (s *MemoryStore) Put(id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// copy so callers can reuse their buffer
+	s.chunks[id] = append([]byte(nil), data...)
+
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.chunks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemoryStore) GetRange(id string, offset, length int64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.chunks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if offset < 0 || length < 0 || offset+length > int64(len(data)) {
+		return nil, fmt.Errorf("range [%d, %d) is out of bounds for %s", offset, offset+length, id)
+	}
+
+	return append([]byte(nil), data[offset:offset+length]...), nil
+}
+
+func (s *MemoryStore) Has(id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.chunks[id]
+
+	return ok, nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.chunks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.chunks, id)
+
+	return nil
+}
+
+func (s *MemoryStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := []string{}
+	for id := range s.chunks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (s *MemoryStore) Stat(id string) (ChunkInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.chunks[id]
+	if !ok {
+		return ChunkInfo{}, ErrNotFound
+	}
+
+	return ChunkInfo{ID: id, Size: int64(len(data))}, nil
+}
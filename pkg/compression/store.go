@@ -0,0 +1,161 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// marker byte, chunks that don't shrink are stored as they are
+const (
+	stored   byte = 0
+	deflated byte = 1
+)
+
+var ErrInvalid = errors.New("object is not in the compressed format")
+
+// Store deflates objects, it goes above encryption
+type Store struct {
+	inner chunkstore.ChunkStore
+	level int
+}
+
+func NewStore(inner chunkstore.ChunkStore, level int) (*Store, error) {
+	// checks the level
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		inner: inner,
+		level: level,
+	}
+	return store, nil
+}
+
+func (s *Store) compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{deflated})
+
+	w, err := flate.NewWriter(buf, s.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= 1+len(data) {
+		return append([]byte{stored}, data...), nil
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompress(obj []byte) ([]byte, error) {
+	if len(obj) == 0 {
+		return nil, ErrInvalid
+	}
+
+	switch obj[0] {
+	case stored:
+		return obj[1:], nil
+	case deflated:
+		data, err := io.ReadAll(flate.NewReader(bytes.NewReader(obj[1:])))
+		if err != nil {
+			return nil, ErrInvalid
+		}
+
+		return data, nil
+	default:
+		return nil, ErrInvalid
+	}
+}
+
+func (s *Store) Put(id string, data []byte) error {
+	return s.PutBatch([]chunkstore.Object{{ID: id, Data: data}})
+}
+
+func (s *Store) PutBatch(objects []chunkstore.Object) error {
+	compressed := []chunkstore.Object{}
+
+	for _, object := range objects {
+		data, err := s.compress(object.Data)
+		if err != nil {
+			return err
+		}
+
+		compressed = append(compressed, chunkstore.Object{ID: object.ID, Data: data})
+	}
+
+	if err := chunkstore.PutBatch(s.inner, compressed); err != nil {
+		return err
+	}
+
+	for i := range objects {
+		objects[i].Stored = compressed[i].StoredSize()
+	}
+
+	return nil
+}
+
+func (s *Store) Get(id string) ([]byte, error) {
+	obj, err := s.inner.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return decompress(obj)
+}
+
+func (s *Store) Has(id string) (bool, error) {
+	return s.inner.Has(id)
+}
+
+func (s *Store) Delete(id string) error {
+	return s.inner.Delete(id)
+}
+
+func (s *Store) List() ([]string, error) {
+	return s.inner.List()
+}
+
+// Stat reports the uncompressed size, which takes reading the object
+func (s *Store) Stat(id string) (chunkstore.ChunkInfo, error) {
+	data, err := s.Get(id)
+	if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	}
+
+	return chunkstore.ChunkInfo{ID: id, Size: int64(len(data))}, nil
+}
+
+func (s *Store) Missing(ids []string) ([]string, error) {
+	return chunkstore.Missing(s.inner, ids)
+}
+
+func (s *Store) Flush() error {
+	if flusher, ok := s.inner.(chunkstore.Flusher); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+func (s *Store) Close() error {
+	if closer, ok := s.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Unwrap returns the store holding the compressed objects
+func (s *Store) Unwrap() chunkstore.ChunkStore {
+	return s.inner
+}
@@ -0,0 +1,85 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+func newStore(t *testing.T) (*Store, *chunkstore.MemoryStore) {
+	inner := chunkstore.NewMemoryStore()
+
+	store, err := NewStore(inner, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, inner
+}
+
+func TestRoundTrip(t *testing.T) {
+	store, inner := newStore(t)
+
+	text := bytes.Repeat([]byte("the same line over and over\n"), 100)
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	objects := []chunkstore.Object{{ID: "a1", Data: text}, {ID: "b2", Data: random}, {ID: "c3", Data: []byte{}}}
+	if err := store.PutBatch(objects); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, object := range objects {
+		data, err := store.Get(object.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, object.Data) {
+			t.Fatalf("%s was read back wrong", object.ID)
+		}
+
+		info, err := store.Stat(object.ID)
+		if err != nil || info.Size != int64(len(object.Data)) {
+			t.Fatalf("stat of %s returned %+v, %v", object.ID, info, err)
+		}
+
+		raw, _ := inner.Get(object.ID)
+		if object.StoredSize() != int64(len(raw)) {
+			t.Fatalf("%s is reported stored at %d bytes, the store holds %d", object.ID, object.StoredSize(), len(raw))
+		}
+	}
+
+	if objects[0].Stored >= int64(len(text)) {
+		t.Fatalf("repetitive text stored at %d of %d bytes", objects[0].Stored, len(text))
+	}
+
+	// data that doesn't shrink is kept with just the marker byte
+	if objects[1].Stored != int64(len(random))+1 {
+		t.Fatalf("random data stored at %d bytes, want %d", objects[1].Stored, len(random)+1)
+	}
+}
+
+func TestInvalidObject(t *testing.T) {
+	store, inner := newStore(t)
+
+	for id, obj := range map[string][]byte{
+		"a1": {},
+		"b2": {7, 1, 2, 3},
+		"c3": {deflated, 0xff, 0xff, 0xff},
+	} {
+		inner.Put(id, obj)
+
+		if _, err := store.Get(id); err != ErrInvalid {
+			t.Fatalf("%s returned %v, want ErrInvalid", id, err)
+		}
+	}
+}
+
+func TestInvalidLevel(t *testing.T) {
+	if _, err := NewStore(chunkstore.NewMemoryStore(), 42); err == nil {
+		t.Fatal("level 42 was accepted")
+	}
+}
@@ -0,0 +1,182 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupt key file")
+
+// KeyFile holds the master key wrapped under a scrypt-derived key
+type KeyFile struct {
+	Version int
+	KDF     string
+	N       int
+	R       int
+	P       int
+	Salt    []byte
+	Nonce   []byte
+	Key     []byte
+}
+
+func (k *KeyFile) SetDefaults() {
+	k.Version = 1
+	k.KDF = "scrypt"
+	k.N = 1 << 15
+	k.R = 8
+	k.P = 1
+}
+
+// MasterKey is the random secret everything else is derived from
+type MasterKey []byte
+
+// NewKeyFile generates a master key and wraps it under passphrase
+func NewKeyFile(passphrase string) (*KeyFile, MasterKey, error) {
+	master := make(MasterKey, 32)
+	if _, err := io.ReadFull(rand.Reader, master); err != nil {
+		return nil, nil, err
+	}
+
+	keyFile := &KeyFile{}
+	keyFile.SetDefaults()
+
+	if err := keyFile.wrap(master, passphrase); err != nil {
+		return nil, nil, err
+	}
+
+	return keyFile, master, nil
+}
+
+func (k *KeyFile) kek(passphrase string) ([]byte, error) {
+	if k.KDF != "scrypt" {
+		return nil, errors.New("unsupported key derivation " + k.KDF)
+	}
+
+	return scrypt.Key([]byte(passphrase), k.Salt, k.N, k.R, k.P, chacha20poly1305.KeySize)
+}
+
+func (k *KeyFile) wrap(master MasterKey, passphrase string) error {
+	k.Salt = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, k.Salt); err != nil {
+		return err
+	}
+
+	kek, err := k.kek(passphrase)
+	if err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return err
+	}
+
+	k.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, k.Nonce); err != nil {
+		return err
+	}
+
+	k.Key = aead.Seal(nil, k.Nonce, master, []byte("fastcdc master key"))
+
+	return nil
+}
+
+// Unwrap recovers the master key
+func (k *KeyFile) Unwrap(passphrase string) (MasterKey, error) {
+	kek, err := k.kek(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(k.Nonce) != aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+
+	master, err := aead.Open(nil, k.Nonce, k.Key, []byte("fastcdc master key"))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return master, nil
+}
+
+// ChangePassphrase rewraps the same master key, stored data stays readable
+func (k *KeyFile) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	master, err := k.Unwrap(oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	return k.wrap(master, newPassphrase)
+}
+
+func LoadKeyFile(path string) (*KeyFile, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile := &KeyFile{}
+	if err := json.Unmarshal(bytes, keyFile); err != nil {
+		return nil, err
+	}
+
+	return keyFile, nil
+}
+
+// Save replaces the key file atomically, a torn key file would lose the data
+func (k *KeyFile) Save(path string) error {
+	keyJSON, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fo, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := fo.Name()
+
+	_, err = fo.Write(keyJSON)
+	if err == nil {
+		err = fo.Sync()
+	}
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Derive returns a subkey of the master key for one purpose
+func (m MasterKey) Derive(purpose string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, m, nil, []byte(purpose)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,98 @@
+package encryption
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFileWrapUnwrap(t *testing.T) {
+	keyFile, master, err := NewKeyFile("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(master) != 32 {
+		t.Fatalf("master key is %d bytes", len(master))
+	}
+	if bytes.Contains(keyFile.Key, master) {
+		t.Fatal("key file holds the master key in the clear")
+	}
+
+	path := filepath.Join(t.TempDir(), "key")
+	if err := keyFile.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := loaded.Unwrap("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(unwrapped, master) {
+		t.Fatal("unwrapped a different master key")
+	}
+}
+
+func TestKeyFileWrongPassphrase(t *testing.T) {
+	keyFile, _, err := NewKeyFile("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keyFile.Unwrap("battery staple"); err != ErrWrongPassphrase {
+		t.Fatalf("got %v, want ErrWrongPassphrase", err)
+	}
+
+	keyFile.Key[0] ^= 1
+	if _, err := keyFile.Unwrap("correct horse"); err != ErrWrongPassphrase {
+		t.Fatalf("corrupt key file returned %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	keyFile, master, err := NewKeyFile("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keyFile.ChangePassphrase("wrong", "new"); err != ErrWrongPassphrase {
+		t.Fatalf("got %v with the wrong old passphrase", err)
+	}
+
+	if err := keyFile.ChangePassphrase("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keyFile.Unwrap("old"); err != ErrWrongPassphrase {
+		t.Fatal("old passphrase still unwraps the key")
+	}
+
+	unwrapped, err := keyFile.Unwrap("new")
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(unwrapped, master) {
+		t.Fatal("changing the passphrase changed the master key")
+	}
+}
+
+func TestDerive(t *testing.T) {
+	master := MasterKey(bytes.Repeat([]byte{7}, 32))
+
+	a, err := master.Derive("purpose a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := master.Derive("purpose a")
+	b, _ := master.Derive("purpose b")
+
+	if !bytes.Equal(a, again) {
+		t.Fatal("deriving the same purpose twice gave different keys")
+	}
+	if bytes.Equal(a, b) {
+		t.Fatal("different purposes gave the same key")
+	}
+}
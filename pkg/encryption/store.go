@@ -0,0 +1,165 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"fastcdc-backup/pkg/chunkstore"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// version byte, 24-byte nonce, XChaCha20-Poly1305 ciphertext bound to the ID
+const version byte = 1
+
+var ErrDecrypt = errors.New("object failed authentication")
+
+// Store encrypts objects with random 192-bit nonces
+type Store struct {
+	inner chunkstore.ChunkStore
+	aead  cipher.AEAD
+}
+
+func NewStore(inner chunkstore.ChunkStore, master MasterKey) (*Store, error) {
+	key, err := master.Derive("fastcdc object encryption")
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		inner: inner,
+		aead:  aead,
+	}
+	return store, nil
+}
+
+func (s *Store) seal(id string, data []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, 1+len(nonce)+len(data)+s.aead.Overhead())
+	sealed = append(sealed, version)
+	sealed = append(sealed, nonce...)
+
+	return s.aead.Seal(sealed, nonce, data, []byte(id)), nil
+}
+
+func (s *Store) open(id string, sealed []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < 1+nonceSize+s.aead.Overhead() || sealed[0] != version {
+		return nil, ErrDecrypt
+	}
+
+	data, err := s.aead.Open(nil, sealed[1:1+nonceSize], sealed[1+nonceSize:], []byte(id))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return data, nil
+}
+
+func (s *Store) Put(id string, data []byte) error {
+	// content addressed, don't pay for encrypting what's already there
+	if ok, err := s.inner.Has(id); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	sealed, err := s.seal(id, data)
+	if err != nil {
+		return err
+	}
+
+	return s.inner.Put(id, sealed)
+}
+
+func (s *Store) Get(id string) ([]byte, error) {
+	sealed, err := s.inner.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.open(id, sealed)
+}
+
+func (s *Store) Has(id string) (bool, error) {
+	return s.inner.Has(id)
+}
+
+func (s *Store) Delete(id string) error {
+	return s.inner.Delete(id)
+}
+
+func (s *Store) List() ([]string, error) {
+	return s.inner.List()
+}
+
+// Stat reports the plaintext size
+func (s *Store) Stat(id string) (chunkstore.ChunkInfo, error) {
+	info, err := s.inner.Stat(id)
+	if err != nil {
+		return info, err
+	}
+
+	info.Size -= int64(1 + s.aead.NonceSize() + s.aead.Overhead())
+
+	return info, nil
+}
+
+func (s *Store) Missing(ids []string) ([]string, error) {
+	return chunkstore.Missing(s.inner, ids)
+}
+
+func (s *Store) PutBatch(objects []chunkstore.Object) error {
+	sealed := []chunkstore.Object{}
+
+	for _, object := range objects {
+		data, err := s.seal(object.ID, object.Data)
+		if err != nil {
+			return err
+		}
+
+		sealed = append(sealed, chunkstore.Object{ID: object.ID, Data: data})
+	}
+
+	if err := chunkstore.PutBatch(s.inner, sealed); err != nil {
+		return err
+	}
+
+	for i := range objects {
+		objects[i].Stored = sealed[i].StoredSize()
+	}
+
+	return nil
+}
+
+func (s *Store) Flush() error {
+	if flusher, ok := s.inner.(chunkstore.Flusher); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+func (s *Store) Close() error {
+	if closer, ok := s.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Unwrap returns the store holding the sealed objects
+func (s *Store) Unwrap() chunkstore.ChunkStore {
+	return s.inner
+}
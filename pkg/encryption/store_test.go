@@ -0,0 +1,111 @@
+package encryption
+
+import (
+	"bytes"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+func newStore(t *testing.T, inner chunkstore.ChunkStore, seed byte) *Store {
+	store, err := NewStore(inner, MasterKey(bytes.Repeat([]byte{seed}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestSealOpen(t *testing.T) {
+	inner := chunkstore.NewMemoryStore()
+	store := newStore(t, inner, 1)
+
+	data := []byte("plaintext chunk")
+	if err := store.Put("a1", data); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := inner.Get("a1")
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(sealed, data) {
+		t.Fatal("inner store holds the plaintext")
+	}
+
+	got, err := store.Get("a1")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	info, err := store.Stat("a1")
+	if err != nil || info.Size != int64(len(data)) {
+		t.Fatalf("stat returned %+v, %v, want the plaintext size", info, err)
+	}
+
+	// random nonces, the same chunk never seals to the same bytes
+	objects := []chunkstore.Object{{ID: "b2", Data: data}}
+	if err := store.PutBatch(objects); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := inner.Get("b2")
+	if bytes.Equal(sealed, other) {
+		t.Fatal("equal chunks sealed to equal objects")
+	}
+	if objects[0].Stored != int64(len(other)) {
+		t.Fatalf("batch reports %d stored bytes, the store holds %d", objects[0].Stored, len(other))
+	}
+}
+
+func TestTamperDetected(t *testing.T) {
+	inner := chunkstore.NewMemoryStore()
+	store := newStore(t, inner, 1)
+
+	if err := store.Put("a1", []byte("plaintext chunk")); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := inner.Get("a1")
+
+	for _, i := range []int{0, 1, len(sealed) / 2, len(sealed) - 1} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[i] ^= 1
+		inner.Delete("a1")
+		inner.Put("a1", tampered)
+
+		if _, err := store.Get("a1"); err != ErrDecrypt {
+			t.Fatalf("flipping byte %d returned %v, want ErrDecrypt", i, err)
+		}
+	}
+
+	inner.Delete("a1")
+	inner.Put("a1", sealed[:10])
+	if _, err := store.Get("a1"); err != ErrDecrypt {
+		t.Fatalf("truncated object returned %v, want ErrDecrypt", err)
+	}
+}
+
+func TestObjectsCantBeSwapped(t *testing.T) {
+	inner := chunkstore.NewMemoryStore()
+	store := newStore(t, inner, 1)
+
+	if err := store.Put("a1", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := inner.Get("a1")
+	inner.Put("b2", sealed)
+
+	if _, err := store.Get("b2"); err != ErrDecrypt {
+		t.Fatalf("object moved to another ID returned %v, want ErrDecrypt", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	inner := chunkstore.NewMemoryStore()
+
+	if err := newStore(t, inner, 1).Put("a1", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newStore(t, inner, 2).Get("a1"); err != ErrDecrypt {
+		t.Fatalf("another key returned %v, want ErrDecrypt", err)
+	}
+}
@@ -3,6 +3,8 @@ package fastcdc
 import (
 	"bufio"
 	"crypto/sha512"
+	"fmt"
+	"io"
 	"math"
 )
 
@@ -32,21 +34,34 @@ type Chunker struct {
 }
 
 type Options struct {
-	minSize       int
-	normalSize    int
-	maxSize       int
-	normalization int
+	MinSize       int
+	NormalSize    int
+	MaxSize       int
+	Normalization int
 }
 
 func (opt *Options) SetDefaults() {
-	opt.minSize = 2 * 1000
-	opt.normalSize = 8 * 1000
-	opt.maxSize = 64 * 1000
-	opt.normalization = 2
+	opt.MinSize = 2 * 1000
+	opt.NormalSize = 8 * 1000
+	opt.MaxSize = 64 * 1000
+	opt.Normalization = 2
+}
+
+func (opt Options) Validate() error {
+	if opt.MinSize <= 0 || opt.MinSize > opt.NormalSize || opt.NormalSize > opt.MaxSize {
+		return fmt.Errorf("chunk sizes need 0 < min <= normal <= max, got %d, %d, %d", opt.MinSize, opt.NormalSize, opt.MaxSize)
+	}
+
+	normalBits := int(math.Round(math.Log2(float64(opt.NormalSize))))
+	if opt.Normalization < 0 || opt.Normalization >= normalBits {
+		return fmt.Errorf("normalization %d is out of range for normal size %d", opt.Normalization, opt.NormalSize)
+	}
+
+	return nil
 }
 
 func NewChunker(br *bufio.Reader, opt Options) *Chunker {
-	minSize, normalSize, maxSize, normalization := opt.minSize, opt.normalSize, opt.maxSize, opt.normalization
+	minSize, normalSize, maxSize, normalization := opt.MinSize, opt.NormalSize, opt.MaxSize, opt.Normalization
 
 	normalBits := int(math.Round(math.Log2(float64(normalSize))))
 	smallBits := normalBits + normalization
@@ -69,11 +84,14 @@ func NewChunker(br *bufio.Reader, opt Options) *Chunker {
 	return chunker
 }
 
+// NextChunk returns io.EOF only after the trailing bytes
 func (c *Chunker) NextChunk() (Chunk, error) {
 	for {
 		b, err := c.br.ReadByte()
 
-		if err != nil {
+		if err == io.EOF && len(c.buf) > 0 { // flush the trailing bytes as a final chunk
+			break
+		} else if err != nil {
 			return Chunk{}, err
 		}
 
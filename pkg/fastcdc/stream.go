@@ -0,0 +1,133 @@
+package fastcdc
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// Extent records where a file's bytes sit within a FileStream
+type Extent struct {
+	Path   string
+	Offset int
+	Size   int
+}
+
+// FileStream concatenates files in sorted path order for a single Chunker
+type FileStream struct {
+	paths   []string
+	next    int
+	current *os.File
+
+	offset  int
+	extents []Extent
+}
+
+func NewFileStream(paths []string) *FileStream {
+	sorted := make([]string, len(paths))
+	copy(sorted, paths)
+	sort.Strings(sorted)
+
+	stream := &FileStream{
+		paths:   sorted,
+		next:    0,
+		current: nil,
+		offset:  0,
+		extents: []Extent{},
+	}
+	return stream
+}
+
+func (s *FileStream) Read(p []byte) (int, error) {
+	for {
+		if s.current == nil {
+			if s.next == len(s.paths) {
+				return 0, io.EOF
+			}
+
+			fi, err := os.Open(s.paths[s.next])
+			if err != nil {
+				return 0, err
+			}
+
+			s.current = fi
+			s.extents = append(s.extents, Extent{Path: s.paths[s.next], Offset: s.offset})
+			s.next++
+		}
+
+		n, err := s.current.Read(p)
+		s.offset += n
+		s.extents[len(s.extents)-1].Size += n
+
+		if err == io.EOF { // move on to the next file
+			s.current.Close()
+			s.current = nil
+		} else if err != nil {
+			return n, err
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (s *FileStream) Close() error {
+	if s.current == nil {
+		return nil
+	}
+
+	err := s.current.Close()
+	s.current = nil
+
+	return err
+}
+
+// Extents is only complete once the stream has been read to EOF
+func (s *FileStream) Extents() []Extent {
+	return s.extents
+}
+
+// Slice is the part of chunks[Chunk] that belongs to a single extent
+type Slice struct {
+	Chunk  int
+	Offset int
+	Length int
+}
+
+// SplitExtents maps every extent onto the chunks covering it, both sorted by offset
+func SplitExtents(extents []Extent, chunks []Chunk) [][]Slice {
+	slices := make([][]Slice, len(extents))
+	j := 0
+
+	for i, extent := range extents {
+		start, end := extent.Offset, extent.Offset+extent.Size
+		slices[i] = []Slice{}
+
+		if extent.Size == 0 {
+			continue
+		}
+
+		for j < len(chunks) && chunks[j].Offset+chunks[j].Size <= start {
+			j++
+		}
+
+		for k := j; k < len(chunks) && chunks[k].Offset < end; k++ {
+			lo, hi := start, end
+			if chunks[k].Offset > lo {
+				lo = chunks[k].Offset
+			}
+			if chunks[k].Offset+chunks[k].Size < hi {
+				hi = chunks[k].Offset + chunks[k].Size
+			}
+
+			slices[i] = append(slices[i], Slice{
+				Chunk:  k,
+				Offset: lo - chunks[k].Offset,
+				Length: hi - lo,
+			})
+		}
+	}
+
+	return slices
+}
@@ -0,0 +1,155 @@
+package fastcdc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, contents map[string][]byte) []string {
+	dir := t.TempDir()
+	paths := []string{}
+
+	for name, data := range contents {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+func TestFileStream(t *testing.T) {
+	paths := writeFiles(t, map[string][]byte{
+		"c": []byte("ccc"),
+		"a": []byte("a"),
+		"b": {},
+		"d": []byte("dddd"),
+	})
+
+	stream := NewFileStream(paths)
+	defer stream.Close()
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "acccdddd" {
+		t.Fatalf("read %q, want files concatenated in path order", data)
+	}
+
+	dir := filepath.Dir(paths[0])
+	want := []Extent{
+		{Path: filepath.Join(dir, "a"), Offset: 0, Size: 1},
+		{Path: filepath.Join(dir, "b"), Offset: 1, Size: 0},
+		{Path: filepath.Join(dir, "c"), Offset: 1, Size: 3},
+		{Path: filepath.Join(dir, "d"), Offset: 4, Size: 4},
+	}
+	if !reflect.DeepEqual(stream.Extents(), want) {
+		t.Fatalf("extents %+v, want %+v", stream.Extents(), want)
+	}
+}
+
+func TestFileStreamMissingFile(t *testing.T) {
+	stream := NewFileStream([]string{filepath.Join(t.TempDir(), "missing")})
+	defer stream.Close()
+
+	if _, err := io.ReadAll(stream); err == nil {
+		t.Fatal("reading a missing file succeeded")
+	}
+}
+
+func TestSplitExtents(t *testing.T) {
+	extents := []Extent{
+		{Path: "a", Offset: 0, Size: 3},
+		{Path: "b", Offset: 3, Size: 0},
+		{Path: "c", Offset: 3, Size: 10},
+		{Path: "d", Offset: 13, Size: 2},
+	}
+	chunks := []Chunk{
+		{Offset: 0, Size: 5},
+		{Offset: 5, Size: 4},
+		{Offset: 9, Size: 6},
+	}
+
+	want := [][]Slice{
+		{{Chunk: 0, Offset: 0, Length: 3}},
+		{},
+		{{Chunk: 0, Offset: 3, Length: 2}, {Chunk: 1, Offset: 0, Length: 4}, {Chunk: 2, Offset: 0, Length: 4}},
+		{{Chunk: 2, Offset: 4, Length: 2}},
+	}
+
+	got := SplitExtents(extents, chunks)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("slices %+v, want %+v", got, want)
+	}
+}
+
+func TestChunkedFilesReassemble(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	contents := map[string][]byte{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		data := make([]byte, random.Intn(20000))
+		random.Read(data)
+		contents[name] = data
+	}
+
+	stream := NewFileStream(writeFiles(t, contents))
+	defer stream.Close()
+
+	opt := Options{}
+	opt.SetDefaults()
+	chunker := NewChunker(bufio.NewReader(stream), opt)
+
+	chunks := []Chunk{}
+	for {
+		chunk, err := chunker.NextChunk()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	extents := stream.Extents()
+	for i, slices := range SplitExtents(extents, chunks) {
+		var buf bytes.Buffer
+		for _, slice := range slices {
+			buf.Write(chunks[slice.Chunk].Data[slice.Offset : slice.Offset+slice.Length])
+		}
+
+		name := filepath.Base(extents[i].Path)
+		if !bytes.Equal(buf.Bytes(), contents[name]) {
+			t.Fatalf("%s reassembled to %d bytes, want %d", name, buf.Len(), len(contents[name]))
+		}
+	}
+}
+
+func TestNextChunkFlushesTrailingBytes(t *testing.T) {
+	opt := Options{}
+	opt.SetDefaults()
+
+	data := bytes.Repeat([]byte{7}, opt.MinSize/2)
+	chunker := NewChunker(bufio.NewReader(bytes.NewReader(data)), opt)
+
+	chunk, err := chunker.NextChunk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chunk.Data, data) {
+		t.Fatalf("chunk has %d bytes, want the %d trailing bytes", chunk.Size, len(data))
+	}
+
+	if _, err := chunker.NextChunk(); err != io.EOF {
+		t.Fatalf("got %v after the last chunk, want io.EOF", err)
+	}
+}
@@ -0,0 +1,287 @@
+package gc
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+type Options struct {
+	// every host's hierarchy and chunklists to mark from
+	Namespaces []node.Namespace
+
+	// how long a chunk stays unreferenced before it is swept
+	Grace time.Duration
+
+	// report what would happen without deleting anything or touching the index
+	DryRun bool
+}
+
+func (o *Options) SetDefaults() {
+	o.Namespaces = []node.Namespace{{Hierarchy: "./hierarchy.json", Chunklists: "./chunklists"}}
+	o.Grace = 24 * time.Hour
+	o.DryRun = false
+}
+
+type Result struct {
+	Chunklists int
+	Marked     int
+	Stored     int
+
+	// unreferenced chunks still inside the grace period
+	Pending int
+	Swept   []string
+
+	// referenced but not stored, left out of the index to be uploaded again
+	Missing []string
+
+	// index entries whose instance_count was wrong or that shouldn't exist
+	Recounted int
+
+	// chunklists of files that are no longer in the hierarchy, still marked
+	StaleChunklists []string
+	// files in the hierarchy without a chunklist
+	Unlisted []string
+}
+
+// Run marks from chunklists and snapshots, sweeps and recounts the index
+func Run(store chunkstore.ChunkStore, db *sql.DB, opt Options) (*Result, error) {
+	result := &Result{
+		Swept:           []string{},
+		Missing:         []string{},
+		StaleChunklists: []string{},
+		Unlisted:        []string{},
+	}
+
+	// checksum -> references held by chunklists
+	references := map[string]int64{}
+
+	for _, namespace := range opt.Namespaces {
+		if err := mark(namespace, references, result); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(result.Unlisted)
+
+	if err := sqlitechunks.CreateSnapshotTables(db); err != nil {
+		return nil, err
+	}
+
+	snapshotted, err := sqlitechunks.ListSnapshotChunks(db)
+	if err != nil {
+		return nil, err
+	}
+
+	marked := map[string]bool{}
+	for checksum := range references {
+		marked[checksum] = true
+	}
+	for _, checksum := range snapshotted {
+		marked[checksum] = true
+	}
+	result.Marked = len(marked)
+
+	ids, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	result.Stored = len(ids)
+
+	if err := sqlitechunks.CreateCandidateTable(db); err != nil {
+		return nil, err
+	}
+
+	previous, err := sqlitechunks.ListCandidates(db)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	candidates := map[string]int64{}
+	stored := map[string]bool{}
+
+	for _, id := range ids {
+		stored[id] = true
+		if marked[id] {
+			continue
+		}
+
+		since, ok := previous[id]
+		if !ok {
+			since = now
+		}
+
+		if now-since < int64(opt.Grace/time.Second) {
+			candidates[id] = since
+			result.Pending++
+			continue
+		}
+
+		if !opt.DryRun {
+			if err := store.Delete(id); err != nil && err != chunkstore.ErrNotFound {
+				return nil, err
+			}
+		}
+		result.Swept = append(result.Swept, id)
+	}
+
+	for _, checksum := range sortedKeys(marked) {
+		if !stored[checksum] {
+			result.Missing = append(result.Missing, checksum)
+		}
+	}
+
+	counts := map[string]int64{}
+	for checksum := range marked {
+		if stored[checksum] {
+			counts[checksum] = references[checksum]
+		}
+	}
+
+	indexed, err := sqlitechunks.ListCounts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for checksum, count := range counts {
+		if current, ok := indexed[checksum]; !ok || current != count {
+			result.Recounted++
+		}
+	}
+	for checksum := range indexed {
+		if _, ok := counts[checksum]; !ok {
+			result.Recounted++
+		}
+	}
+
+	if opt.DryRun {
+		return result, nil
+	}
+
+	// a pack store only records deletions in memory until flushed
+	if flusher, ok := store.(chunkstore.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sqlitechunks.ReplaceCounts(db, counts); err != nil {
+		return nil, err
+	}
+
+	if err := sqlitechunks.ReplaceCandidates(db, candidates); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// mark adds a host's references and compares them with its hierarchy
+func mark(namespace node.Namespace, references map[string]int64, result *Result) error {
+	listed, err := hierarchyChunklists(namespace)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+
+	err = filepath.WalkDir(namespace.Chunklists, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == namespace.Chunklists {
+				return filepath.SkipDir
+			}
+			return err
+		} else if entry.IsDir() {
+			return nil
+		}
+
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		fnode := &node.FNode{}
+		if err := json.Unmarshal(bytes, fnode); err != nil {
+			return fmt.Errorf("chunklist %s can't be read, not collecting anything: %w", path, err)
+		}
+		result.Chunklists++
+
+		for _, checksum := range fnode.References() {
+			references[checksum]++
+		}
+
+		seen[filepath.Clean(path)] = true
+		if listed != nil && !listed[filepath.Clean(path)] {
+			result.StaleChunklists = append(result.StaleChunklists, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for path := range listed {
+		if !seen[path] {
+			result.Unlisted = append(result.Unlisted, path)
+		}
+	}
+
+	return nil
+}
+
+// hierarchyChunklists returns nil without a hierarchy
+func hierarchyChunklists(namespace node.Namespace) (map[string]bool, error) {
+	bytes, err := os.ReadFile(namespace.Hierarchy)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	tree := node.Tree{}
+	if err := json.Unmarshal(bytes, &tree); err != nil {
+		return nil, fmt.Errorf("hierarchy %s can't be read: %w", namespace.Hierarchy, err)
+	}
+
+	listed := map[string]bool{}
+	if tree.Root == nil {
+		return listed, nil
+	}
+
+	var walk func(n *node.Node)
+	walk = func(n *node.Node) {
+		if !n.IsDir {
+			rel := strings.TrimPrefix(filepath.Clean(n.Path), filepath.Clean(tree.Root.Path))
+			listed[filepath.Join(namespace.Chunklists, rel)] = true
+		}
+
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(tree.Root)
+
+	return listed, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
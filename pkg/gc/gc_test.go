@@ -0,0 +1,241 @@
+package gc
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+type repo struct {
+	dir   string
+	db    *sql.DB
+	store *chunkstore.MemoryStore
+	opt   Options
+}
+
+func newRepo(t *testing.T) *repo {
+	dir := t.TempDir()
+
+	db, err := sqlitechunks.OpenDB(filepath.Join(dir, "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := sqlitechunks.CreateTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Namespaces = []node.Namespace{{
+		Hierarchy:  filepath.Join(dir, "hierarchy.json"),
+		Chunklists: filepath.Join(dir, "chunklists"),
+	}}
+	opt.Grace = 0
+
+	r := &repo{dir: dir, db: db, store: chunkstore.NewMemoryStore(), opt: opt}
+	return r
+}
+
+func (r *repo) chunklist(t *testing.T, name string, fnode node.FNode) {
+	path := filepath.Join(r.opt.Namespaces[0].Chunklists, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(fnode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (r *repo) hierarchy(t *testing.T, files ...string) {
+	root := &node.Node{Path: "./data", IsDir: true, Children: []*node.Node{}}
+	for _, file := range files {
+		root.Children = append(root.Children, &node.Node{Path: "./data/" + file})
+	}
+
+	data, err := json.Marshal(node.Tree{Root: root, TimeAccessed: time.Now().Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(r.opt.Namespaces[0].Hierarchy, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (r *repo) put(ids ...string) {
+	for _, id := range ids {
+		r.store.Put(id, []byte(id))
+	}
+}
+
+func TestMarkAndSweep(t *testing.T) {
+	r := newRepo(t)
+	r.put("a1", "b2", "c3", "d4")
+	r.chunklist(t, "one", node.FNode{Path: "./data/one", Chunks: []string{"a1", "b2", "a1"}})
+	r.chunklist(t, "two", node.FNode{Path: "./data/two", Slices: []node.Slice{{Chunk: "b2"}, {Chunk: "e5"}}})
+	r.hierarchy(t, "one", "two")
+
+	// drifted counts are rewritten from the chunklists
+	sqlitechunks.ReplaceCounts(r.db, map[string]int64{"a1": 5, "c3": 1})
+
+	result, err := Run(r.store, r.db, r.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Chunklists != 2 || result.Marked != 3 || result.Stored != 4 {
+		t.Fatalf("marked %d of %d from %d chunklists", result.Marked, result.Stored, result.Chunklists)
+	}
+	if len(result.Swept) != 2 || result.Swept[0] != "c3" || result.Swept[1] != "d4" {
+		t.Fatalf("swept %v, want [c3 d4]", result.Swept)
+	}
+	if len(result.Missing) != 1 || result.Missing[0] != "e5" {
+		t.Fatalf("missing %v, want [e5]", result.Missing)
+	}
+
+	for _, id := range []string{"c3", "d4"} {
+		if ok, _ := r.store.Has(id); ok {
+			t.Fatalf("%s was not swept", id)
+		}
+	}
+
+	counts, err := sqlitechunks.ListCounts(r.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"a1": 2, "b2": 2}
+	if len(counts) != len(want) {
+		t.Fatalf("index holds %v, want %v", counts, want)
+	}
+	for checksum, count := range want {
+		if counts[checksum] != count {
+			t.Fatalf("index holds %v, want %v", counts, want)
+		}
+	}
+
+	// a second run finds nothing to do
+	result, err = Run(r.store, r.db, r.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Swept) != 0 || result.Recounted != 0 {
+		t.Fatalf("second run swept %v and recounted %d", result.Swept, result.Recounted)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	r := newRepo(t)
+	r.opt.Grace = time.Hour
+	r.put("a1")
+
+	result, err := Run(r.store, r.db, r.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Pending != 1 || len(result.Swept) != 0 {
+		t.Fatalf("new candidate was swept: %+v", result)
+	}
+
+	// unmarked since long enough
+	if err := sqlitechunks.ReplaceCandidates(r.db, map[string]int64{"a1": time.Now().Add(-2 * time.Hour).Unix()}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = Run(r.store, r.db, r.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Swept) != 1 {
+		t.Fatalf("expired candidate was kept: %+v", result)
+	}
+}
+
+func TestSnapshotsKeepChunks(t *testing.T) {
+	r := newRepo(t)
+	r.put("a1", "b2")
+
+	if err := sqlitechunks.CreateSnapshotTables(r.db); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitechunks.ReplaceSnapshot(r.db, "backup", []string{"a1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Run(r.store, r.db, r.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Swept) != 1 || result.Swept[0] != "b2" {
+		t.Fatalf("swept %v, want [b2]", result.Swept)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	r := newRepo(t)
+	r.put("a1")
+	sqlitechunks.ReplaceCounts(r.db, map[string]int64{"a1": 3})
+
+	r.opt.DryRun = true
+	result, err := Run(r.store, r.db, r.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Swept) != 1 || result.Recounted != 1 {
+		t.Fatalf("dry run reported %+v", result)
+	}
+	if ok, _ := r.store.Has("a1"); !ok {
+		t.Fatal("dry run deleted a chunk")
+	}
+	if count := sqlitechunks.GetCount(r.db, "a1"); count != 3 {
+		t.Fatalf("dry run changed instance_count to %d", count)
+	}
+}
+
+func TestHierarchyMismatch(t *testing.T) {
+	r := newRepo(t)
+	r.chunklist(t, "one", node.FNode{Path: "./data/one", Chunks: []string{}})
+	r.chunklist(t, "gone", node.FNode{Path: "./data/gone", Chunks: []string{}})
+	r.hierarchy(t, "one", "new")
+
+	result, err := Run(r.store, r.db, r.opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.StaleChunklists) != 1 || filepath.Base(result.StaleChunklists[0]) != "gone" {
+		t.Fatalf("stale chunklists %v", result.StaleChunklists)
+	}
+	if len(result.Unlisted) != 1 || filepath.Base(result.Unlisted[0]) != "new" {
+		t.Fatalf("unlisted files %v", result.Unlisted)
+	}
+}
+
+func TestUnreadableChunklist(t *testing.T) {
+	r := newRepo(t)
+	r.put("a1")
+
+	path := filepath.Join(r.opt.Namespaces[0].Chunklists, "broken")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte("{"), 0644)
+
+	if _, err := Run(r.store, r.db, r.opt); err == nil {
+		t.Fatal("gc ran past an unreadable chunklist")
+	}
+	if ok, _ := r.store.Has("a1"); !ok {
+		t.Fatal("chunk swept despite the unreadable chunklist")
+	}
+}
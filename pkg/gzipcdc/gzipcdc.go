@@ -0,0 +1,255 @@
+package gzipcdc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrNotReproducible = errors.New("gzip stream cannot be regenerated byte-for-byte")
+
+var errMismatch = errors.New("recompressed output differs from original")
+
+// levels to try, most common first
+var levels = []int{
+	gzip.DefaultCompression, 9, 1, 2, 3, 4, 5, 7, 8, gzip.NoCompression, gzip.HuffmanOnly,
+}
+
+// content each level is tried on before checking the whole file
+const probeSize = 1 << 20
+
+// Params regenerate the original .gz file
+type Params struct {
+	Level   int
+	Name    string
+	Comment string
+	Extra   []byte
+	ModTime int64
+	OS      byte
+	Size    int64
+}
+
+func IsGzip(path string) bool {
+	fi, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fi.Close()
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(fi, magic); err != nil {
+		return false
+	}
+
+	return magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// Analyze finds compress/flate parameters that reproduce the file, or ErrNotReproducible.
+// Only single-member files written by Go reproduce, GNU gzip, zlib and raw deflate don't.
+func Analyze(path string) (*Params, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	fileInfo, err := fi.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(fi)
+
+	raw, err := br.Peek(10)
+	if err != nil {
+		return nil, ErrNotReproducible
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, ErrNotReproducible
+	}
+	header := zr.Header
+
+	params := &Params{
+		Name:    header.Name,
+		Comment: header.Comment,
+		Extra:   header.Extra,
+		ModTime: 0,
+		OS:      header.OS,
+		Size:    fileInfo.Size(),
+	}
+	if !header.ModTime.IsZero() {
+		params.ModTime = header.ModTime.Unix()
+	}
+
+	candidates := []int{}
+	for _, level := range levels {
+		if extraFlags(level) != raw[8] {
+			continue
+		}
+
+		params.Level = level
+
+		ok, err := reproduces(path, params, probeSize)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			candidates = append(candidates, level)
+		}
+	}
+
+	for _, level := range candidates {
+		params.Level = level
+
+		ok, err := reproduces(path, params, 0)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return params, nil
+		}
+	}
+
+	return nil, ErrNotReproducible
+}
+
+// extraFlags is the XFL header byte compress/gzip writes for level
+func extraFlags(level int) byte {
+	switch level {
+	case gzip.BestCompression:
+		return 2
+	case gzip.BestSpeed:
+		return 4
+	}
+
+	return 0
+}
+
+// reproduces compares recompressed content against path, up to limit when set
+func reproduces(path string, params *Params, limit int64) (bool, error) {
+	src, err := Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	orig, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer orig.Close()
+
+	cw := &compareWriter{r: bufio.NewReader(orig)}
+
+	zw, err := NewWriter(cw, *params)
+	if err != nil {
+		return false, err
+	}
+
+	var content io.Reader = src
+	if limit > 0 {
+		content = io.LimitReader(src, limit)
+	}
+
+	_, err = io.Copy(zw, content)
+	if err == nil && limit == 0 {
+		err = zw.Close()
+	}
+
+	if errors.Is(err, errMismatch) || isCorrupt(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if limit > 0 {
+		return true, nil
+	}
+
+	// trailing members or garbage after the first member can't be regenerated
+	if _, err := cw.r.ReadByte(); err != io.EOF {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func isCorrupt(err error) bool {
+	var corrupt flate.CorruptInputError
+
+	return errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, gzip.ErrHeader) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &corrupt)
+}
+
+type compareWriter struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (cw *compareWriter) Write(p []byte) (int, error) {
+	if cap(cw.buf) < len(p) {
+		cw.buf = make([]byte, len(p))
+	}
+	buf := cw.buf[:len(p)]
+
+	if _, err := io.ReadFull(cw.r, buf); err != nil {
+		return 0, errMismatch
+	}
+
+	if !bytes.Equal(buf, p) {
+		return 0, errMismatch
+	}
+
+	return len(p), nil
+}
+
+type reader struct {
+	*gzip.Reader
+	fi *os.File
+}
+
+func (r *reader) Close() error {
+	r.Reader.Close()
+
+	return r.fi.Close()
+}
+
+// Open returns the uncompressed content of the first gzip member in path
+func Open(path string) (io.ReadCloser, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bufio.NewReader(fi))
+	if err != nil {
+		fi.Close()
+		return nil, err
+	}
+	zr.Multistream(false)
+
+	return &reader{Reader: zr, fi: fi}, nil
+}
+
+// NewWriter reproduces the original file from its content
+func NewWriter(w io.Writer, params Params) (*gzip.Writer, error) {
+	zw, err := gzip.NewWriterLevel(w, params.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	zw.Name = params.Name
+	zw.Comment = params.Comment
+	zw.Extra = params.Extra
+	zw.OS = params.OS
+	if params.ModTime != 0 {
+		zw.ModTime = time.Unix(params.ModTime, 0)
+	}
+
+	return zw, nil
+}
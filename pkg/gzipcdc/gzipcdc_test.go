@@ -0,0 +1,157 @@
+package gzipcdc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func content(size int) []byte {
+	random := rand.New(rand.NewSource(int64(size)))
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon\n"}
+
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.WriteString(words[random.Intn(len(words))])
+	}
+
+	return buf.Bytes()[:size]
+}
+
+func writeGzip(t *testing.T, data []byte, level int) string {
+	path := filepath.Join(t.TempDir(), "file.gz")
+
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Name = "file"
+	zw.Comment = "comment"
+	zw.ModTime = time.Unix(1600000000, 0)
+
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// regenerate rebuilds the .gz file from its uncompressed content
+func regenerate(t *testing.T, path string, params *Params) []byte {
+	src, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	var buf bytes.Buffer
+	zw, err := NewWriter(&buf, *params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(zw, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, level := range levels {
+		for _, size := range []int{0, 100, 50000} {
+			path := writeGzip(t, content(size), level)
+
+			params, err := Analyze(path)
+			if err != nil {
+				t.Fatalf("level %d, size %d: %v", level, size, err)
+			}
+
+			original, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(regenerate(t, path, params), original) {
+				t.Fatalf("level %d, size %d: regenerated file differs", level, size)
+			}
+			if params.Size != int64(len(original)) {
+				t.Fatalf("level %d, size %d: size %d, want %d", level, size, params.Size, len(original))
+			}
+		}
+	}
+}
+
+func TestRoundTripPastProbe(t *testing.T) {
+	path := writeGzip(t, content(3*probeSize/2), gzip.DefaultCompression)
+
+	params, err := Analyze(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(regenerate(t, path, params), original) {
+		t.Fatal("regenerated file differs")
+	}
+}
+
+func TestGNUGzipNotReproducible(t *testing.T) {
+	path := filepath.Join("testdata", "gnu.txt.gz")
+	if !IsGzip(path) {
+		t.Fatal("testdata is not detected as gzip")
+	}
+
+	if _, err := Analyze(path); err != ErrNotReproducible {
+		t.Fatalf("got %v, want ErrNotReproducible", err)
+	}
+}
+
+func TestMultipleMembersNotReproducible(t *testing.T) {
+	path := writeGzip(t, content(1000), gzip.DefaultCompression)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(data, data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Analyze(path); err != ErrNotReproducible {
+		t.Fatalf("got %v, want ErrNotReproducible", err)
+	}
+}
+
+func TestNotGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plain")
+	if err := os.WriteFile(path, []byte("plain text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if IsGzip(path) {
+		t.Fatal("plain file detected as gzip")
+	}
+	if _, err := Analyze(path); err != ErrNotReproducible {
+		t.Fatalf("got %v, want ErrNotReproducible", err)
+	}
+}
@@ -0,0 +1,134 @@
+package ingest
+
+import (
+	"database/sql"
+	"fmt"
+
+	"fastcdc-backup/pkg/accounting"
+	"fastcdc-backup/pkg/chunkid"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/fastcdc"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+type Options struct {
+	// names chunks as configured for the repository
+	ChunkID chunkid.Func
+
+	Quota accounting.Quota
+
+	// leave chunks nothing references in the store for gc
+	Collected bool
+}
+
+func (o *Options) SetDefaults() {
+	o.ChunkID = chunkid.SHA512
+	o.Quota = accounting.Quota{}
+	o.Collected = false
+}
+
+func (o Options) Validate() error {
+	if o.ChunkID == nil {
+		return fmt.Errorf("a chunk ID function is required")
+	}
+
+	return o.Quota.Validate()
+}
+
+// Writer stores chunks and keeps the index's sizes and counts in step
+type Writer struct {
+	db    *sql.DB
+	store chunkstore.ChunkStore
+	opt   Options
+
+	// the soft quota is only warned about once per writer
+	quotaWarned bool
+}
+
+func NewWriter(db *sql.DB, store chunkstore.ChunkStore, opt Options) (*Writer, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+
+	writer := &Writer{
+		db:          db,
+		store:       store,
+		opt:         opt,
+		quotaWarned: false,
+	}
+	return writer, nil
+}
+
+func (w *Writer) ID(data []byte) string {
+	return w.opt.ChunkID(data)
+}
+
+// WriteChunk uploads a single chunk, returning its ID
+func (w *Writer) WriteChunk(chunk *fastcdc.Chunk) (string, error) {
+	id := w.ID(chunk.Data)
+
+	err := w.Upload([]chunkstore.Object{{ID: id, Data: chunk.Data}})
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Wrote %d bytes to %s\n", len(chunk.Data), id)
+
+	return id, nil
+}
+
+// Upload writes chunks within the repository quota and records their sizes
+func (w *Writer) Upload(objects []chunkstore.Object) error {
+	adding := int64(0)
+	for _, object := range objects {
+		adding += int64(len(object.Data))
+	}
+
+	stored, err := sqlitechunks.StoredBytes(w.db)
+	if err != nil {
+		return err
+	}
+
+	if err := w.opt.Quota.Check(stored, adding); err != nil {
+		return err
+	}
+
+	err = chunkstore.PutBatch(w.store, objects)
+	if err != nil {
+		return err
+	}
+
+	err = sqlitechunks.SetSizes(w.db, accounting.Measure(objects))
+	if err != nil {
+		return err
+	}
+
+	if !w.quotaWarned && w.opt.Quota.OverSoft(stored+adding) {
+		fmt.Printf("warning: repository holds about %d bytes, past its soft quota of %d\n", stored+adding, w.opt.Quota.Soft)
+		w.quotaWarned = true
+	}
+
+	return nil
+}
+
+// AddReference counts in one statement, other hosts may be writing too
+func (w *Writer) AddReference(checksum string) error {
+	return sqlitechunks.AddReference(w.db, checksum)
+}
+
+// Release deletes the chunk at zero references unless gc collects it
+func (w *Writer) Release(checksum string) error {
+	instances, err := sqlitechunks.Release(w.db, checksum)
+	if err != nil {
+		return err
+	}
+
+	if instances <= 0 && !w.opt.Collected {
+		// only releases our reference on a chunk server, queued behind uploads with an outbox
+		err := w.store.Delete(checksum)
+		if err != nil && err != chunkstore.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/flate"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"fastcdc-backup/pkg/accounting"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/compression"
+	"fastcdc-backup/pkg/fastcdc"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+func openIndex(t *testing.T) *sql.DB {
+	db, err := sqlitechunks.OpenDB(filepath.Join(t.TempDir(), "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := sqlitechunks.CreateTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlitechunks.CreateSizeTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func newWriter(t *testing.T, store chunkstore.ChunkStore, opt Options) (*Writer, *sql.DB) {
+	db := openIndex(t)
+
+	writer, err := NewWriter(db, store, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writer, db
+}
+
+func TestWriteReferenceRelease(t *testing.T) {
+	store := chunkstore.NewMemoryStore()
+	opt := Options{}
+	opt.SetDefaults()
+	writer, db := newWriter(t, store, opt)
+
+	chunk := fastcdc.Chunk{Data: []byte("chunk"), Size: 5}
+	id, err := writer.WriteChunk(&chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Has(id); !ok {
+		t.Fatal("written chunk is not in the store")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := writer.AddReference(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored, err := sqlitechunks.StoredBytes(db)
+	if err != nil {
+		t.Fatal(err)
+	} else if stored != 5 {
+		t.Fatalf("index records %d stored bytes, want 5", stored)
+	}
+	if count := sqlitechunks.GetCount(db, id); count != 2 {
+		t.Fatalf("instance_count %d, want 2", count)
+	}
+
+	if err := writer.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Has(id); !ok {
+		t.Fatal("chunk deleted while still referenced")
+	}
+
+	if err := writer.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Has(id); ok {
+		t.Fatal("unreferenced chunk is still in the store")
+	}
+	if sqlitechunks.Exists(db, id) {
+		t.Fatal("unreferenced chunk is still in the index")
+	}
+}
+
+func TestUploadRecordsStoredSize(t *testing.T) {
+	store, err := compression.NewStore(chunkstore.NewMemoryStore(), flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := Options{}
+	opt.SetDefaults()
+	writer, db := newWriter(t, store, opt)
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	id := writer.ID(data)
+	if err := writer.Upload([]chunkstore.Object{{ID: id, Data: data}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.AddReference(id); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := sqlitechunks.StoredBytes(db)
+	if err != nil {
+		t.Fatal(err)
+	} else if stored <= 0 || stored >= int64(len(data)) {
+		t.Fatalf("index records %d stored bytes for %d compressible bytes", stored, len(data))
+	}
+}
+
+func TestReleaseCollected(t *testing.T) {
+	store := chunkstore.NewMemoryStore()
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Collected = true
+	writer, db := newWriter(t, store, opt)
+
+	id, err := writer.WriteChunk(&fastcdc.Chunk{Data: []byte("chunk"), Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.AddReference(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.Has(id); !ok {
+		t.Fatal("chunk left for gc was deleted")
+	}
+	if sqlitechunks.Exists(db, id) {
+		t.Fatal("unreferenced chunk is still in the index")
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	store := chunkstore.NewMemoryStore()
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Quota = accounting.Quota{Hard: 8}
+	writer, _ := newWriter(t, store, opt)
+
+	id, err := writer.WriteChunk(&fastcdc.Chunk{Data: []byte("12345"), Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.AddReference(id); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = writer.WriteChunk(&fastcdc.Chunk{Data: []byte("67890"), Size: 5})
+	if !errors.Is(err, accounting.ErrQuotaExceeded) {
+		t.Fatalf("got %v, want ErrQuotaExceeded", err)
+	}
+
+	ids, _ := store.List()
+	if len(ids) != 1 {
+		t.Fatalf("store holds %d chunks after the refused upload, want 1", len(ids))
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Quota = accounting.Quota{Soft: 10, Hard: 5}
+
+	if _, err := NewWriter(nil, chunkstore.NewMemoryStore(), opt); err == nil {
+		t.Fatal("soft quota above the hard quota was accepted")
+	}
+}
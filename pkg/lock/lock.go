@@ -0,0 +1,405 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+var ErrLocked = errors.New("repository is locked")
+
+// ErrLost means the lock was removed while held, likely by unlock
+var ErrLost = errors.New("lock was removed while held")
+
+type Options struct {
+	// how often a held lock's heartbeat is renewed
+	Refresh time.Duration
+
+	// heartbeats older than this belong to dead processes, allow for skew
+	StaleAfter time.Duration
+
+	// how long Acquire waits and polls for conflicts, 0 doesn't wait
+	Wait time.Duration
+	Poll time.Duration
+}
+
+func (o *Options) SetDefaults() {
+	o.Refresh = time.Minute
+	o.StaleAfter = 10 * time.Minute
+	o.Wait = time.Minute
+	o.Poll = 5 * time.Second
+}
+
+// Lock is held by one process, shared locks conflict with the same command on the same host
+type Lock struct {
+	ID        string
+	Exclusive bool
+	Host      string
+	PID       int
+	Command   string
+	Created   time.Time
+	Heartbeat time.Time
+
+	// the object currently holding the lock, replaced on every heartbeat
+	object string
+}
+
+func (l Lock) Stale(now time.Time, opt Options) bool {
+	return now.Sub(l.Heartbeat) > opt.StaleAfter
+}
+
+func (l Lock) String() string {
+	kind := "shared"
+	if l.Exclusive {
+		kind = "exclusive"
+	}
+
+	return fmt.Sprintf("%s lock %s held by %s on %s (pid %d) since %s, last heartbeat %s", kind, l.ID, l.Command, l.Host, l.PID,
+		l.Created.Format(time.RFC3339), l.Heartbeat.Format(time.RFC3339))
+}
+
+// conflicts reports whether l can't be held alongside other
+func (l Lock) conflicts(other Lock) bool {
+	if l.ID == other.ID {
+		return false
+	}
+
+	return l.Exclusive || other.Exclusive || (l.Host == other.Host && l.Command == other.Command)
+}
+
+// objects are named <lock id>-<heartbeat sequence>
+func objectName(id string, seq int) string {
+	return id + "-" + strconv.Itoa(seq)
+}
+
+func parseObject(name string) (string, int, bool) {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return "", 0, false
+	}
+
+	seq, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return name[:i], seq, true
+}
+
+// List returns the locks in store, whether live or stale
+func List(store chunkstore.ChunkStore) ([]Lock, error) {
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[string]int{}
+	for _, name := range names {
+		if id, seq, ok := parseObject(name); ok {
+			if current, ok := latest[id]; !ok || seq > current {
+				latest[id] = seq
+			}
+		}
+	}
+
+	locks := []Lock{}
+	for id, seq := range latest {
+		object := objectName(id, seq)
+
+		data, err := store.Get(object)
+		if err == chunkstore.ErrNotFound { // released or refreshed meanwhile
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		lock := Lock{}
+		if err := json.Unmarshal(data, &lock); err != nil {
+			return nil, fmt.Errorf("lock %s can't be read: %w", object, err)
+		}
+		lock.object = object
+
+		locks = append(locks, lock)
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Created.Before(locks[j].Created)
+	})
+
+	return locks, nil
+}
+
+// Remove deletes every object of a lock
+func Remove(store chunkstore.ChunkStore, id string) error {
+	names, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if lockID, _, ok := parseObject(name); ok && lockID == id {
+			if err := store.Delete(name); err != nil && err != chunkstore.ErrNotFound {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RemoveStale deletes the locks whose heartbeat has stopped and returns them
+func RemoveStale(store chunkstore.ChunkStore, opt Options) ([]Lock, error) {
+	locks, err := List(store)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	removed := []Lock{}
+	for _, lock := range locks {
+		if !lock.Stale(now, opt) {
+			continue
+		}
+
+		if err := Remove(store, lock.ID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, lock)
+	}
+
+	return removed, nil
+}
+
+// Handle is a held lock, kept alive by a heartbeat until released
+type Handle struct {
+	store chunkstore.ChunkStore
+	opt   Options
+
+	mu   sync.Mutex
+	lock Lock
+	seq  int
+	err  error
+
+	stop    chan struct{}
+	done    chan struct{}
+	release sync.Once
+}
+
+// Acquire waits up to opt.Wait for conflicting live locks, then fails with ErrLocked
+func Acquire(store chunkstore.ChunkStore, exclusive bool, command string, opt Options) (*Handle, error) {
+	deadline := time.Now().Add(opt.Wait)
+
+	for {
+		handle, err := tryAcquire(store, exclusive, command, opt)
+		if !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			return handle, err
+		}
+
+		// jittered so processes don't collide again
+		time.Sleep(opt.Poll + time.Duration(mathrand.Int63n(int64(opt.Poll/2)+1)))
+	}
+}
+
+func tryAcquire(store chunkstore.ChunkStore, exclusive bool, command string, opt Options) (*Handle, error) {
+	if err := checkConflicts(store, Lock{Exclusive: exclusive, Host: hostname(), Command: command}, opt); err != nil {
+		return nil, err
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	handle := &Handle{
+		store: store,
+		opt:   opt,
+		lock: Lock{
+			ID:        hex.EncodeToString(random),
+			Exclusive: exclusive,
+			Host:      hostname(),
+			PID:       os.Getpid(),
+			Command:   command,
+			Created:   now,
+			Heartbeat: now,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if err := handle.write(); err != nil {
+		return nil, err
+	}
+
+	// both back off if a conflicting lock raced ours
+	if err := checkConflicts(store, handle.lock, opt); err != nil {
+		Remove(store, handle.lock.ID)
+		return nil, err
+	}
+
+	go handle.heartbeat()
+
+	return handle, nil
+}
+
+func checkConflicts(store chunkstore.ChunkStore, lock Lock, opt Options) error {
+	locks, err := List(store)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, other := range locks {
+		if !other.Stale(now, opt) && lock.conflicts(other) {
+			return fmt.Errorf("%w: %s", ErrLocked, other)
+		}
+	}
+
+	return nil
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+
+	return host
+}
+
+// write puts the next object before dropping the previous, h.mu held
+func (h *Handle) write() error {
+	data, err := json.Marshal(h.lock)
+	if err != nil {
+		return err
+	}
+
+	object := objectName(h.lock.ID, h.seq+1)
+	if err := h.store.Put(object, data); err != nil {
+		return err
+	}
+
+	if h.lock.object != "" {
+		if err := h.store.Delete(h.lock.object); err != nil && err != chunkstore.ErrNotFound {
+			return err
+		}
+	}
+
+	h.seq++
+	h.lock.object = object
+
+	return nil
+}
+
+func (h *Handle) refresh() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ok, err := h.store.Has(h.lock.object); err != nil {
+		return err
+	} else if !ok {
+		return ErrLost
+	}
+
+	h.lock.Heartbeat = time.Now()
+
+	return h.write()
+}
+
+func (h *Handle) heartbeat() {
+	defer close(h.done)
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(h.opt.Refresh):
+		}
+
+		// a failed refresh is retried, the lock only goes stale after several
+		err := h.refresh()
+
+		h.mu.Lock()
+		h.err = err
+		h.mu.Unlock()
+
+		if err == ErrLost {
+			return
+		}
+	}
+}
+
+// Err returns why the last heartbeat failed, or nil
+func (h *Handle) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.err
+}
+
+func (h *Handle) Lock() Lock {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.lock
+}
+
+// Release stops the heartbeat and removes the lock, once
+func (h *Handle) Release() error {
+	var err error
+
+	h.release.Do(func() {
+		close(h.stop)
+		<-h.done
+
+		err = Remove(h.store, h.lock.ID)
+		if err == nil && h.err == ErrLost {
+			err = ErrLost
+		}
+
+		if closer, ok := h.store.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+
+	return err
+}
+
+// hidden leaves one lock out of listings
+type hidden struct {
+	chunkstore.ChunkStore
+	id string
+}
+
+// Hide serves store without held, so locks taken through a server don't conflict with the server's own
+func Hide(store chunkstore.ChunkStore, held *Handle) chunkstore.ChunkStore {
+	return &hidden{ChunkStore: store, id: held.Lock().ID}
+}
+
+func (s *hidden) List() ([]string, error) {
+	names, err := s.ChunkStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	visible := []string{}
+	for _, name := range names {
+		if id, _, ok := parseObject(name); !ok || id != s.id {
+			visible = append(visible, name)
+		}
+	}
+
+	return visible, nil
+}
@@ -0,0 +1,135 @@
+package lock
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+func testOptions(wait time.Duration) Options {
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Wait = wait
+	opt.Poll = 10 * time.Millisecond
+
+	return opt
+}
+
+// closingStore records whether it was closed
+type closingStore struct {
+	*chunkstore.MemoryStore
+	closed bool
+}
+
+func (s *closingStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSharedLocks(t *testing.T) {
+	store := chunkstore.NewMemoryStore()
+
+	backup, err := Acquire(store, false, "backup", testOptions(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Release()
+
+	serve, err := Acquire(store, false, "serve", testOptions(0))
+	if err != nil {
+		t.Fatalf("shared locks of different commands conflict: %v", err)
+	}
+	defer serve.Release()
+
+	if _, err := Acquire(store, false, "backup", testOptions(0)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second backup on the same host returned %v, want ErrLocked", err)
+	}
+	if _, err := Acquire(store, true, "prune", testOptions(0)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("exclusive lock next to shared ones returned %v, want ErrLocked", err)
+	}
+}
+
+func TestAcquireWaits(t *testing.T) {
+	store := chunkstore.NewMemoryStore()
+
+	held, err := Acquire(store, true, "prune", testOptions(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held.Release()
+	}()
+
+	handle, err := Acquire(store, false, "backup", testOptions(5*time.Second))
+	if err != nil {
+		t.Fatalf("lock wasn't taken once the conflicting one was released: %v", err)
+	}
+	if err := handle.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if names, _ := store.List(); len(names) != 0 {
+		t.Fatalf("released locks left %v", names)
+	}
+}
+
+func TestAcquireTimesOut(t *testing.T) {
+	store := chunkstore.NewMemoryStore()
+
+	held, err := Acquire(store, true, "prune", testOptions(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	start := time.Now()
+	if _, err := Acquire(store, false, "backup", testOptions(50*time.Millisecond)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v, want ErrLocked", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("gave up after %v", waited)
+	}
+}
+
+func TestStaleLocksAreIgnored(t *testing.T) {
+	store := chunkstore.NewMemoryStore()
+	opt := testOptions(0)
+
+	held, err := Acquire(store, true, "prune", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	opt.StaleAfter = -time.Second
+	handle, err := Acquire(store, true, "gc", opt)
+	if err != nil {
+		t.Fatalf("stale lock blocked: %v", err)
+	}
+	defer handle.Release()
+
+	removed, err := RemoveStale(store, opt)
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("removed %d stale locks, %v", len(removed), err)
+	}
+}
+
+func TestReleaseClosesStore(t *testing.T) {
+	store := &closingStore{MemoryStore: chunkstore.NewMemoryStore()}
+
+	handle, err := Acquire(store, false, "backup", testOptions(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handle.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.closed {
+		t.Fatal("store wasn't closed on release")
+	}
+}
@@ -0,0 +1,235 @@
+package mirror
+
+import (
+	"bytes"
+	"database/sql"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"fastcdc-backup/pkg/chunkid"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+type Options struct {
+	// rehash chunks, skipping those that don't match their ID
+	Verify chunkid.Func
+
+	// batch size, the destination is flushed after each
+	BatchBytes int
+}
+
+func (o *Options) SetDefaults() {
+	o.Verify = nil
+	o.BatchBytes = 8 << 20
+}
+
+type Result struct {
+	Listed  int
+	Missing int
+	Copied  int
+	Bytes   int64
+	Corrupt []string
+}
+
+// Chunks copies the chunks dst is missing, never deleting from it
+func Chunks(src, dst chunkstore.ChunkStore, opt Options) (Result, error) {
+	result := Result{Corrupt: []string{}}
+
+	ids, err := src.List()
+	if err != nil {
+		return result, err
+	}
+	sort.Strings(ids)
+	result.Listed = len(ids)
+
+	missing, err := chunkstore.Missing(dst, ids)
+	if err != nil {
+		return result, err
+	}
+	result.Missing = len(missing)
+
+	batch := []chunkstore.Object{}
+	size := 0
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := chunkstore.PutBatch(dst, batch); err != nil {
+			return err
+		}
+
+		if flusher, ok := dst.(chunkstore.Flusher); ok {
+			if err := flusher.Flush(); err != nil {
+				return err
+			}
+		}
+
+		for _, object := range batch {
+			result.Copied++
+			result.Bytes += int64(len(object.Data))
+		}
+
+		batch = []chunkstore.Object{}
+		size = 0
+
+		return nil
+	}
+
+	for _, id := range missing {
+		data, err := src.Get(id)
+		if err != nil {
+			return result, err
+		}
+
+		if opt.Verify != nil && chunkid.Verify(opt.Verify, id, data) != nil {
+			result.Corrupt = append(result.Corrupt, id)
+			continue
+		}
+
+		batch = append(batch, chunkstore.Object{ID: id, Data: data})
+		size += len(data)
+
+		if size >= opt.BatchBytes {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, flush()
+}
+
+// Index makes the instance counts in dst match src
+func Index(src, dst *sql.DB) error {
+	counts, err := sqlitechunks.ListCounts(src)
+	if err != nil {
+		return err
+	}
+
+	return sqlitechunks.ReplaceCounts(dst, counts)
+}
+
+// Files makes dst match src, rewriting changed files atomically
+func Files(src, dst string) (int, error) {
+	written := 0
+	seen := map[string]bool{}
+
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == src {
+				return filepath.SkipDir
+			}
+			return err
+		} else if entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		seen[rel] = true
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+		if current, err := os.ReadFile(target); err == nil && bytes.Equal(current, data) {
+			return nil
+		}
+
+		if err := writeFile(target, data); err != nil {
+			return err
+		}
+		written++
+
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+
+	err = filepath.WalkDir(dst, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dst {
+				return filepath.SkipDir
+			}
+			return err
+		} else if entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+
+		if !seen[rel] {
+			return os.Remove(path)
+		}
+
+		return nil
+	})
+
+	return written, err
+}
+
+// File copies a single file when it differs, removing dst if src is gone
+func File(src, dst string) (bool, error) {
+	data, err := os.ReadFile(src)
+	if os.IsNotExist(err) {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if current, err := os.ReadFile(dst); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+
+	return true, writeFile(dst, data)
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	fo, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := fo.Name()
+
+	_, err = fo.Write(data)
+	if err == nil {
+		err = fo.Chmod(0644)
+	}
+	if err == nil {
+		err = fo.Sync()
+	}
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package mirror
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkid"
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// failingStore stops accepting chunks after a number of puts
+type failingStore struct {
+	*chunkstore.MemoryStore
+	puts int
+}
+
+func (s *failingStore) Put(id string, data []byte) error {
+	if s.puts == 0 {
+		return errors.New("connection lost")
+	}
+	s.puts--
+
+	return s.MemoryStore.Put(id, data)
+}
+
+func newSource(t *testing.T, contents ...string) (*chunkstore.MemoryStore, []string) {
+	src := chunkstore.NewMemoryStore()
+	ids := []string{}
+
+	for _, content := range contents {
+		id := chunkid.SHA512([]byte(content))
+		if err := src.Put(id, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	return src, ids
+}
+
+func checkCopied(t *testing.T, dst chunkstore.ChunkStore, ids []string) {
+	for _, id := range ids {
+		if ok, err := dst.Has(id); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("%s was not mirrored", id)
+		}
+	}
+}
+
+func TestChunksIncremental(t *testing.T) {
+	src, ids := newSource(t, "one", "two", "three")
+
+	dst := chunkstore.NewMemoryStore()
+	if err := dst.Put(ids[0], []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := Options{}
+	opt.SetDefaults()
+
+	result, err := Chunks(src, dst, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Listed != 3 || result.Missing != 2 || result.Copied != 2 {
+		t.Fatalf("first run %+v, want 2 of 3 copied", result)
+	}
+	checkCopied(t, dst, ids)
+
+	result, err = Chunks(src, dst, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Missing != 0 || result.Copied != 0 {
+		t.Fatalf("second run %+v copied again", result)
+	}
+}
+
+func TestChunksResume(t *testing.T) {
+	src, ids := newSource(t, "one", "two", "three")
+
+	opt := Options{}
+	opt.SetDefaults()
+	opt.BatchBytes = 1
+
+	dst := &failingStore{MemoryStore: chunkstore.NewMemoryStore(), puts: 1}
+
+	result, err := Chunks(src, dst, opt)
+	if err == nil {
+		t.Fatal("a failing destination returned no error")
+	}
+	if result.Copied != 1 {
+		t.Fatalf("copied %d chunks before failing, want 1", result.Copied)
+	}
+
+	dst.puts = 3
+
+	result, err = Chunks(src, dst, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Missing != 2 || result.Copied != 2 {
+		t.Fatalf("resumed run %+v, want the 2 remaining chunks", result)
+	}
+	checkCopied(t, dst, ids)
+}
+
+func TestChunksSkipsCorrupt(t *testing.T) {
+	src, ids := newSource(t, "one", "two")
+
+	if err := src.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Put(ids[1], []byte("bit rot")); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Verify = chunkid.SHA512
+
+	dst := chunkstore.NewMemoryStore()
+
+	result, err := Chunks(src, dst, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Corrupt) != 1 || result.Corrupt[0] != ids[1] || result.Copied != 1 {
+		t.Fatalf("result %+v, want the corrupt chunk skipped", result)
+	}
+	if ok, _ := dst.Has(ids[1]); ok {
+		t.Fatal("a corrupt chunk was mirrored")
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	dst := filepath.Join(t.TempDir(), "dst")
+
+	writeFiles(t, src, map[string]string{"a/x.json": "x", "b.json": "b", "same.json": "same"})
+	writeFiles(t, dst, map[string]string{"a/x.json": "old", "same.json": "same", "gone/c.json": "c"})
+
+	written, err := Files(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 2 {
+		t.Fatalf("wrote %d files, want the changed and the new one", written)
+	}
+
+	for name, want := range map[string]string{"a/x.json": "x", "b.json": "b", "same.json": "same"} {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("%s holds %q, want %q", name, data, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "gone/c.json")); !os.IsNotExist(err) {
+		t.Fatalf("a file missing from the source was kept: %v", err)
+	}
+
+	written, err = Files(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 0 {
+		t.Fatalf("an unchanged mirror rewrote %d files", written)
+	}
+}
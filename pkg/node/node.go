@@ -3,7 +3,10 @@ package node
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
+
+	"fastcdc-backup/pkg/gzipcdc"
 )
 
 type Tree struct {
@@ -11,6 +14,22 @@ type Tree struct {
 	Root         *Node
 }
 
+// Namespace is one host's hierarchy and chunklists, Host empty when unshared
+type Namespace struct {
+	Host       string
+	Hierarchy  string
+	Chunklists string
+}
+
+// Qualify prefixes a name with the host so hosts can't collide
+func (n Namespace) Qualify(name string) string {
+	if n.Host == "" {
+		return name
+	}
+
+	return n.Host + ":" + name
+}
+
 type Node struct {
 	Path     string
 	IsDir    bool
@@ -51,16 +70,29 @@ type Options struct {
 	Path   string
 	Size   int64
 	Chunks []string
+	Slices []Slice
+	Gzip   *gzipcdc.Params
+}
+
+// Slice references part of a chunk shared with other files
+type Slice struct {
+	Chunk  string
+	Offset int64
+	Length int64
 }
 
 type FNode struct {
 	Path   string
 	Size   int64
 	Chunks []string
+	Slices []Slice `json:",omitempty"`
+
+	// set when the chunks hold the decompressed content of a .gz file
+	Gzip *gzipcdc.Params `json:",omitempty"`
 }
 
 func NewFNode(opt Options) (*FNode, error) {
-	Path, Size, Chunks := opt.Path, opt.Size, opt.Chunks
+	Path, Size, Chunks, Slices, Gzip := opt.Path, opt.Size, opt.Chunks, opt.Slices, opt.Gzip
 
 	if Path == "" {
 		return nil, errors.New("error creating FNode")
@@ -70,11 +102,80 @@ func NewFNode(opt Options) (*FNode, error) {
 		Path:   Path,
 		Size:   Size,
 		Chunks: Chunks,
+		Slices: Slices,
+		Gzip:   Gzip,
 	}
 
 	return fnode, nil
 }
 
+// References returns one checksum per reference, as instance_count counts
+func (f *FNode) References() []string {
+	if len(f.Slices) == 0 {
+		return f.Chunks
+	}
+
+	references := []string{}
+	for _, slice := range f.Slices {
+		references = append(references, slice.Chunk)
+	}
+
+	return references
+}
+
+// Restore writes the file contents to w, loading chunk data through load
+func (f *FNode) Restore(w io.Writer, load func(checksum string) ([]byte, error)) error {
+	if f.Gzip == nil {
+		return f.restoreChunks(w, load)
+	}
+
+	// chunks hold the uncompressed stream, recompress it into the original file
+	zw, err := gzipcdc.NewWriter(w, *f.Gzip)
+	if err != nil {
+		return err
+	}
+
+	if err := f.restoreChunks(zw, load); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func (f *FNode) restoreChunks(w io.Writer, load func(checksum string) ([]byte, error)) error {
+	if len(f.Slices) == 0 {
+		for _, checksum := range f.Chunks {
+			data, err := load(checksum)
+			if err != nil {
+				return err
+			}
+
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, slice := range f.Slices {
+		data, err := load(slice.Chunk)
+		if err != nil {
+			return err
+		}
+
+		if slice.Offset < 0 || slice.Length < 0 || slice.Offset+slice.Length > int64(len(data)) {
+			return fmt.Errorf("slice [%d, %d) is out of range for chunk %s", slice.Offset, slice.Offset+slice.Length, slice.Chunk)
+		}
+
+		if _, err := w.Write(data[slice.Offset : slice.Offset+slice.Length]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func walk(node *Node) {
 	files, _ := os.ReadDir(node.Path)
 
@@ -0,0 +1,69 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func loader(chunks map[string][]byte) func(string) ([]byte, error) {
+	return func(checksum string) ([]byte, error) {
+		data, ok := chunks[checksum]
+		if !ok {
+			return nil, errors.New("missing chunk " + checksum)
+		}
+		return data, nil
+	}
+}
+
+func TestRestoreChunks(t *testing.T) {
+	load := loader(map[string][]byte{"x": []byte("hello "), "y": []byte("world")})
+	fnode := &FNode{Path: "f", Size: 11, Chunks: []string{"x", "y"}}
+
+	var buf bytes.Buffer
+	if err := fnode.Restore(&buf, load); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello world" {
+		t.Fatalf("restored %q", buf.String())
+	}
+}
+
+func TestRestoreSlices(t *testing.T) {
+	load := loader(map[string][]byte{"x": []byte("aabbb"), "y": []byte("bbcc")})
+	fnode := &FNode{
+		Path:   "b",
+		Size:   5,
+		Chunks: []string{"x", "y"},
+		Slices: []Slice{{Chunk: "x", Offset: 2, Length: 3}, {Chunk: "y", Offset: 0, Length: 2}},
+	}
+
+	var buf bytes.Buffer
+	if err := fnode.Restore(&buf, load); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "bbbbb" {
+		t.Fatalf("restored %q", buf.String())
+	}
+
+	if got := fnode.References(); len(got) != 2 || got[0] != "x" || got[1] != "y" {
+		t.Fatalf("references %v", got)
+	}
+}
+
+func TestRestoreSliceOutOfRange(t *testing.T) {
+	load := loader(map[string][]byte{"x": []byte("abc")})
+	fnode := &FNode{Path: "f", Slices: []Slice{{Chunk: "x", Offset: 2, Length: 2}}}
+
+	if err := fnode.Restore(&bytes.Buffer{}, load); err == nil {
+		t.Fatal("restoring past the end of a chunk succeeded")
+	}
+}
+
+func TestRestoreMissingChunk(t *testing.T) {
+	fnode := &FNode{Path: "f", Chunks: []string{"x"}}
+
+	if err := fnode.Restore(&bytes.Buffer{}, loader(map[string][]byte{})); err == nil {
+		t.Fatal("restoring a missing chunk succeeded")
+	}
+}
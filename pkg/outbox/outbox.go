@@ -0,0 +1,407 @@
+package outbox
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+type Options struct {
+	// most chunks sent to the store in one batch
+	BatchSize int
+
+	// the wait after a failed attempt doubles from MinBackoff up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// how often Run looks for new entries
+	Poll time.Duration
+}
+
+func (o *Options) SetDefaults() {
+	o.BatchSize = 100
+	o.MinBackoff = time.Second
+	o.MaxBackoff = time.Hour
+	o.Poll = time.Second
+}
+
+// Store queues changes for Drain, no Unwrap as bypassing it would reorder them
+type Store struct {
+	db   *sql.DB
+	open func() (chunkstore.ChunkStore, error)
+	opt  Options
+
+	mu    sync.Mutex
+	inner chunkstore.ChunkStore
+}
+
+func NewStore(db *sql.DB, open func() (chunkstore.ChunkStore, error), opt Options) (*Store, error) {
+	if err := sqlitechunks.CreateOutboxTable(db); err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		db:   db,
+		open: open,
+		opt:  opt,
+	}
+	return store, nil
+}
+
+// Inner returns the store changes are applied to, opening it if needed
+func (s *Store) Inner() (chunkstore.ChunkStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connect()
+}
+
+// connect opens the inner store, s.mu held
+func (s *Store) connect() (chunkstore.ChunkStore, error) {
+	if s.inner != nil {
+		return s.inner, nil
+	}
+
+	inner, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	s.inner = inner
+
+	return inner, nil
+}
+
+// disconnect drops the inner store after a failure, s.mu held
+func (s *Store) disconnect() {
+	if closer, ok := s.inner.(io.Closer); ok {
+		closer.Close()
+	}
+
+	s.inner = nil
+}
+
+func (s *Store) Put(id string, data []byte) error {
+	return s.PutBatch([]chunkstore.Object{{ID: id, Data: data}})
+}
+
+func (s *Store) PutBatch(objects []chunkstore.Object) error {
+	now := time.Now().Unix()
+
+	entries := []sqlitechunks.OutboxEntry{}
+	for _, object := range objects {
+		entries = append(entries, sqlitechunks.OutboxEntry{Op: opPut, Checksum: object.ID, Data: object.Data, QueuedAt: now})
+	}
+
+	return sqlitechunks.Enqueue(s.db, entries)
+}
+
+// Delete is queued behind earlier uploads
+func (s *Store) Delete(id string) error {
+	entry := sqlitechunks.OutboxEntry{Op: opDelete, Checksum: id, QueuedAt: time.Now().Unix()}
+
+	return sqlitechunks.Enqueue(s.db, []sqlitechunks.OutboxEntry{entry})
+}
+
+// queued returns the last change queued for id, if any
+func (s *Store) queued(id string) (*sqlitechunks.OutboxEntry, error) {
+	entry, err := sqlitechunks.LatestOutboxEntry(s.db, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func (s *Store) Get(id string) ([]byte, error) {
+	entry, err := s.queued(id)
+	if err != nil {
+		return nil, err
+	} else if entry != nil && entry.Op == opPut {
+		return entry.Data, nil
+	} else if entry != nil {
+		return nil, chunkstore.ErrNotFound
+	}
+
+	inner, err := s.Inner()
+	if err != nil {
+		return nil, err
+	}
+
+	return inner.Get(id)
+}
+
+func (s *Store) Has(id string) (bool, error) {
+	entry, err := s.queued(id)
+	if err != nil {
+		return false, err
+	} else if entry != nil {
+		return entry.Op == opPut, nil
+	}
+
+	inner, err := s.Inner()
+	if err != nil {
+		return false, err
+	}
+
+	return inner.Has(id)
+}
+
+func (s *Store) Missing(ids []string) ([]string, error) {
+	ops, err := sqlitechunks.LatestOutboxOps(s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	unknown := []string{}
+	for _, id := range ids {
+		switch ops[id] {
+		case opPut:
+		case opDelete:
+			missing = append(missing, id)
+		default:
+			unknown = append(unknown, id)
+		}
+	}
+
+	if len(unknown) == 0 {
+		return missing, nil
+	}
+
+	inner, err := s.Inner()
+	if err != nil {
+		return nil, err
+	}
+
+	innerMissing, err := chunkstore.Missing(inner, unknown)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(missing, innerMissing...), nil
+}
+
+// List includes queued uploads and leaves out queued deletes
+func (s *Store) List() ([]string, error) {
+	ops, err := sqlitechunks.LatestOutboxOps(s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	inner, err := s.Inner()
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := inner.List()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, id := range stored {
+		if _, ok := ops[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	for id, op := range ops {
+		if op == opPut {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (s *Store) Stat(id string) (chunkstore.ChunkInfo, error) {
+	entry, err := s.queued(id)
+	if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	} else if entry != nil && entry.Op == opPut {
+		return chunkstore.ChunkInfo{ID: id, Size: int64(len(entry.Data))}, nil
+	} else if entry != nil {
+		return chunkstore.ChunkInfo{}, chunkstore.ErrNotFound
+	}
+
+	inner, err := s.Inner()
+	if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	}
+
+	return inner.Stat(id)
+}
+
+// Flush is a no-op, queued changes are durable
+func (s *Store) Flush() error {
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if closer, ok := s.inner.(io.Closer); ok {
+		err = closer.Close()
+	}
+	s.inner = nil
+
+	return err
+}
+
+func (s *Store) backoff(attempts int) time.Duration {
+	wait := s.opt.MinBackoff
+	for i := 0; i < attempts && wait < s.opt.MaxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > s.opt.MaxBackoff {
+		wait = s.opt.MaxBackoff
+	}
+
+	return wait
+}
+
+// Drain applies queued changes until empty, backing off or failing
+func (s *Store) Drain() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	applied := 0
+
+	for {
+		entries, err := sqlitechunks.OutboxHead(s.db, s.opt.BatchSize)
+		if err != nil {
+			return applied, err
+		} else if len(entries) == 0 || entries[0].NextAttempt > time.Now().Unix() {
+			return applied, nil
+		}
+
+		head := entries[0]
+
+		if err := s.apply(entries); err != nil {
+			s.disconnect()
+
+			next := time.Now().Add(s.backoff(head.Attempts)).Unix()
+			if deferErr := sqlitechunks.DeferOutbox(s.db, head.Seq, next, err.Error()); deferErr != nil {
+				return applied, deferErr
+			}
+
+			return applied, fmt.Errorf("outbox: %w", err)
+		}
+
+		if head.Op == opDelete {
+			entries = entries[:1]
+		} else {
+			entries = leadingPuts(entries)
+		}
+
+		seqs := []int64{}
+		for _, entry := range entries {
+			seqs = append(seqs, entry.Seq)
+		}
+
+		if err := sqlitechunks.ConfirmOutbox(s.db, seqs); err != nil {
+			return applied, err
+		}
+		applied += len(seqs)
+	}
+}
+
+func leadingPuts(entries []sqlitechunks.OutboxEntry) []sqlitechunks.OutboxEntry {
+	for i, entry := range entries {
+		if entry.Op != opPut {
+			return entries[:i]
+		}
+	}
+
+	return entries
+}
+
+// apply sends a delete or a batch of uploads from the head, s.mu held
+func (s *Store) apply(entries []sqlitechunks.OutboxEntry) error {
+	inner, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	if entries[0].Op == opDelete {
+		// a store that refuses deletes for good keeps the chunk for pruning
+		err := inner.Delete(entries[0].Checksum)
+		if err == chunkstore.ErrNotFound || err == chunkstore.ErrAppendOnly {
+			return nil
+		}
+
+		return err
+	}
+
+	objects := []chunkstore.Object{}
+	for _, entry := range leadingPuts(entries) {
+		objects = append(objects, chunkstore.Object{ID: entry.Checksum, Data: entry.Data})
+	}
+
+	if err := chunkstore.PutBatch(inner, objects); err != nil {
+		return err
+	}
+
+	// only confirmed once the store has them for good
+	if flusher, ok := inner.(chunkstore.Flusher); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+// Run drains until stop is closed, reporting failures
+func (s *Store) Run(stop <-chan struct{}, report func(error)) {
+	for {
+		if _, err := s.Drain(); err != nil && report != nil {
+			report(err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(s.opt.Poll):
+		}
+	}
+}
+
+// Retry drops the backoff
+func (s *Store) Retry() error {
+	return sqlitechunks.RetryOutbox(s.db)
+}
+
+func (s *Store) Backlog() (sqlitechunks.OutboxBacklog, error) {
+	return sqlitechunks.GetOutboxBacklog(s.db)
+}
+
+// Find returns the outbox somewhere in a stack of wrapping stores, or nil
+func Find(store chunkstore.ChunkStore) *Store {
+	for {
+		if outbox, ok := store.(*Store); ok {
+			return outbox
+		}
+
+		wrapper, ok := store.(chunkstore.Wrapper)
+		if !ok {
+			return nil
+		}
+
+		store = wrapper.Unwrap()
+	}
+}
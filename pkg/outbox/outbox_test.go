@@ -0,0 +1,225 @@
+package outbox
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+var errOffline = errors.New("store is offline")
+
+// flakyStore fails while offline and records what it applied
+type flakyStore struct {
+	*chunkstore.MemoryStore
+	offline bool
+	applied []string
+}
+
+func (s *flakyStore) Put(id string, data []byte) error {
+	if s.offline {
+		return errOffline
+	}
+	s.applied = append(s.applied, "put "+id)
+
+	return s.MemoryStore.Put(id, data)
+}
+
+func (s *flakyStore) Delete(id string) error {
+	if s.offline {
+		return errOffline
+	}
+	s.applied = append(s.applied, "delete "+id)
+
+	return s.MemoryStore.Delete(id)
+}
+
+func (s *flakyStore) Has(id string) (bool, error) {
+	if s.offline {
+		return false, errOffline
+	}
+
+	return s.MemoryStore.Has(id)
+}
+
+func newOutbox(t *testing.T, inner *flakyStore) (*Store, *int) {
+	db, err := sqlitechunks.OpenDB(filepath.Join(t.TempDir(), "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	opt := Options{}
+	opt.SetDefaults()
+	opt.BatchSize = 2
+
+	opened := 0
+	store, err := NewStore(db, func() (chunkstore.ChunkStore, error) {
+		opened++
+		return inner, nil
+	}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, &opened
+}
+
+func TestQueuedChangesAreVisible(t *testing.T) {
+	inner := &flakyStore{MemoryStore: chunkstore.NewMemoryStore(), offline: true}
+	inner.MemoryStore.Put("c3", []byte("stored"))
+	store, opened := newOutbox(t, inner)
+
+	if err := store.Put("a1", []byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("c3"); err != nil {
+		t.Fatal(err)
+	}
+	if *opened != 0 {
+		t.Fatal("queuing opened the store")
+	}
+
+	if data, err := store.Get("a1"); err != nil || string(data) != "queued" {
+		t.Fatalf("get of a queued upload returned %q, %v", data, err)
+	}
+	if ok, err := store.Has("c3"); err != nil || ok {
+		t.Fatalf("a chunk queued for deletion is still there: %v, %v", ok, err)
+	}
+	if info, err := store.Stat("a1"); err != nil || info.Size != 6 {
+		t.Fatalf("stat of a queued upload returned %+v, %v", info, err)
+	}
+
+	missing, err := store.Missing([]string{"a1", "c3"})
+	if err != nil || len(missing) != 1 || missing[0] != "c3" {
+		t.Fatalf("missing returned %v, %v", missing, err)
+	}
+
+	backlog, err := store.Backlog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backlog.Puts != 1 || backlog.Deletes != 1 || backlog.Bytes != 6 {
+		t.Fatalf("backlog is %+v", backlog)
+	}
+}
+
+func TestDrainKeepsOrder(t *testing.T) {
+	inner := &flakyStore{MemoryStore: chunkstore.NewMemoryStore()}
+	store, _ := newOutbox(t, inner)
+
+	for _, id := range []string{"a1", "b2", "c3"} {
+		if err := store.Put(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("d4", []byte("d4")); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := store.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 5 {
+		t.Fatalf("drain applied %d changes, want 5", applied)
+	}
+
+	want := []string{"put a1", "put b2", "put c3", "delete a1", "put d4"}
+	if len(inner.applied) != len(want) {
+		t.Fatalf("store saw %v, want %v", inner.applied, want)
+	}
+	for i := range want {
+		if inner.applied[i] != want[i] {
+			t.Fatalf("store saw %v, want %v", inner.applied, want)
+		}
+	}
+
+	backlog, err := store.Backlog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backlog.Puts+backlog.Deletes != 0 {
+		t.Fatalf("drained outbox still holds %+v", backlog)
+	}
+}
+
+func TestFailedDrainBacksOff(t *testing.T) {
+	inner := &flakyStore{MemoryStore: chunkstore.NewMemoryStore(), offline: true}
+	store, opened := newOutbox(t, inner)
+
+	if err := store.Put("a1", []byte("a1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Drain(); !errors.Is(err, errOffline) {
+		t.Fatalf("drain against an offline store returned %v", err)
+	}
+
+	backlog, err := store.Backlog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backlog.Attempts != 1 || backlog.LastError != errOffline.Error() || backlog.NextAttempt <= time.Now().Unix() {
+		t.Fatalf("failed attempt left %+v", backlog)
+	}
+
+	// waiting out the backoff, nothing is tried
+	inner.offline = false
+	if applied, err := store.Drain(); err != nil || applied != 0 {
+		t.Fatalf("drain during the backoff applied %d, %v", applied, err)
+	}
+	if len(inner.applied) != 0 {
+		t.Fatal("drain during the backoff reached the store")
+	}
+
+	if err := store.Retry(); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := store.Drain(); err != nil || applied != 1 {
+		t.Fatalf("drain after retry applied %d, %v", applied, err)
+	}
+	if ok, _ := inner.MemoryStore.Has("a1"); !ok {
+		t.Fatal("chunk did not arrive")
+	}
+
+	// the failed store was dropped and opened again
+	if *opened != 2 {
+		t.Fatalf("store was opened %d times, want 2", *opened)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	store := &Store{opt: Options{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+
+	for attempts, want := range map[int]time.Duration{
+		0:  time.Second,
+		1:  2 * time.Second,
+		3:  8 * time.Second,
+		4:  10 * time.Second,
+		50: 10 * time.Second,
+	} {
+		if got := store.backoff(attempts); got != want {
+			t.Errorf("backoff after %d attempts is %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestDeleteOfMissingChunkIsConfirmed(t *testing.T) {
+	inner := &flakyStore{MemoryStore: chunkstore.NewMemoryStore()}
+	store, _ := newOutbox(t, inner)
+
+	if err := store.Delete("e5"); err != nil {
+		t.Fatal(err)
+	}
+
+	if applied, err := store.Drain(); err != nil || applied != 1 {
+		t.Fatalf("drain applied %d, %v", applied, err)
+	}
+}
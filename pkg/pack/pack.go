@@ -0,0 +1,169 @@
+package pack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// chunk data, JSON index, big-endian index length, magic
+const magic = "FCPK"
+
+const trailerSize = 4 + len(magic)
+
+const DefaultTargetSize = 32 << 20
+
+var ErrInvalidPack = errors.New("invalid pack file")
+
+// Entry is a chunk stored in a pack
+type Entry struct {
+	ID     string
+	Offset int64
+	Length int64
+}
+
+// Packer appends chunks into an in-memory pack until it reaches the target size
+type Packer struct {
+	target  int64
+	buf     bytes.Buffer
+	entries []Entry
+	index   map[string]int
+}
+
+func NewPacker(target int64) *Packer {
+	if target <= 0 {
+		target = DefaultTargetSize
+	}
+
+	packer := &Packer{
+		target:  target,
+		entries: []Entry{},
+		index:   map[string]int{},
+	}
+	return packer
+}
+
+func (p *Packer) Add(id string, data []byte) {
+	if _, ok := p.index[id]; ok {
+		return
+	}
+
+	p.index[id] = len(p.entries)
+	p.entries = append(p.entries, Entry{
+		ID:     id,
+		Offset: int64(p.buf.Len()),
+		Length: int64(len(data)),
+	})
+	p.buf.Write(data)
+}
+
+// Remove forgets a pending chunk, its bytes are left as a dead region
+func (p *Packer) Remove(id string) bool {
+	i, ok := p.index[id]
+	if !ok {
+		return false
+	}
+
+	p.entries = append(p.entries[:i], p.entries[i+1:]...)
+	delete(p.index, id)
+	for j := i; j < len(p.entries); j++ {
+		p.index[p.entries[j].ID] = j
+	}
+
+	return true
+}
+
+func (p *Packer) Lookup(id string) ([]byte, bool) {
+	i, ok := p.index[id]
+	if !ok {
+		return nil, false
+	}
+
+	entry := p.entries[i]
+	data := p.buf.Bytes()[entry.Offset : entry.Offset+entry.Length]
+
+	return append([]byte(nil), data...), true
+}
+
+func (p *Packer) IDs() []string {
+	ids := []string{}
+	for _, entry := range p.entries {
+		ids = append(ids, entry.ID)
+	}
+
+	return ids
+}
+
+func (p *Packer) Len() int {
+	return len(p.entries)
+}
+
+func (p *Packer) Size() int64 {
+	return int64(p.buf.Len())
+}
+
+func (p *Packer) Full() bool {
+	return int64(p.buf.Len()) >= p.target
+}
+
+// Finish seals a pack named by its SHA-256 and resets the packer
+func (p *Packer) Finish() (string, []byte, []Entry, error) {
+	indexJSON, err := json.Marshal(p.entries)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	data := make([]byte, 0, p.buf.Len()+len(indexJSON)+trailerSize)
+	data = append(data, p.buf.Bytes()...)
+	data = append(data, indexJSON...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(indexJSON)))
+	data = append(data, magic...)
+
+	entries := p.entries
+
+	p.buf.Reset()
+	p.entries = []Entry{}
+	p.index = map[string]int{}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data)), data, entries, nil
+}
+
+// ParseTrailer returns the length of the index preceding the trailer
+func ParseTrailer(trailer []byte) (int64, error) {
+	if len(trailer) != trailerSize || string(trailer[4:]) != magic {
+		return 0, ErrInvalidPack
+	}
+
+	return int64(binary.BigEndian.Uint32(trailer[:4])), nil
+}
+
+func ParseIndex(indexJSON []byte) ([]Entry, error) {
+	entries := []Entry{}
+	if err := json.Unmarshal(indexJSON, &entries); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPack, err)
+	}
+
+	return entries, nil
+}
+
+// ReadIndex parses the index at the end of a complete pack file
+func ReadIndex(data []byte) ([]Entry, error) {
+	if len(data) < trailerSize {
+		return nil, ErrInvalidPack
+	}
+
+	length, err := ParseTrailer(data[len(data)-trailerSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	end := int64(len(data) - trailerSize)
+	if length > end {
+		return nil, ErrInvalidPack
+	}
+
+	return ParseIndex(data[end-length : end])
+}
@@ -0,0 +1,291 @@
+package pack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"fastcdc-backup/pkg/sqlite-chunks"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// parity shards, JSON header, big-endian header length, magic
+const parityMagic = "FCPR"
+
+// parity objects sit next to their pack in the same store
+const paritySuffix = ".parity"
+
+var ErrUnrecoverable = errors.New("pack is damaged beyond what its parity can repair")
+
+// ParityOptions gives every DataShards shards of ShardSize bytes ParityShards parity shards
+type ParityOptions struct {
+	DataShards   int
+	ParityShards int
+	ShardSize    int64
+}
+
+func (o *ParityOptions) SetDefaults() {
+	o.DataShards = 10
+	o.ParityShards = 2
+	o.ShardSize = 64 << 10
+}
+
+func (o ParityOptions) Validate() error {
+	if o.DataShards < 1 || o.ParityShards < 1 || o.DataShards+o.ParityShards > 256 {
+		return fmt.Errorf("invalid shard counts %d+%d", o.DataShards, o.ParityShards)
+	} else if o.ShardSize < 1 {
+		return fmt.Errorf("invalid shard size %d", o.ShardSize)
+	}
+
+	return nil
+}
+
+// Parity describes the parity object of one pack
+type Parity struct {
+	Size         int64
+	ShardSize    int64
+	DataShards   int
+	ParityShards int
+	Hashes       []byte
+}
+
+func (p *Parity) shards() int64 {
+	return (p.Size + p.ShardSize - 1) / p.ShardSize
+}
+
+func (p *Parity) stripes() int64 {
+	return (p.shards() + int64(p.DataShards) - 1) / int64(p.DataShards)
+}
+
+func (p *Parity) hash(shard int64) []byte {
+	return p.Hashes[shard*sha256.Size : (shard+1)*sha256.Size]
+}
+
+func (p *Parity) parityHash(stripe int64, i int) []byte {
+	return p.hash(p.shards() + stripe*int64(p.ParityShards) + int64(i))
+}
+
+// stripeRange is where the data of a stripe sits in the pack
+func (p *Parity) stripeRange(stripe int64) (int64, int64) {
+	start := stripe * int64(p.DataShards) * p.ShardSize
+	end := start + int64(p.DataShards)*p.ShardSize
+	if end > p.Size {
+		end = p.Size
+	}
+
+	return start, end
+}
+
+func (p *Parity) row(packID string) sqlitechunks.Parity {
+	return sqlitechunks.Parity{
+		PackID:       packID,
+		Size:         p.Size,
+		ShardSize:    p.ShardSize,
+		DataShards:   p.DataShards,
+		ParityShards: p.ParityShards,
+		Hashes:       p.Hashes,
+	}
+}
+
+func parityFromRow(row sqlitechunks.Parity) *Parity {
+	parity := &Parity{
+		Size:         row.Size,
+		ShardSize:    row.ShardSize,
+		DataShards:   row.DataShards,
+		ParityShards: row.ParityShards,
+		Hashes:       row.Hashes,
+	}
+	return parity
+}
+
+// checkData returns the damaged shards of data starting at shard first
+func (p *Parity) checkData(data []byte, first int64) []int64 {
+	bad := []int64{}
+
+	for i := int64(0); i*p.ShardSize < int64(len(data)); i++ {
+		end := (i + 1) * p.ShardSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		sum := sha256.Sum256(data[i*p.ShardSize : end])
+		if !bytes.Equal(sum[:], p.hash(first+i)) {
+			bad = append(bad, first+i)
+		}
+	}
+
+	return bad
+}
+
+// NewParity computes the parity object for a pack
+func NewParity(data []byte, opt ParityOptions) (*Parity, []byte, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	enc, err := reedsolomon.New(opt.DataShards, opt.ParityShards)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parity := &Parity{
+		Size:         int64(len(data)),
+		ShardSize:    opt.ShardSize,
+		DataShards:   opt.DataShards,
+		ParityShards: opt.ParityShards,
+	}
+
+	hashes := []byte{}
+	for start := int64(0); start < parity.Size; start += parity.ShardSize {
+		end := start + parity.ShardSize
+		if end > parity.Size {
+			end = parity.Size
+		}
+
+		sum := sha256.Sum256(data[start:end])
+		hashes = append(hashes, sum[:]...)
+	}
+
+	obj := []byte{}
+	for stripe := int64(0); stripe < parity.stripes(); stripe++ {
+		start, end := parity.stripeRange(stripe)
+
+		shards := parity.split(data[start:end])
+		if err := enc.Encode(shards); err != nil {
+			return nil, nil, err
+		}
+
+		for _, shard := range shards[opt.DataShards:] {
+			sum := sha256.Sum256(shard)
+			hashes = append(hashes, sum[:]...)
+			obj = append(obj, shard...)
+		}
+	}
+	parity.Hashes = hashes
+
+	header, err := json.Marshal(parity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj = append(obj, header...)
+	obj = binary.BigEndian.AppendUint32(obj, uint32(len(header)))
+	obj = append(obj, parityMagic...)
+
+	return parity, obj, nil
+}
+
+// split pads a stripe into data shards and empty parity shards
+func (p *Parity) split(data []byte) [][]byte {
+	shards := make([][]byte, p.DataShards+p.ParityShards)
+
+	for i := range shards {
+		shards[i] = make([]byte, p.ShardSize)
+
+		start := int64(i) * p.ShardSize
+		if i < p.DataShards && start < int64(len(data)) {
+			copy(shards[i], data[start:])
+		}
+	}
+
+	return shards
+}
+
+// ReadParity parses the header at the end of a complete parity object
+func ReadParity(obj []byte) (*Parity, error) {
+	if len(obj) < trailerSize || string(obj[len(obj)-len(parityMagic):]) != parityMagic {
+		return nil, ErrInvalidPack
+	}
+
+	end := int64(len(obj) - trailerSize)
+	length := int64(binary.BigEndian.Uint32(obj[end : end+4]))
+	if length > end {
+		return nil, ErrInvalidPack
+	}
+
+	parity := &Parity{}
+	if err := json.Unmarshal(obj[end-length:end], parity); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPack, err)
+	}
+
+	return parity, nil
+}
+
+// reconstruct rebuilds a stripe from its intact shards, returning how many were damaged
+func (p *Parity) reconstruct(stripe int64, data []byte, parityData []byte) ([][]byte, int, error) {
+	enc, err := reedsolomon.New(p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start, end := p.stripeRange(stripe)
+	first := start / p.ShardSize
+	count := (end - start + p.ShardSize - 1) / p.ShardSize
+
+	shards := make([][]byte, p.DataShards+p.ParityShards)
+	damaged := 0
+
+	for i := 0; i < p.DataShards; i++ {
+		if int64(i) >= count { // padding past the end of the pack
+			shards[i] = make([]byte, p.ShardSize)
+			continue
+		}
+
+		lo, hi := int64(i)*p.ShardSize, int64(i+1)*p.ShardSize
+		if hi > end-start {
+			hi = end - start
+		}
+
+		if hi <= int64(len(data)) {
+			sum := sha256.Sum256(data[lo:hi])
+			if bytes.Equal(sum[:], p.hash(first+int64(i))) {
+				shards[i] = make([]byte, p.ShardSize)
+				copy(shards[i], data[lo:hi])
+				continue
+			}
+		}
+
+		damaged++
+	}
+
+	for i := 0; i < p.ParityShards; i++ {
+		lo, hi := int64(i)*p.ShardSize, int64(i+1)*p.ShardSize
+
+		if hi <= int64(len(parityData)) {
+			sum := sha256.Sum256(parityData[lo:hi])
+			if bytes.Equal(sum[:], p.parityHash(stripe, i)) {
+				shards[p.DataShards+i] = parityData[lo:hi]
+				continue
+			}
+		}
+
+		damaged++
+	}
+
+	if damaged == 0 {
+		return shards, 0, nil
+	}
+
+	if err := enc.Reconstruct(shards); err != nil {
+		return nil, damaged, ErrUnrecoverable
+	}
+
+	// every shard used was verified, but check the result anyway
+	for i := int64(0); i < count; i++ {
+		lo, hi := i*p.ShardSize, (i+1)*p.ShardSize
+		if hi > end-start {
+			hi = end - start
+		}
+
+		sum := sha256.Sum256(shards[i][:hi-lo])
+		if !bytes.Equal(sum[:], p.hash(first+i)) {
+			return nil, damaged, ErrUnrecoverable
+		}
+	}
+
+	return shards, damaged, nil
+}
@@ -0,0 +1,294 @@
+package pack
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+var testParity = ParityOptions{DataShards: 4, ParityShards: 2, ShardSize: 16}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestParityReconstruct(t *testing.T) {
+	data := randomData(150)
+
+	parity, obj, err := NewParity(data, testParity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ReadParity(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Size != 150 || !bytes.Equal(header.Hashes, parity.Hashes) {
+		t.Fatal("parity header does not match the parity returned")
+	}
+
+	// the second stripe runs past the end of the data
+	for stripe := int64(0); stripe < parity.stripes(); stripe++ {
+		start, end := parity.stripeRange(stripe)
+		parityLength := int64(parity.ParityShards) * parity.ShardSize
+		parityData := obj[stripe*parityLength : (stripe+1)*parityLength]
+
+		damaged := append([]byte(nil), data[start:end]...)
+		damaged[0] ^= 0xff
+		damaged[len(damaged)-1] ^= 0xff
+
+		shards, n, err := parity.reconstruct(stripe, damaged, parityData)
+		if err != nil {
+			t.Fatalf("stripe %d: %v", stripe, err)
+		}
+		if n != 2 {
+			t.Fatalf("stripe %d: %d shards damaged, want 2", stripe, n)
+		}
+		if !bytes.Equal(joinShards(parity, stripe, shards), data[start:end]) {
+			t.Fatalf("stripe %d was not rebuilt", stripe)
+		}
+	}
+}
+
+func TestParityUnrecoverable(t *testing.T) {
+	data := randomData(64)
+
+	parity, obj, err := NewParity(data, testParity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damaged := append([]byte(nil), data...)
+	for i := int64(0); i < 3; i++ {
+		damaged[i*parity.ShardSize] ^= 0xff
+	}
+
+	if _, _, err := parity.reconstruct(0, damaged, obj[:2*parity.ShardSize]); err != ErrUnrecoverable {
+		t.Fatalf("three damaged shards returned %v, want ErrUnrecoverable", err)
+	}
+
+	// a missing read leaves every data shard to be rebuilt
+	if _, _, err := parity.reconstruct(0, nil, obj[:2*parity.ShardSize]); err != ErrUnrecoverable {
+		t.Fatalf("a missing stripe returned %v, want ErrUnrecoverable", err)
+	}
+}
+
+func TestParityValidate(t *testing.T) {
+	for _, opt := range []ParityOptions{
+		{DataShards: 0, ParityShards: 2, ShardSize: 16},
+		{DataShards: 4, ParityShards: 0, ShardSize: 16},
+		{DataShards: 200, ParityShards: 100, ShardSize: 16},
+		{DataShards: 4, ParityShards: 2, ShardSize: 0},
+	} {
+		if opt.Validate() == nil {
+			t.Fatalf("%+v passed validation", opt)
+		}
+	}
+
+	if _, err := ReadParity([]byte("not a parity object")); err != ErrInvalidPack {
+		t.Fatalf("reading garbage returned %v, want ErrInvalidPack", err)
+	}
+}
+
+func newStore(t *testing.T) (*Store, *chunkstore.MemoryStore) {
+	db, err := sqlitechunks.OpenDB(filepath.Join(t.TempDir(), "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	packs := chunkstore.NewMemoryStore()
+
+	store, err := NewStore(packs, db, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnableParity(testParity); err != nil {
+		t.Fatal(err)
+	}
+
+	return store, packs
+}
+
+// writeChunks stores one pack, returning its chunks and ID
+func writeChunks(t *testing.T, store *Store, packs chunkstore.ChunkStore) (map[string][]byte, string) {
+	chunks := map[string][]byte{}
+	for i, id := range []string{"a1", "b2", "c3", "d4"} {
+		chunks[id] = randomData(40 + i*30)
+
+		if err := store.Put(id, chunks[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := packs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if !strings.HasSuffix(id, paritySuffix) {
+			return chunks, id
+		}
+	}
+
+	t.Fatal("no pack was written")
+	return nil, ""
+}
+
+func damage(t *testing.T, packs chunkstore.ChunkStore, id string, offsets ...int) {
+	data, err := packs.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range offsets {
+		data[offset] ^= 0xff
+	}
+
+	if err := packs.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := packs.Put(id, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkChunks(t *testing.T, store *Store, chunks map[string][]byte) {
+	for id, want := range chunks {
+		data, err := store.Get(id)
+		if err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Fatalf("%s was read back wrong", id)
+		}
+	}
+}
+
+func TestReadRebuildsDamagedPack(t *testing.T) {
+	store, packs := newStore(t)
+	chunks, packID := writeChunks(t, store, packs)
+
+	damage(t, packs, packID, 0, 70, 100)
+	checkChunks(t, store, chunks)
+
+	data, err := store.readPack(packID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadIndex(data); err != nil {
+		t.Fatalf("rebuilt pack has no index: %v", err)
+	}
+}
+
+func TestScrubRepairs(t *testing.T) {
+	store, packs := newStore(t)
+	chunks, packID := writeChunks(t, store, packs)
+	original, _ := packs.Get(packID)
+
+	damage(t, packs, packID, 5, 20)
+	damage(t, packs, packID+paritySuffix, 32)
+
+	damages, err := store.Scrub(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damages) != 1 || damages[0].PackID != packID || damages[0].Shards != 3 || damages[0].Repaired {
+		t.Fatalf("scrub without repair found %+v", damages)
+	}
+
+	damages, err = store.Scrub(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damages) != 1 || !damages[0].Repaired {
+		t.Fatalf("scrub with repair found %+v", damages)
+	}
+
+	repaired, _ := packs.Get(packID)
+	if !bytes.Equal(repaired, original) {
+		t.Fatal("pack was not repaired")
+	}
+	if ok, _ := packs.Has(packID + chunkstore.RepairSuffix); ok {
+		t.Fatal("repair left its backup behind")
+	}
+
+	damages, err = store.Scrub(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damages) != 0 {
+		t.Fatalf("repaired pack still has damage %+v", damages)
+	}
+	checkChunks(t, store, chunks)
+}
+
+func TestScrubUnrecoverable(t *testing.T) {
+	store, packs := newStore(t)
+	_, packID := writeChunks(t, store, packs)
+
+	damage(t, packs, packID, 0, 16, 32)
+
+	damages, err := store.Scrub(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damages) != 1 || damages[0].Repaired || damages[0].Err == "" {
+		t.Fatalf("scrub of an unrecoverable pack found %+v", damages)
+	}
+}
+
+func TestScrubFinishesInterruptedRepair(t *testing.T) {
+	store, packs := newStore(t)
+	chunks, packID := writeChunks(t, store, packs)
+	original, _ := packs.Get(packID)
+	backup := packID + chunkstore.RepairSuffix
+
+	// interrupted after deleting the damaged pack
+	if err := packs.Put(backup, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := packs.Delete(packID); err != nil {
+		t.Fatal(err)
+	}
+
+	damages, err := store.Scrub(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(damages) != 0 {
+		t.Fatalf("scrub found %+v", damages)
+	}
+	if ok, _ := packs.Has(backup); ok {
+		t.Fatal("backup was left behind")
+	}
+	checkChunks(t, store, chunks)
+
+	// interrupted before deleting the backup of the new parity object
+	parityObj, _ := packs.Get(packID + paritySuffix)
+	if err := packs.Put(packID+paritySuffix+chunkstore.RepairSuffix, parityObj); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Scrub(false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := packs.Has(packID + paritySuffix + chunkstore.RepairSuffix); ok {
+		t.Fatal("parity backup was left behind")
+	}
+	if ok, _ := packs.Has(packID + paritySuffix); !ok {
+		t.Fatal("parity object was deleted")
+	}
+}
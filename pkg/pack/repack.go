@@ -0,0 +1,167 @@
+package pack
+
+import (
+	"sort"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+type RepackOptions struct {
+	// packs with a larger share of dead bytes are rewritten
+	Threshold float64
+	// limits on how much work a single run does, 0 means no limit
+	MaxBytes int64
+	MaxPacks int
+}
+
+func (opt *RepackOptions) SetDefaults() {
+	opt.Threshold = 0.3
+	opt.MaxBytes = 1 << 30
+	opt.MaxPacks = 0
+}
+
+type RepackResult struct {
+	Packs     int
+	Rewritten int64
+	Reclaimed int64
+}
+
+// Repack rewrites the live chunks of mostly dead packs
+func (s *Store) Repack(opt RepackOptions) (RepackResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := RepackResult{}
+
+	if err := s.flush(); err != nil {
+		return result, err
+	}
+
+	usage, err := sqlitechunks.ListPackUsage(s.db)
+	if err != nil {
+		return result, err
+	}
+
+	candidates := []sqlitechunks.PackUsage{}
+	for _, u := range usage {
+		if u.DeadFraction() > opt.Threshold {
+			candidates = append(candidates, u)
+		}
+	}
+
+	// most wasteful first
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].DeadFraction() > candidates[j].DeadFraction()
+	})
+
+	selected := []sqlitechunks.PackUsage{}
+	rewrite := int64(0)
+
+	for _, u := range candidates {
+		if opt.MaxPacks > 0 && len(selected) == opt.MaxPacks {
+			break
+		}
+		if opt.MaxBytes > 0 && rewrite+u.Live > opt.MaxBytes {
+			continue
+		}
+
+		selected = append(selected, u)
+		rewrite += u.Live
+	}
+
+	packer := NewPacker(s.packer.target)
+	written := map[string]bool{}
+
+	for _, u := range selected {
+		locations, err := sqlitechunks.ListPackEntries(s.db, u.PackID)
+		if err != nil {
+			return result, err
+		}
+
+		if len(locations) > 0 {
+			data, err := s.readPack(u.PackID)
+			if err != nil {
+				return result, err
+			}
+
+			for _, location := range locations {
+				packer.Add(location.Checksum, data[location.Offset:location.Offset+location.Length])
+
+				if packer.Full() {
+					packID, err := s.writePack(packer)
+					if err != nil {
+						return result, err
+					}
+					written[packID] = true
+				}
+			}
+		}
+
+		result.Rewritten += u.Live
+	}
+
+	packID, err := s.writePack(packer)
+	if err != nil {
+		return result, err
+	}
+	written[packID] = true
+
+	// every live chunk now points at a new pack
+	for _, u := range selected {
+		if written[u.PackID] { // rewritten into an identical pack
+			continue
+		}
+
+		if err := sqlitechunks.DeletePack(s.db, u.PackID); err != nil {
+			return result, err
+		}
+
+		if err := s.packs.Delete(u.PackID); err != nil {
+			return result, err
+		}
+
+		if err := s.packs.Delete(u.PackID + paritySuffix); err != nil && err != chunkstore.ErrNotFound {
+			return result, err
+		}
+
+		result.Packs++
+		result.Reclaimed += u.Size - u.Live
+	}
+
+	return result, nil
+}
+
+// writePack stores a pack and moves its locations in one transaction
+func (s *Store) writePack(packer *Packer) (string, error) {
+	if packer.Len() == 0 {
+		return "", nil
+	}
+
+	packID, data, entries, err := packer.Finish()
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.packs.Put(packID, data); err != nil {
+		return "", err
+	}
+
+	if s.parity != nil {
+		if err := s.writeParity(packID, data); err != nil {
+			return "", err
+		}
+	}
+
+	locations := []sqlitechunks.Location{}
+	for _, entry := range entries {
+		locations = append(locations, sqlitechunks.Location{
+			Checksum: entry.ID,
+			PackID:   packID,
+			Offset:   entry.Offset,
+			Length:   entry.Length,
+		})
+	}
+
+	return packID, sqlitechunks.AddPack(s.db, packID, int64(len(data)), locations)
+}
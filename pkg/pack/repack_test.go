@@ -0,0 +1,134 @@
+package pack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// writePack flushes four chunks into their own pack and deletes all but the first
+func writePack(t *testing.T, store *Store, packs chunkstore.ChunkStore, n int) (string, map[string][]byte) {
+	before, err := packs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := map[string]bool{}
+	for _, id := range before {
+		known[id] = true
+	}
+
+	live := map[string][]byte{}
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("p%dc%d", n, i)
+		data := randomData(100 + n*4 + i)
+
+		if err := store.Put(id, data); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			live[id] = data
+		}
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < 4; i++ {
+		if err := store.Delete(fmt.Sprintf("p%dc%d", n, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := packs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range after {
+		if !known[id] && !strings.HasSuffix(id, paritySuffix) {
+			return id, live
+		}
+	}
+
+	t.Fatal("no pack was written")
+	return "", nil
+}
+
+func TestRepack(t *testing.T) {
+	store, packs := newStore(t)
+
+	packIDs := []string{}
+	live := map[string][]byte{}
+	for n := 0; n < 3; n++ {
+		packID, chunks := writePack(t, store, packs, n)
+		packIDs = append(packIDs, packID)
+		for id, data := range chunks {
+			live[id] = data
+		}
+	}
+
+	opt := RepackOptions{}
+	opt.SetDefaults()
+	opt.MaxPacks = 2
+
+	result, err := store.Repack(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Packs != 2 {
+		t.Fatalf("rewrote %d packs, want MaxPacks 2", result.Packs)
+	}
+	if result.Rewritten <= 0 || result.Reclaimed <= 0 {
+		t.Fatalf("result %+v has nothing rewritten or reclaimed", result)
+	}
+
+	remaining := 0
+	for _, packID := range packIDs {
+		ok, err := packs.Has(packID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasParity, err := packs.Has(packID + paritySuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != hasParity {
+			t.Fatalf("pack %s was removed without its parity", packID)
+		}
+		if ok {
+			remaining++
+		}
+	}
+	if remaining != 1 {
+		t.Fatalf("%d of the old packs remain, want 1", remaining)
+	}
+
+	checkChunks(t, store, live)
+	if _, err := store.Get("p0c1"); err != chunkstore.ErrNotFound {
+		t.Fatalf("reading a deleted chunk returned %v, want ErrNotFound", err)
+	}
+
+	// the last pack's live chunk is over the byte limit
+	opt.MaxPacks = 0
+	opt.MaxBytes = 50
+
+	result, err = store.Repack(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Packs != 0 {
+		t.Fatalf("rewrote %d packs past MaxBytes", result.Packs)
+	}
+
+	opt.MaxBytes = 0
+
+	result, err = store.Repack(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Packs != 1 {
+		t.Fatalf("rewrote %d packs, want the last one", result.Packs)
+	}
+	checkChunks(t, store, live)
+}
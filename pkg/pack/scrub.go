@@ -0,0 +1,284 @@
+package pack
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+// EnableParity adds parity to packs written from now on
+func (s *Store) EnableParity(opt ParityOptions) error {
+	if err := opt.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.parity = &opt
+
+	return nil
+}
+
+func (s *Store) writeParity(packID string, data []byte) error {
+	parity, obj, err := NewParity(data, *s.parity)
+	if err != nil {
+		return err
+	}
+
+	if err := s.packs.Put(packID+paritySuffix, obj); err != nil {
+		return err
+	}
+
+	return sqlitechunks.AddParity(s.db, parity.row(packID))
+}
+
+func (s *Store) loadParity(packID string) (*Parity, error) {
+	row, err := sqlitechunks.GetParity(s.db, packID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return parityFromRow(row), nil
+}
+
+// readRange checks the shards it reads, rebuilding damaged ones
+func (s *Store) readRange(packID string, offset, length int64) ([]byte, error) {
+	parity, err := s.loadParity(packID)
+	if err != nil {
+		return nil, err
+	} else if parity == nil || length == 0 {
+		return chunkstore.GetRange(s.packs, packID, offset, length)
+	}
+
+	if offset < 0 || length < 0 || offset+length > parity.Size {
+		return nil, fmt.Errorf("range [%d, %d) is out of bounds for %s", offset, offset+length, packID)
+	}
+
+	first, last := offset/parity.ShardSize, (offset+length-1)/parity.ShardSize
+	start, end := first*parity.ShardSize, (last+1)*parity.ShardSize
+	if end > parity.Size {
+		end = parity.Size
+	}
+
+	data, err := chunkstore.GetRange(s.packs, packID, start, end-start)
+	if err == nil && len(parity.checkData(data, first)) == 0 {
+		return data[offset-start : offset-start+length], nil
+	}
+
+	// rebuild every stripe the range falls into
+	firstStripe, lastStripe := first/int64(parity.DataShards), last/int64(parity.DataShards)
+	stripeStart, _ := parity.stripeRange(firstStripe)
+
+	rebuilt := []byte{}
+	for stripe := firstStripe; stripe <= lastStripe; stripe++ {
+		shards, _, err := s.readStripe(packID, parity, stripe)
+		if err != nil {
+			return nil, err
+		}
+
+		rebuilt = append(rebuilt, joinShards(parity, stripe, shards)...)
+	}
+
+	return rebuilt[offset-stripeStart : offset-stripeStart+length], nil
+}
+
+func (s *Store) readStripe(packID string, parity *Parity, stripe int64) ([][]byte, int, error) {
+	start, end := parity.stripeRange(stripe)
+	parityLength := int64(parity.ParityShards) * parity.ShardSize
+
+	// a failed read leaves those shards to be rebuilt from the others
+	data, _ := chunkstore.GetRange(s.packs, packID, start, end-start)
+	parityData, _ := chunkstore.GetRange(s.packs, packID+paritySuffix, stripe*parityLength, parityLength)
+
+	return parity.reconstruct(stripe, data, parityData)
+}
+
+// joinShards returns the pack bytes held by the data shards of a stripe
+func joinShards(parity *Parity, stripe int64, shards [][]byte) []byte {
+	start, end := parity.stripeRange(stripe)
+
+	data := []byte{}
+	for _, shard := range shards[:parity.DataShards] {
+		data = append(data, shard...)
+	}
+
+	return data[:end-start]
+}
+
+// readPack returns a whole pack, rebuilt from parity where it is damaged
+func (s *Store) readPack(packID string) ([]byte, error) {
+	parity, err := s.loadParity(packID)
+	if err != nil {
+		return nil, err
+	} else if parity == nil {
+		return s.packs.Get(packID)
+	}
+
+	data, err := s.packs.Get(packID)
+	if err == nil && int64(len(data)) == parity.Size && len(parity.checkData(data, 0)) == 0 {
+		return data, nil
+	}
+
+	data, _, err = s.rebuildPack(packID, parity)
+
+	return data, err
+}
+
+// rebuildPack returns the repaired pack and how many shards were damaged
+func (s *Store) rebuildPack(packID string, parity *Parity) ([]byte, int, error) {
+	data := []byte{}
+	damaged := 0
+
+	for stripe := int64(0); stripe < parity.stripes(); stripe++ {
+		shards, n, err := s.readStripe(packID, parity, stripe)
+		if err != nil {
+			return nil, damaged + n, fmt.Errorf("%s: %w", packID, err)
+		}
+		damaged += n
+
+		data = append(data, joinShards(parity, stripe, shards)...)
+	}
+
+	return data, damaged, nil
+}
+
+// Damage is a pack found damaged while scrubbing
+type Damage struct {
+	PackID   string
+	Shards   int
+	Repaired bool
+	Err      string `json:",omitempty"`
+}
+
+// Scrub verifies every pack and its parity, rewriting damaged ones with repair
+func (s *Store) Scrub(repair bool) ([]Damage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage, err := sqlitechunks.ListPackUsage(s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	damages := []Damage{}
+
+	for _, u := range usage {
+		parity, err := s.loadParity(u.PackID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.recover(u.PackID); err != nil {
+			return nil, err
+		} else if parity != nil {
+			if err := s.recover(u.PackID + paritySuffix); err != nil {
+				return nil, err
+			}
+		}
+
+		if parity == nil {
+			data, err := s.packs.Get(u.PackID)
+			if err != nil {
+				damages = append(damages, Damage{PackID: u.PackID, Err: err.Error()})
+			} else if fmt.Sprintf("%x", sha256.Sum256(data)) != u.PackID {
+				damages = append(damages, Damage{PackID: u.PackID, Err: "pack has no parity to repair it from"})
+			}
+			continue
+		}
+
+		data, damaged, err := s.rebuildPack(u.PackID, parity)
+		if err != nil {
+			damages = append(damages, Damage{PackID: u.PackID, Shards: damaged, Err: err.Error()})
+			continue
+		} else if damaged == 0 {
+			continue
+		}
+
+		damage := Damage{PackID: u.PackID, Shards: damaged}
+
+		if repair {
+			if err := s.repair(u.PackID, parity, data); err != nil {
+				return nil, err
+			}
+			damage.Repaired = true
+		}
+
+		damages = append(damages, damage)
+	}
+
+	return damages, nil
+}
+
+// repair rewrites the pack or parity object that no longer matches
+func (s *Store) repair(packID string, parity *Parity, data []byte) error {
+	current, err := s.packs.Get(packID)
+	if err != nil || int64(len(current)) != parity.Size || len(parity.checkData(current, 0)) > 0 {
+		if err := s.replace(packID, data); err != nil {
+			return err
+		}
+	}
+
+	// the header is regenerated too, it is covered by no hash
+	_, obj, err := NewParity(data, ParityOptions{
+		DataShards:   parity.DataShards,
+		ParityShards: parity.ParityShards,
+		ShardSize:    parity.ShardSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	current, err = s.packs.Get(packID + paritySuffix)
+	if err != nil || string(current) != string(obj) {
+		return s.replace(packID+paritySuffix, obj)
+	}
+
+	return nil
+}
+
+// replace keeps a backup under RepairSuffix until the new object is in
+func (s *Store) replace(id string, data []byte) error {
+	backup := id + chunkstore.RepairSuffix
+
+	if err := s.packs.Put(backup, data); err != nil {
+		return err
+	}
+
+	if err := s.packs.Delete(id); err != nil && err != chunkstore.ErrNotFound {
+		return err
+	}
+
+	if err := s.packs.Put(id, data); err != nil {
+		return err
+	}
+
+	return s.packs.Delete(backup)
+}
+
+// recover finishes an interrupted replace from its backup
+func (s *Store) recover(id string) error {
+	backup := id + chunkstore.RepairSuffix
+
+	data, err := s.packs.Get(backup)
+	if err == chunkstore.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if ok, err := s.packs.Has(id); err != nil {
+		return err
+	} else if !ok {
+		if err := s.packs.Put(id, data); err != nil {
+			return err
+		}
+	}
+
+	return s.packs.Delete(backup)
+}
@@ -0,0 +1,181 @@
+package pack
+
+import (
+	"database/sql"
+	"sync"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+// Store appends chunks into pack files, locations are kept in the index
+type Store struct {
+	mu     sync.Mutex
+	packs  chunkstore.ChunkStore
+	db     *sql.DB
+	packer *Packer
+
+	// new packs get a parity object when set
+	parity *ParityOptions
+}
+
+func NewStore(packs chunkstore.ChunkStore, db *sql.DB, targetSize int64) (*Store, error) {
+	if err := sqlitechunks.CreatePackTables(db); err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		packs:  packs,
+		db:     db,
+		packer: NewPacker(targetSize),
+	}
+	return store, nil
+}
+
+func (s *Store) Put(id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ok, err := s.has(id); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	s.packer.Add(id, data)
+
+	if s.packer.Full() {
+		return s.flush()
+	}
+
+	return nil
+}
+
+// Flush writes out the pending pack even if it is below the target size
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+func (s *Store) flush() error {
+	// the pack has to be durable before the index points into it
+	_, err := s.writePack(s.packer)
+
+	return err
+}
+
+func (s *Store) Get(id string) ([]byte, error) {
+	s.mu.Lock()
+	data, ok := s.packer.Lookup(id)
+	s.mu.Unlock()
+
+	if ok {
+		return data, nil
+	}
+
+	location, err := sqlitechunks.GetLocation(s.db, id)
+	if err == sql.ErrNoRows {
+		return nil, chunkstore.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s.readRange(location.PackID, location.Offset, location.Length)
+}
+
+func (s *Store) has(id string) (bool, error) {
+	if _, ok := s.packer.index[id]; ok {
+		return true, nil
+	}
+
+	_, err := sqlitechunks.GetLocation(s.db, id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *Store) Has(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.has(id)
+}
+
+// Missing counts chunks still in the unflushed pack as held
+func (s *Store) Missing(ids []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	missing := []string{}
+	for _, id := range ids {
+		ok, err := s.has(id)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			missing = append(missing, id)
+		}
+	}
+
+	return missing, nil
+}
+
+// Delete only unlinks the chunk, repack reclaims the space
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.packer.Remove(id) {
+		return nil
+	}
+
+	if ok, err := s.has(id); err != nil {
+		return err
+	} else if !ok {
+		return chunkstore.ErrNotFound
+	}
+
+	return sqlitechunks.DeleteLocation(s.db, id)
+}
+
+func (s *Store) List() ([]string, error) {
+	locations, err := sqlitechunks.ListLocations(s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, location := range locations {
+		ids = append(ids, location.Checksum)
+	}
+
+	s.mu.Lock()
+	ids = append(ids, s.packer.IDs()...)
+	s.mu.Unlock()
+
+	return ids, nil
+}
+
+func (s *Store) Stat(id string) (chunkstore.ChunkInfo, error) {
+	s.mu.Lock()
+	data, ok := s.packer.Lookup(id)
+	s.mu.Unlock()
+
+	if ok {
+		return chunkstore.ChunkInfo{ID: id, Size: int64(len(data))}, nil
+	}
+
+	location, err := sqlitechunks.GetLocation(s.db, id)
+	if err == sql.ErrNoRows {
+		return chunkstore.ChunkInfo{}, chunkstore.ErrNotFound
+	} else if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	}
+
+	return chunkstore.ChunkInfo{ID: id, Size: location.Length}, nil
+}
@@ -0,0 +1,56 @@
+package pack
+
+import (
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+func TestUnflushedChunksAreMissing(t *testing.T) {
+	store, packs := newStore(t)
+
+	if err := store.Put("a1", randomData(40)); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := chunkstore.Missing(store, []string{"a1", "b2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0] != "b2" {
+		t.Fatalf("missing %v before the flush, want [b2]", missing)
+	}
+
+	// a crash before the flush loses the pending pack
+	reopened, err := NewStore(packs, store.db, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err = chunkstore.Missing(reopened, []string{"a1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 {
+		t.Fatal("a chunk that was never flushed is reported as held")
+	}
+	if _, err := reopened.Get("a1"); err != chunkstore.ErrNotFound {
+		t.Fatalf("reading an unflushed chunk returned %v, want ErrNotFound", err)
+	}
+
+	if err := reopened.Put("a1", randomData(40)); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err = chunkstore.Missing(reopened, []string{"a1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Fatal("a flushed chunk is reported missing")
+	}
+	checkChunks(t, reopened, map[string][]byte{"a1": randomData(40)})
+}
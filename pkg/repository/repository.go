@@ -0,0 +1,871 @@
+package repository
+
+import (
+	"compress/flate"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fastcdc-backup/pkg/accounting"
+	"fastcdc-backup/pkg/cache"
+	"fastcdc-backup/pkg/chunkid"
+	"fastcdc-backup/pkg/chunkserver"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/compression"
+	"fastcdc-backup/pkg/encryption"
+	"fastcdc-backup/pkg/fastcdc"
+	"fastcdc-backup/pkg/lock"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/outbox"
+	"fastcdc-backup/pkg/pack"
+	"fastcdc-backup/pkg/s3store"
+	"fastcdc-backup/pkg/serve"
+	"fastcdc-backup/pkg/sqlite-chunks"
+	"fastcdc-backup/pkg/throttle"
+)
+
+const ConfigFile = "config.json"
+
+// FormatVersion is bumped when older builds would misread a repository
+const FormatVersion = 1
+
+const IndexFile = "db/chunks.sqlite"
+
+const KeyFile = "key.json"
+
+// hosts of a shared repository each have a directory here
+const HostsDir = "hosts"
+
+// the passphrase protecting the key file is read from here
+const PassphraseEnv = "FASTCDC_PASSPHRASE"
+
+// names the maintenance file, kept away from clients
+const MaintenanceEnv = "FASTCDC_MAINTENANCE"
+
+type Config struct {
+	// on-disk format, 0 for repositories created before init existed
+	Version int
+
+	// chunk boundaries, changing them stops deduplication
+	Chunker fastcdc.Options
+
+	Layout chunkstore.Layout
+
+	// previous layout, read from during a migration
+	Migrating *chunkstore.Layout `json:",omitempty"`
+
+	// target size of pack files, chunks are stored as individual files when 0
+	PackSize int64 `json:",omitempty"`
+
+	// packs written while set get Reed-Solomon parity so damage can be repaired
+	Parity *pack.ParityOptions `json:",omitempty"`
+
+	// chunks and packs are kept in this bucket rather than under root when set
+	S3 *s3store.Config `json:",omitempty"`
+
+	// URL of a chunk server that stores chunks on the repository's behalf
+	Server string `json:",omitempty"`
+
+	// chunk server token, FASTCDC_SERVER_TOKEN when empty
+	ServerToken string `json:",omitempty"`
+
+	// serve command, e.g. ["ssh", "host", "fastcdc", "serve", "-root", "/srv/repo"]
+	Serve []string `json:",omitempty"`
+
+	// rate and concurrency limits on transfers to and from the store
+	Throttle *throttle.Options `json:",omitempty"`
+
+	// queue writes in the index and send them in the background
+	Outbox *outbox.Options `json:",omitempty"`
+
+	// local read cache, a relative Dir is under the root
+	Cache *cache.Options `json:",omitempty"`
+
+	// client-side AEAD under the master key in KeyFile
+	Encryption string `json:",omitempty"`
+
+	// "deflate" or empty, only set at init
+	Compression string `json:",omitempty"`
+
+	// "sha512" or "hmac-sha512", the latter keyed with the master key
+	ChunkID string `json:",omitempty"`
+
+	// limits on the bytes the store holds for the repository
+	Quota *accounting.Quota `json:",omitempty"`
+
+	// hosts share this directory and its index, or a chunk server instead of a bucket
+	Hosts bool `json:",omitempty"`
+
+	// deletes are refused, S3 clients still need s3:DeleteObject on locks/
+	AppendOnly bool `json:",omitempty"`
+}
+
+// Maintenance is read from the file MaintenanceEnv names, every field is optional
+type Maintenance struct {
+	// credentials allowed s3:DeleteObject and s3:DeleteObjectVersion
+	AccessKeyID     string `json:",omitempty"`
+	SecretAccessKey string `json:",omitempty"`
+
+	// deletes bypass governance mode object lock retention
+	BypassGovernance bool `json:",omitempty"`
+
+	// serve command whose server allows deletes
+	Serve []string `json:",omitempty"`
+}
+
+func (c *Config) SetDefaults() {
+	c.Version = 0
+	c.Chunker.SetDefaults()
+	c.Layout = chunkstore.FlatLayout
+	c.Migrating = nil
+	c.PackSize = 0
+	c.Parity = nil
+	c.S3 = nil
+	c.Server = ""
+	c.Serve = nil
+	c.Throttle = nil
+	c.Outbox = nil
+	c.Cache = nil
+	c.Encryption = ""
+	c.Compression = ""
+	c.ChunkID = "sha512"
+	c.Quota = nil
+	c.Hosts = false
+	c.AppendOnly = false
+}
+
+// LoadConfig returns defaults for repositories without a config
+func LoadConfig(root string) (*Config, error) {
+	config := &Config{}
+	config.SetDefaults()
+
+	bytes, err := os.ReadFile(filepath.Join(root, ConfigFile))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (c *Config) Validate() error {
+	if err := c.Chunker.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Layout.Validate(); err != nil {
+		return err
+	}
+	if c.Migrating != nil {
+		if err := c.Migrating.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.PackSize < 0 {
+		return fmt.Errorf("invalid pack size %d", c.PackSize)
+	}
+	if c.Parity != nil {
+		if err := c.Parity.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.S3 != nil && c.S3.ObjectLock != nil {
+		if err := c.S3.ObjectLock.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Throttle != nil {
+		if err := c.Throttle.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Quota != nil {
+		if err := c.Quota.Validate(); err != nil {
+			return err
+		}
+	}
+
+	switch c.Encryption {
+	case "", "xchacha20-poly1305":
+	default:
+		return fmt.Errorf("unsupported encryption %s", c.Encryption)
+	}
+
+	switch c.Compression {
+	case "", "deflate":
+	default:
+		return fmt.Errorf("unsupported compression %s", c.Compression)
+	}
+
+	switch c.ChunkID {
+	case "sha512", "hmac-sha512":
+	default:
+		return fmt.Errorf("unsupported chunk id %s", c.ChunkID)
+	}
+
+	return nil
+}
+
+// Open refuses repositories this build can't safely work on
+func Open(root string) (*Config, error) {
+	if _, err := os.Stat(filepath.Join(root, ConfigFile)); os.IsNotExist(err) {
+		if legacy(root) {
+			return nil, fmt.Errorf("repository %s predates format versions, run fastcdc init there to adopt it", root)
+		}
+		return nil, fmt.Errorf("%s is not a repository, create one with fastcdc init", root)
+	} else if err != nil {
+		return nil, err
+	}
+
+	config, err := LoadConfig(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Version == 0 {
+		return nil, fmt.Errorf("repository %s predates format versions, run fastcdc init there to adopt it", root)
+	} else if config.Version > FormatVersion {
+		return nil, fmt.Errorf("repository %s has format version %d, this build only understands up to %d", root, config.Version, FormatVersion)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("repository %s: %w", root, err)
+	}
+
+	return config, nil
+}
+
+// legacy reports whether root predates versioned configs
+func legacy(root string) bool {
+	for _, name := range []string{ConfigFile, IndexFile, "chunks", "packs", "chunklists", "hierarchy.json", HostsDir} {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+var ErrExists = errors.New("repository already exists")
+
+// Init creates a repository, returning true when a legacy one was adopted instead
+func Init(root string, config *Config) (bool, error) {
+	if current, err := LoadConfig(root); err != nil {
+		return false, err
+	} else if current.Version != 0 {
+		return false, fmt.Errorf("%w at %s", ErrExists, root)
+	} else if legacy(root) {
+		current.Version = FormatVersion
+		if err := current.Validate(); err != nil {
+			return false, err
+		}
+
+		return true, current.Save(root)
+	}
+
+	config.Version = FormatVersion
+	if err := config.Validate(); err != nil {
+		return false, err
+	}
+
+	dirs := []string{"chunklists"}
+	if config.Hosts {
+		dirs = []string{HostsDir}
+	}
+	if config.S3 == nil && config.Server == "" && len(config.Serve) == 0 {
+		if config.PackSize > 0 {
+			dirs = append(dirs, "packs")
+		} else {
+			dirs = append(dirs, "chunks")
+		}
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return false, err
+		}
+	}
+
+	db, err := OpenIndex(root)
+	if err != nil {
+		return false, err
+	}
+	db.Close()
+
+	return false, config.Save(root)
+}
+
+// Collected reports whether unreferenced chunks are left for pruning
+func (c *Config) Collected() bool {
+	return (c.AppendOnly || c.Hosts) && c.Server == ""
+}
+
+// Maintain returns an append-only config as the maintenance context sees it, never saved
+func Maintain(config *Config) (*Config, error) {
+	if !config.AppendOnly {
+		return config, nil
+	}
+
+	path, ok := os.LookupEnv(MaintenanceEnv)
+	if !ok {
+		return nil, fmt.Errorf("repository is append-only, set %s to its maintenance file to prune it", MaintenanceEnv)
+	}
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance := Maintenance{}
+	if err := json.Unmarshal(bytes, &maintenance); err != nil {
+		return nil, fmt.Errorf("maintenance file %s: %w", path, err)
+	}
+
+	maintained := *config
+	maintained.AppendOnly = false
+
+	if config.S3 != nil {
+		s3Config := *config.S3
+		if maintenance.AccessKeyID != "" {
+			s3Config.AccessKeyID = maintenance.AccessKeyID
+			s3Config.SecretAccessKey = maintenance.SecretAccessKey
+		}
+		s3Config.BypassGovernance = maintenance.BypassGovernance
+
+		maintained.S3 = &s3Config
+	}
+
+	if len(maintenance.Serve) > 0 {
+		maintained.Serve = maintenance.Serve
+	}
+
+	return &maintained, nil
+}
+
+// ValidHost reports whether host can name a directory under HostsDir
+func ValidHost(host string) error {
+	if host == "" || host == "." || host == ".." || filepath.Base(host) != host || strings.ContainsAny(host, `/\:`) {
+		return fmt.Errorf("invalid host name %q", host)
+	}
+
+	return nil
+}
+
+// Namespace returns host's namespace, the root's own when unshared
+func (c *Config) Namespace(root string, host string) (node.Namespace, error) {
+	if !c.Hosts {
+		return node.Namespace{
+			Hierarchy:  filepath.Join(root, "hierarchy.json"),
+			Chunklists: filepath.Join(root, "chunklists"),
+		}, nil
+	}
+
+	if err := ValidHost(host); err != nil {
+		return node.Namespace{}, err
+	}
+
+	dir := filepath.Join(root, HostsDir, host)
+
+	return node.Namespace{
+		Host:       host,
+		Hierarchy:  filepath.Join(dir, "hierarchy.json"),
+		Chunklists: filepath.Join(dir, "chunklists"),
+	}, nil
+}
+
+// Namespaces returns every host's namespace, sorted by host
+func (c *Config) Namespaces(root string) ([]node.Namespace, error) {
+	if !c.Hosts {
+		namespace, err := c.Namespace(root, "")
+		if err != nil {
+			return nil, err
+		}
+
+		return []node.Namespace{namespace}, nil
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, HostsDir))
+	if os.IsNotExist(err) {
+		return []node.Namespace{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	namespaces := []node.Namespace{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		namespace, err := c.Namespace(root, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, namespace)
+	}
+
+	return namespaces, nil
+}
+
+// AdoptHosts moves a single host repository into host's namespace
+func AdoptHosts(root string, host string) error {
+	config, err := Open(root)
+	if err != nil {
+		return err
+	}
+
+	if config.Hosts {
+		return fmt.Errorf("repository %s is already shared between hosts", root)
+	}
+
+	from, err := config.Namespace(root, "")
+	if err != nil {
+		return err
+	}
+
+	config.Hosts = true
+	to, err := config.Namespace(root, host)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to.Hierarchy), 0755); err != nil {
+		return err
+	}
+
+	moves := [][2]string{{from.Hierarchy, to.Hierarchy}, {from.Chunklists, to.Chunklists}}
+	for _, move := range moves {
+		if err := os.Rename(move[0], move[1]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return config.Save(root)
+}
+
+// Save replaces the config file atomically
+func (c *Config) Save(root string) error {
+	configJSON, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fo, err := os.CreateTemp(root, ConfigFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := fo.Name()
+
+	_, err = fo.Write(configJSON)
+	if err == nil {
+		err = fo.Sync()
+	}
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(root, ConfigFile)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func OpenIndex(root string) (*sql.DB, error) {
+	path := filepath.Join(root, IndexFile)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := sqlitechunks.OpenDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sqlitechunks.CreateTable(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := sqlitechunks.CreateSizeTable(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func OpenChunkStore(root string, config *Config) (*chunkstore.FSStore, error) {
+	dir := filepath.Join(root, "chunks")
+
+	if config.Migrating != nil {
+		return chunkstore.NewFSStore(dir, config.Layout, *config.Migrating)
+	}
+
+	return chunkstore.NewFSStore(dir, config.Layout)
+}
+
+// openBackend opens a directory under root or a prefix in the bucket
+func openBackend(root string, config *Config, name string, layout chunkstore.Layout) (chunkstore.ChunkStore, error) {
+	if config.S3 != nil {
+		s3Config := *config.S3
+		s3Config.Prefix += name + "/"
+
+		// no retention, and plain deletes so s3:DeleteObjectVersion isn't needed
+		if name == "locks" {
+			s3Config.ObjectLock = nil
+			s3Config.Versioned = false
+		}
+
+		store, err := s3store.NewStore(s3Config)
+		if err != nil {
+			return nil, err
+		}
+
+		return store, nil
+	}
+
+	fallback := []chunkstore.Layout{}
+	if name == "chunks" && config.Migrating != nil {
+		fallback = append(fallback, *config.Migrating)
+	}
+
+	store, err := chunkstore.NewFSStore(filepath.Join(root, name), layout, fallback...)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// OpenLocks returns the lock store, the server's behind a chunk server or serve command
+func OpenLocks(root string, config *Config) (chunkstore.ChunkStore, error) {
+	if config.Server != "" {
+		return ServerClient(config).Locks(), nil
+	}
+
+	if len(config.Serve) > 0 {
+		client, err := serve.Dial(config.Serve)
+		if err != nil {
+			return nil, err
+		}
+
+		return client.Locks(), nil
+	}
+
+	return openBackend(root, config, "locks", chunkstore.FlatLayout)
+}
+
+// Lock takes a lock with the default timings
+func Lock(root string, config *Config, exclusive bool, command string) (*lock.Handle, error) {
+	store, err := OpenLocks(root, config)
+	if err != nil {
+		return nil, err
+	}
+
+	opt := lock.Options{}
+	opt.SetDefaults()
+
+	handle, err := lock.Acquire(store, exclusive, command, opt)
+	if err != nil {
+		if closer, ok := store.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+
+	return handle, nil
+}
+
+// LoadMasterKey unwraps the repository key with the passphrase from the environment
+func LoadMasterKey(root string) (encryption.MasterKey, error) {
+	passphrase, ok := os.LookupEnv(PassphraseEnv)
+	if !ok {
+		return nil, fmt.Errorf("repository is encrypted, set %s", PassphraseEnv)
+	}
+
+	keyFile, err := encryption.LoadKeyFile(filepath.Join(root, KeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return keyFile.Unwrap(passphrase)
+}
+
+// ChunkIDFunc returns how the repository names chunks
+func ChunkIDFunc(root string, config *Config) (chunkid.Func, error) {
+	switch config.ChunkID {
+	case "", "sha512":
+		return chunkid.SHA512, nil
+	case "hmac-sha512":
+		master, err := LoadMasterKey(root)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := master.Derive("fastcdc chunk id")
+		if err != nil {
+			return nil, err
+		}
+
+		return chunkid.HMAC(key), nil
+	default:
+		return nil, fmt.Errorf("unsupported chunk id %s", config.ChunkID)
+	}
+}
+
+// OpenStore returns the configured store stack chunks are written to
+func OpenStore(root string, config *Config, db *sql.DB) (chunkstore.ChunkStore, error) {
+	var store chunkstore.ChunkStore
+	var err error
+
+	// below encryption, the backend is opened on first send
+	if config.Outbox != nil {
+		store, err = outbox.NewStore(db, func() (chunkstore.ChunkStore, error) {
+			return openStore(root, config, db)
+		}, *config.Outbox)
+	} else {
+		store, err = openStore(root, config, db)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// below encryption, so cached objects stay sealed on disk
+	if config.Cache != nil {
+		opt := *config.Cache
+		if !filepath.IsAbs(opt.Dir) {
+			opt.Dir = filepath.Join(root, opt.Dir)
+		}
+
+		store, err = cache.NewStore(store, opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch config.Encryption {
+	case "":
+	case "xchacha20-poly1305":
+		master, err := LoadMasterKey(root)
+		if err != nil {
+			return nil, err
+		}
+
+		store, err = encryption.NewStore(store, master)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption %s", config.Encryption)
+	}
+
+	// above encryption, ciphertext doesn't compress
+	switch config.Compression {
+	case "":
+		return store, nil
+	case "deflate":
+		return compression.NewStore(store, flate.DefaultCompression)
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", config.Compression)
+	}
+}
+
+// openStore opens the store below the outbox, append-only unless behind a chunk server
+func openStore(root string, config *Config, db *sql.DB) (chunkstore.ChunkStore, error) {
+	store, err := openObjects(root, config, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.AppendOnly && config.Server == "" {
+		return chunkstore.NewAppendOnlyStore(store), nil
+	}
+
+	return store, nil
+}
+
+// ServerClient talks to the repository's chunk server
+func ServerClient(config *Config) *chunkserver.Client {
+	token := config.ServerToken
+	if token == "" {
+		token = os.Getenv(chunkserver.TokenEnv)
+	}
+
+	return chunkserver.NewClient(config.Server, token)
+}
+
+func openObjects(root string, config *Config, db *sql.DB) (chunkstore.ChunkStore, error) {
+	// every transfer to and from the backend goes through the one limiter
+	limit := func(store chunkstore.ChunkStore) chunkstore.ChunkStore {
+		return store
+	}
+	if config.Throttle != nil {
+		limiter, err := throttle.NewLimiter(*config.Throttle)
+		if err != nil {
+			return nil, err
+		}
+
+		limit = func(store chunkstore.ChunkStore) chunkstore.ChunkStore {
+			return throttle.NewStore(store, limiter)
+		}
+	}
+
+	if config.Server != "" {
+		return limit(ServerClient(config)), nil
+	}
+
+	if len(config.Serve) > 0 {
+		client, err := serve.Dial(config.Serve)
+		if err != nil {
+			return nil, err
+		}
+
+		return limit(client), nil
+	}
+
+	if config.PackSize == 0 {
+		chunks, err := openBackend(root, config, "chunks", config.Layout)
+		if err != nil {
+			return nil, err
+		}
+
+		return limit(chunks), nil
+	}
+
+	packs, err := openBackend(root, config, "packs", chunkstore.FlatLayout)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := pack.NewStore(limit(packs), db, config.PackSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Parity != nil {
+		if err := store.EnableParity(*config.Parity); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// InitEncryption creates the key file, only while the repository holds no chunks
+func InitEncryption(root string, passphrase string, hmacIDs bool) error {
+	config, err := Open(root)
+	if err != nil {
+		return err
+	}
+
+	if config.Encryption != "" {
+		return fmt.Errorf("repository is already encrypted")
+	}
+
+	db, err := OpenIndex(root)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	store, err := openStore(root, config, db)
+	if err != nil {
+		return err
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		return err
+	} else if len(ids) > 0 {
+		return fmt.Errorf("repository already holds %d unencrypted objects", len(ids))
+	}
+
+	path := filepath.Join(root, KeyFile)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	keyFile, _, err := encryption.NewKeyFile(passphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := keyFile.Save(path); err != nil {
+		return err
+	}
+
+	config.Encryption = "xchacha20-poly1305"
+	if hmacIDs {
+		config.ChunkID = "hmac-sha512"
+	}
+
+	return config.Save(root)
+}
+
+// MigrateLayout records layout first, then moves chunks into it, resuming when rerun
+func MigrateLayout(root string, layout chunkstore.Layout) (int, error) {
+	if err := layout.Validate(); err != nil {
+		return 0, err
+	}
+
+	config, err := Open(root)
+	if err != nil {
+		return 0, err
+	}
+
+	// behind a server the chunks are in the server's repository, not under root
+	if config.S3 != nil || config.Server != "" || len(config.Serve) > 0 {
+		return 0, fmt.Errorf("layouts only apply to local chunk directories")
+	}
+
+	if config.Migrating != nil && config.Layout != layout {
+		return 0, fmt.Errorf("migration to layout %s is unfinished, resume it first", config.Layout)
+	} else if config.Migrating == nil {
+		if config.Layout == layout {
+			return 0, nil
+		}
+
+		previous := config.Layout
+		config.Migrating = &previous
+	}
+	config.Layout = layout
+
+	if err := config.Save(root); err != nil {
+		return 0, err
+	}
+
+	store, err := OpenChunkStore(root, config)
+	if err != nil {
+		return 0, err
+	}
+
+	moved, err := store.Relocate()
+	if err != nil {
+		return moved, err
+	}
+
+	config.Migrating = nil
+
+	return moved, config.Save(root)
+}
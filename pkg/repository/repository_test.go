@@ -0,0 +1,335 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"fastcdc-backup/pkg/cache"
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/gc"
+	"fastcdc-backup/pkg/ingest"
+	"fastcdc-backup/pkg/node"
+	"fastcdc-backup/pkg/outbox"
+	"fastcdc-backup/pkg/sqlite-chunks"
+	"fastcdc-backup/pkg/throttle"
+)
+
+// initRepo creates a repository in a temporary directory
+func initRepo(t *testing.T, configure func(*Config)) (string, *Config) {
+	root := t.TempDir()
+
+	config := &Config{}
+	config.SetDefaults()
+	if configure != nil {
+		configure(config)
+	}
+
+	if _, err := Init(root, config); err != nil {
+		t.Fatal(err)
+	}
+
+	return root, config
+}
+
+func TestMigrateLayoutRefusesRemoteStores(t *testing.T) {
+	for name, configure := range map[string]func(*Config){
+		"server": func(c *Config) { c.Server = "http://localhost:1" },
+		"serve":  func(c *Config) { c.Serve = []string{"ssh", "host", "fastcdc", "serve"} },
+	} {
+		root, _ := initRepo(t, configure)
+
+		if _, err := MigrateLayout(root, chunkstore.Layout{Levels: 1, Width: 2}); err == nil {
+			t.Fatalf("layout migration behind a %s was accepted", name)
+		}
+
+		config, err := Open(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Layout != chunkstore.FlatLayout {
+			t.Fatalf("refused migration behind a %s changed the layout to %v", name, config.Layout)
+		}
+	}
+}
+
+func TestOpenChecksVersion(t *testing.T) {
+	root, config := initRepo(t, nil)
+
+	if _, err := Open(root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []int{0, FormatVersion + 1} {
+		config.Version = version
+		if err := config.Save(root); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Open(root); err == nil {
+			t.Fatalf("opened a repository at format version %d", version)
+		}
+	}
+
+	if _, err := Open(t.TempDir()); err == nil {
+		t.Fatal("opened an empty directory")
+	}
+}
+
+func TestInitAdoptsLegacy(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "chunks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "hierarchy.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(root); err == nil {
+		t.Fatal("opened a repository without a format version")
+	}
+
+	config := &Config{}
+	config.SetDefaults()
+
+	adopted, err := Init(root, config)
+	if err != nil {
+		t.Fatal(err)
+	} else if !adopted {
+		t.Fatal("the legacy repository was not adopted")
+	}
+
+	opened, err := Open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Version != FormatVersion {
+		t.Fatalf("adopted at version %d, want %d", opened.Version, FormatVersion)
+	}
+
+	if _, err := Init(root, config); !errors.Is(err, ErrExists) {
+		t.Fatalf("initialising twice returned %v, want ErrExists", err)
+	}
+}
+
+// layers lists the types down the store stack as far as Unwrap reaches
+func layers(store chunkstore.ChunkStore) []string {
+	types := []string{}
+	for {
+		types = append(types, fmt.Sprintf("%T", store))
+
+		wrapper, ok := store.(chunkstore.Wrapper)
+		if !ok {
+			return types
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+func TestOpenStoreOrder(t *testing.T) {
+	t.Setenv(PassphraseEnv, "correct horse")
+
+	for _, test := range []struct {
+		name      string
+		configure func(*Config)
+		want      []string
+	}{
+		{
+			"throttled chunks",
+			func(c *Config) {},
+			[]string{"*compression.Store", "*encryption.Store", "*cache.Store", "*throttle.Store", "*chunkstore.FSStore"},
+		},
+		{
+			"outbox",
+			func(c *Config) {
+				c.Outbox = &outbox.Options{}
+				c.Outbox.SetDefaults()
+			},
+			[]string{"*compression.Store", "*encryption.Store", "*cache.Store", "*outbox.Store"},
+		},
+		{
+			"append-only packs",
+			func(c *Config) {
+				c.PackSize = 1 << 20
+				c.AppendOnly = true
+			},
+			[]string{"*compression.Store", "*encryption.Store", "*cache.Store", "*chunkstore.AppendOnlyStore"},
+		},
+	} {
+		root, _ := initRepo(t, nil)
+		if err := InitEncryption(root, "correct horse", false); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := Open(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Compression = "deflate"
+		config.Cache = &cache.Options{}
+		config.Cache.SetDefaults()
+		config.Throttle = &throttle.Options{}
+		config.Throttle.SetDefaults()
+		test.configure(config)
+
+		db, err := OpenIndex(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		store, err := OpenStore(root, config, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := layers(store); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: stack %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// backUp stores a file as the watcher does in host's namespace, returning how many chunks it uploaded
+func backUp(t *testing.T, root string, config *Config, store chunkstore.ChunkStore, writer *ingest.Writer, host string, name string, contents ...string) int {
+	namespace, err := config.Namespace(root, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(root, HostsDir, host)
+	if namespace.Hierarchy != filepath.Join(dir, "hierarchy.json") || namespace.Chunklists != filepath.Join(dir, "chunklists") {
+		t.Fatalf("%s's namespace %+v is outside %s", host, namespace, dir)
+	}
+
+	objects := []chunkstore.Object{}
+	fnode := &node.FNode{Path: "./data/" + name, Chunks: []string{}}
+	for _, content := range contents {
+		id := writer.ID([]byte(content))
+		objects = append(objects, chunkstore.Object{ID: id, Data: []byte(content)})
+		fnode.Chunks = append(fnode.Chunks, id)
+		fnode.Size += int64(len(content))
+	}
+
+	missing, err := chunkstore.Missing(store, fnode.Chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isMissing := map[string]bool{}
+	for _, id := range missing {
+		isMissing[id] = true
+	}
+
+	uploads := []chunkstore.Object{}
+	for _, object := range objects {
+		if isMissing[object.ID] {
+			uploads = append(uploads, object)
+		}
+	}
+	if err := writer.Upload(uploads); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range fnode.Chunks {
+		if err := writer.AddReference(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree := node.Tree{Root: &node.Node{Path: "./data", IsDir: true, Children: []*node.Node{{Path: fnode.Path}}}}
+	for path, v := range map[string]interface{}{filepath.Join(namespace.Chunklists, name): fnode, namespace.Hierarchy: tree} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return len(uploads)
+}
+
+func TestHostsShareRepository(t *testing.T) {
+	root, config := initRepo(t, func(c *Config) { c.Hosts = true })
+
+	db, err := OpenIndex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store, err := OpenStore(root, config, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt := ingest.Options{}
+	opt.SetDefaults()
+	writer, err := ingest.NewWriter(db, store, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploaded := backUp(t, root, config, store, writer, "alpha", "one", "shared chunk", "alpha's chunk"); uploaded != 2 {
+		t.Fatalf("alpha uploaded %d chunks, want 2", uploaded)
+	}
+	if uploaded := backUp(t, root, config, store, writer, "beta", "two", "shared chunk", "beta's chunk"); uploaded != 1 {
+		t.Fatalf("beta uploaded %d chunks, want only its own", uploaded)
+	}
+
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("store holds %d chunks, want the shared one once", len(ids))
+	}
+
+	shared := writer.ID([]byte("shared chunk"))
+	counts, err := sqlitechunks.ListCounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[shared] != 2 {
+		t.Fatalf("shared chunk counted %d times, want once per host", counts[shared])
+	}
+
+	orphan := writer.ID([]byte("orphan"))
+	if err := store.Put(orphan, []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces, err := config.Namespaces(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(namespaces) != 2 || namespaces[0].Host != "alpha" || namespaces[1].Host != "beta" {
+		t.Fatalf("namespaces %+v, want alpha and beta", namespaces)
+	}
+
+	gcOpt := gc.Options{}
+	gcOpt.SetDefaults()
+	gcOpt.Namespaces = namespaces
+	gcOpt.Grace = 0
+
+	result, err := gc.Run(store, db, gcOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Chunklists != 2 || result.Marked != 3 {
+		t.Fatalf("marked %d chunks from %d chunklists, want 3 from both hosts", result.Marked, result.Chunklists)
+	}
+	if len(result.Swept) != 1 || result.Swept[0] != orphan {
+		t.Fatalf("swept %v, want only the orphan", result.Swept)
+	}
+	if len(result.StaleChunklists) != 0 || len(result.Unlisted) != 0 {
+		t.Fatalf("stale %v and unlisted %v chunklists", result.StaleChunklists, result.Unlisted)
+	}
+}
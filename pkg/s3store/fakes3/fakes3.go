@@ -0,0 +1,630 @@
+package fakes3
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fastcdc-backup/pkg/s3store"
+)
+
+type upload struct {
+	key       string
+	parts     map[int][]byte
+	retention *retention
+}
+
+// retention keeps one version from being deleted until it expires
+type retention struct {
+	mode  string
+	until time.Time
+}
+
+// version is an object version or a delete marker
+type version struct {
+	id           string
+	data         []byte
+	deleteMarker bool
+	retention    *retention
+}
+
+// bucket holds versions oldest first, unversioned keys have one "null" version
+type bucket struct {
+	versioned bool
+	objects   map[string][]*version
+}
+
+// current returns the latest version of key unless it is a delete marker
+func (b *bucket) current(key string) (*version, bool) {
+	versions := b.objects[key]
+	if len(versions) == 0 || versions[len(versions)-1].deleteMarker {
+		return nil, false
+	}
+
+	return versions[len(versions)-1], true
+}
+
+// Server is an in-process S3 server covering the API s3store uses
+type Server struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	uploads map[string]*upload
+	nextID  int
+
+	accessKey string
+	secretKey string
+	region    string
+
+	// lets tests count requests by method
+	Requests map[string]int
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// New returns a server with empty buckets, accepting requests signed with the given keys
+func New(accessKey, secretKey, region string, buckets ...string) *Server {
+	server := &Server{
+		buckets:   map[string]*bucket{},
+		uploads:   map[string]*upload{},
+		accessKey: accessKey,
+		secretKey: secretKey,
+		region:    region,
+		Requests:  map[string]int{},
+	}
+
+	for _, name := range buckets {
+		server.buckets[name] = &bucket{objects: map[string][]*version{}}
+	}
+
+	return server
+}
+
+// EnableVersioning keeps every version, as object lock needs
+func (s *Server) EnableVersioning(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buckets[name].versioned = true
+}
+
+// Start listens on a random local port
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	s.listener = listener
+	s.server = &http.Server{Handler: s}
+
+	go s.server.Serve(listener)
+
+	return nil
+}
+
+func (s *Server) URL() string {
+	return "http://" + s.listener.Addr().String()
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// Object returns the current version for inspecting or corrupting it
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.buckets[bucket].current(key)
+	if !ok {
+		return nil, false
+	}
+
+	return v.data, true
+}
+
+func (s *Server) SetObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(s.buckets[bucket], key, data, nil)
+}
+
+// Versions returns how many versions and delete markers a key has
+func (s *Server) Versions(bucket, key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.buckets[bucket].objects[key])
+}
+
+// Uploads returns how many multipart uploads are in progress
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uploads)
+}
+
+// Retention returns the current version's object lock
+func (s *Server) Retention(bucket, key string) (string, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.buckets[bucket].current(key)
+	if !ok || v.retention == nil {
+		return "", time.Time{}, false
+	}
+
+	return v.retention.mode, v.retention.until, true
+}
+
+// put adds a version and returns its ID, s.mu held
+func (s *Server) put(b *bucket, key string, data []byte, lock *retention) string {
+	if !b.versioned {
+		b.objects[key] = []*version{{id: "null", data: data}}
+		return "null"
+	}
+
+	s.nextID++
+	v := &version{id: "v" + strconv.Itoa(s.nextID), data: data, retention: lock}
+	b.objects[key] = append(b.objects[key], v)
+
+	return v.id
+}
+
+// parseRetention reads the object lock headers of an upload, nil without any
+func parseRetention(r *http.Request) (*retention, error) {
+	mode := r.Header.Get("x-amz-object-lock-mode")
+	until := r.Header.Get("x-amz-object-lock-retain-until-date")
+	if mode == "" && until == "" {
+		return nil, nil
+	}
+
+	if mode != "GOVERNANCE" && mode != "COMPLIANCE" {
+		return nil, fmt.Errorf("unknown object lock mode %q", mode)
+	}
+
+	t, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return nil, err
+	}
+
+	return &retention{mode: mode, until: t}, nil
+}
+
+// checkMD5 reports whether the upload carries a Content-MD5 matching body
+func checkMD5(r *http.Request, body []byte) bool {
+	sum := md5.Sum(body)
+	return r.Header.Get("Content-MD5") == base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// locked reports whether the retention on v forbids deleting it
+func locked(r *http.Request, v *version) bool {
+	if v.retention == nil || !time.Now().Before(v.retention.until) {
+		return false
+	}
+
+	bypass := r.Header.Get("x-amz-bypass-governance-retention") == "true"
+
+	return v.retention.mode == "COMPLIANCE" || !bypass
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Requests[r.Method]++
+
+	if err := s3store.Verify(r, s.accessKey, s.secretKey, s.region); err != nil {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	if r.Header.Get("x-amz-content-sha256") != fmt.Sprintf("%x", sha256.Sum256(body)) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload hash does not match")
+		return
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	b, ok := s.buckets[path[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "bucket does not exist")
+		return
+	}
+
+	query := r.URL.Query()
+
+	if len(path) == 1 || path[1] == "" {
+		if r.Method == http.MethodGet && query.Get("list-type") == "2" {
+			s.list(w, b, query.Get("prefix"), query.Get("continuation-token"), query.Get("max-keys"))
+			return
+		}
+		if r.Method == http.MethodGet && query.Has("versions") {
+			s.listVersions(w, b, query.Get("prefix"), query.Get("key-marker"), query.Get("version-id-marker"), query.Get("max-keys"))
+			return
+		}
+
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "unsupported bucket operation")
+		return
+	}
+	key := path[1]
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		lock, err := parseRetention(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		} else if lock != nil && !b.versioned {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", "bucket is missing object lock configuration")
+			return
+		}
+		s.uploads[id] = &upload{key: key, parts: map[int][]byte{}, retention: lock}
+
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			UploadID string   `xml:"UploadId"`
+		}{Bucket: path[0], Key: key, UploadID: id})
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		u, ok := s.uploads[query.Get("uploadId")]
+		if !ok || u.key != key {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+			return
+		}
+
+		part, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || part < 1 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+			return
+		}
+
+		if u.retention != nil && !checkMD5(r, body) {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", "Content-MD5 is required with object lock")
+			return
+		}
+
+		u.parts[part] = body
+		w.Header().Set("ETag", etag(body))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.complete(w, b, key, query.Get("uploadId"), body)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut:
+		lock, err := parseRetention(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		} else if lock != nil && !b.versioned {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", "bucket is missing object lock configuration")
+			return
+		} else if lock != nil && !checkMD5(r, body) {
+			writeError(w, http.StatusBadRequest, "InvalidRequest", "Content-MD5 is required with object lock")
+			return
+		}
+
+		// a new version goes on top of retained ones rather than replacing them
+		w.Header().Set("x-amz-version-id", s.put(b, key, body, lock))
+		w.Header().Set("ETag", etag(body))
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		v, ok := b.current(key)
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeError(w, http.StatusNotFound, "NoSuchKey", "key does not exist")
+			return
+		}
+
+		data := v.data
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && r.Method == http.MethodGet {
+			start, end, ok := parseRange(rangeHeader, int64(len(data)))
+			if !ok {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "range not satisfiable")
+				return
+			}
+
+			w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+
+	case r.Method == http.MethodDelete && query.Has("versionId"):
+		s.deleteVersion(w, r, b, key, query.Get("versionId"))
+
+	case r.Method == http.MethodDelete:
+		// versions stay, hidden behind a delete marker
+		if b.versioned {
+			s.nextID++
+			marker := &version{id: "v" + strconv.Itoa(s.nextID), deleteMarker: true}
+			b.objects[key] = append(b.objects[key], marker)
+
+			w.Header().Set("x-amz-version-id", marker.id)
+			w.Header().Set("x-amz-delete-marker", "true")
+		} else {
+			delete(b.objects, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "unsupported object operation")
+	}
+}
+
+func parseRange(header string, size int64) (int64, int64, bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	bounds := strings.SplitN(spec, "-", 2)
+	if spec == header || len(bounds) != 2 {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+	if bounds[1] != "" {
+		end, err = strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end, true
+}
+
+// deleteVersion removes one version unless it is retained
+func (s *Server) deleteVersion(w http.ResponseWriter, r *http.Request, b *bucket, key, versionID string) {
+	versions := b.objects[key]
+
+	for i, v := range versions {
+		if v.id != versionID {
+			continue
+		}
+
+		if locked(r, v) {
+			writeError(w, http.StatusForbidden, "AccessDenied", "object is under retention")
+			return
+		}
+
+		versions = append(versions[:i:i], versions[i+1:]...)
+		if len(versions) == 0 {
+			delete(b.objects, key)
+		} else {
+			b.objects[key] = versions
+		}
+
+		w.Header().Set("x-amz-version-id", versionID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeError(w, http.StatusNotFound, "NoSuchVersion", "version does not exist")
+}
+
+func (s *Server) complete(w http.ResponseWriter, b *bucket, key, uploadID string, body []byte) {
+	u, ok := s.uploads[uploadID]
+	if !ok || u.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+		return
+	}
+
+	request := struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}{}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	data := []byte{}
+	sums := []byte{}
+
+	for i, part := range request.Parts {
+		partData, ok := u.parts[part.PartNumber]
+		if !ok || part.PartNumber != i+1 || etag(partData) != part.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", "part is missing or out of order")
+			return
+		}
+
+		data = append(data, partData...)
+		sum := md5.Sum(partData)
+		sums = append(sums, sum[:]...)
+	}
+
+	w.Header().Set("x-amz-version-id", s.put(b, key, data, u.retention))
+	delete(s.uploads, uploadID)
+
+	sum := md5.Sum(sums)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Key: key, ETag: fmt.Sprintf(`"%x-%d"`, sum, len(request.Parts))})
+}
+
+type listEntry struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+	ETag string `xml:"ETag"`
+}
+
+func pageLimit(maxKeys string) int {
+	limit := 1000
+	if n, err := strconv.Atoi(maxKeys); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+
+	return limit
+}
+
+func (s *Server) list(w http.ResponseWriter, b *bucket, prefix, token, maxKeys string) {
+	limit := pageLimit(maxKeys)
+
+	keys := []string{}
+	for key := range b.objects {
+		// the continuation token is simply the last key returned
+		if _, ok := b.current(key); ok && strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := struct {
+		XMLName               xml.Name    `xml:"ListBucketResult"`
+		Prefix                string      `xml:"Prefix"`
+		KeyCount              int         `xml:"KeyCount"`
+		IsTruncated           bool        `xml:"IsTruncated"`
+		NextContinuationToken string      `xml:"NextContinuationToken,omitempty"`
+		Contents              []listEntry `xml:"Contents"`
+	}{Prefix: prefix, Contents: []listEntry{}}
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[limit-1]
+	}
+
+	for _, key := range keys {
+		v, _ := b.current(key)
+		result.Contents = append(result.Contents, listEntry{Key: key, Size: int64(len(v.data)), ETag: etag(v.data)})
+	}
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, result)
+}
+
+type versionEntry struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId"`
+	IsLatest  bool   `xml:"IsLatest"`
+	Size      int64  `xml:"Size,omitempty"`
+}
+
+// listVersions lists versions and delete markers by key, newest first
+func (s *Server) listVersions(w http.ResponseWriter, b *bucket, prefix, keyMarker, versionMarker, maxKeys string) {
+	limit := pageLimit(maxKeys)
+
+	keys := []string{}
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) && key >= keyMarker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := struct {
+		XMLName             xml.Name       `xml:"ListVersionsResult"`
+		Prefix              string         `xml:"Prefix"`
+		IsTruncated         bool           `xml:"IsTruncated"`
+		NextKeyMarker       string         `xml:"NextKeyMarker,omitempty"`
+		NextVersionIDMarker string         `xml:"NextVersionIdMarker,omitempty"`
+		Versions            []versionEntry `xml:"Version"`
+		DeleteMarkers       []versionEntry `xml:"DeleteMarker"`
+	}{Prefix: prefix, Versions: []versionEntry{}, DeleteMarkers: []versionEntry{}}
+
+	count := 0
+	for _, key := range keys {
+		versions := b.objects[key]
+
+		skipping := key == keyMarker
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+
+			if skipping {
+				if v.id == versionMarker {
+					skipping = false
+				}
+				continue
+			}
+
+			if count == limit {
+				result.IsTruncated = true
+				writeXML(w, result)
+				return
+			}
+
+			entry := versionEntry{Key: key, VersionID: v.id, IsLatest: i == len(versions)-1}
+			if v.deleteMarker {
+				result.DeleteMarkers = append(result.DeleteMarkers, entry)
+			} else {
+				entry.Size = int64(len(v.data))
+				result.Versions = append(result.Versions, entry)
+			}
+
+			result.NextKeyMarker, result.NextVersionIDMarker = key, v.id
+			count++
+		}
+	}
+
+	result.NextKeyMarker, result.NextVersionIDMarker = "", ""
+	writeXML(w, result)
+}
@@ -0,0 +1,569 @@
+package s3store
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Config addresses objects path-style as endpoint/bucket/prefix+id, region "auto" for R2
+type Config struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+	Prefix   string
+
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY when empty
+	AccessKeyID     string `json:",omitempty"`
+	SecretAccessKey string `json:",omitempty"`
+
+	// objects at least this large are uploaded in parts of PartSize
+	MultipartThreshold int64
+	PartSize           int64
+
+	// objects are written under this retention when set
+	ObjectLock *ObjectLock `json:",omitempty"`
+
+	// deletes remove every version by ID, implied by ObjectLock
+	Versioned bool `json:",omitempty"`
+
+	// deletes bypass governance retention, needs s3:BypassGovernanceRetention
+	BypassGovernance bool `json:",omitempty"`
+}
+
+// ObjectLock retains every version written, the bucket needs object lock enabled
+type ObjectLock struct {
+	// "GOVERNANCE" can be bypassed, "COMPLIANCE" can't
+	Mode string
+
+	// how long each object is retained after it is written
+	Days int
+}
+
+func (o ObjectLock) Validate() error {
+	switch o.Mode {
+	case "GOVERNANCE", "COMPLIANCE":
+	default:
+		return fmt.Errorf("s3: unsupported object lock mode %q", o.Mode)
+	}
+
+	if o.Days <= 0 {
+		return fmt.Errorf("s3: object lock retention has to be at least a day")
+	}
+
+	return nil
+}
+
+func (c *Config) SetDefaults() {
+	c.Region = "auto"
+	c.Prefix = ""
+	c.MultipartThreshold = 16 << 20
+	c.PartSize = 8 << 20
+}
+
+// Error is an error response returned by the server
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+type Store struct {
+	config Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewStore(config Config) (*Store, error) {
+	if config.AccessKeyID == "" {
+		config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if config.SecretAccessKey == "" {
+		config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("s3: endpoint and bucket are required")
+	}
+	if config.ObjectLock != nil {
+		if err := config.ObjectLock.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Region == "" {
+		config.Region = "auto"
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = 8 << 20
+	}
+	if config.MultipartThreshold <= 0 {
+		config.MultipartThreshold = 16 << 20
+	}
+
+	store := &Store{
+		config: config,
+		client: &http.Client{Timeout: 5 * time.Minute},
+		now:    time.Now,
+	}
+	return store, nil
+}
+
+func (s *Store) objectURL(key string, query url.Values) string {
+	u := strings.TrimSuffix(s.config.Endpoint, "/") + "/" + s.config.Bucket
+	if key != "" {
+		u += "/" + uriEncode(key, true)
+	}
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+
+	return u
+}
+
+func (s *Store) key(id string) string {
+	return s.config.Prefix + id
+}
+
+func (s *Store) versioned() bool {
+	return s.config.Versioned || s.config.ObjectLock != nil
+}
+
+// do signs the request, the caller closes successful bodies
+func (s *Store) do(method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	payloadHash := emptyPayloadHash
+
+	if body != nil {
+		reader = bytes.NewReader(body)
+		payloadHash = hashHex(body)
+	}
+
+	req, err := http.NewRequest(method, s.objectURL(key, query), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+
+	Sign(req, payloadHash, s.config.AccessKeyID, s.config.SecretAccessKey, s.config.Region, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		e := &Error{StatusCode: resp.StatusCode}
+		if data, err := io.ReadAll(resp.Body); err == nil && len(data) > 0 {
+			xml.Unmarshal(data, e)
+		}
+
+		if resp.StatusCode == http.StatusNotFound && (e.Code == "" || e.Code == "NoSuchKey") {
+			return nil, chunkstore.ErrNotFound
+		}
+
+		return nil, e
+	}
+
+	return resp, nil
+}
+
+// retention returns object lock headers, nil without a lock
+func (s *Store) retention() http.Header {
+	if s.config.ObjectLock == nil {
+		return nil
+	}
+
+	until := s.now().UTC().AddDate(0, 0, s.config.ObjectLock.Days)
+
+	header := http.Header{}
+	header.Set("x-amz-object-lock-mode", s.config.ObjectLock.Mode)
+	header.Set("x-amz-object-lock-retain-until-date", until.Format(time.RFC3339))
+
+	return header
+}
+
+// withMD5 adds the Content-MD5 S3 requires on uploads under retention
+func withMD5(header http.Header, data []byte) http.Header {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	sum := md5.Sum(data)
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	return header
+}
+
+func (s *Store) Put(id string, data []byte) error {
+	if int64(len(data)) >= s.config.MultipartThreshold {
+		return s.putMultipart(s.key(id), data)
+	}
+
+	header := s.retention()
+	if header != nil {
+		header = withMD5(header, data)
+	}
+
+	resp, err := s.do(http.MethodPut, s.key(id), nil, data, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+func (s *Store) putMultipart(key string, data []byte) error {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, s.retention())
+	if err != nil {
+		return err
+	}
+
+	initiated := initiateMultipartUploadResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	err = s.uploadParts(key, initiated.UploadID, data)
+	if err != nil { // don't leave the parts behind to be billed for
+		if resp, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+	}
+
+	return err
+}
+
+func (s *Store) uploadParts(key, uploadID string, data []byte) error {
+	complete := completeMultipartUpload{Parts: []completedPart{}}
+
+	for offset, part := int64(0), 1; offset < int64(len(data)); offset, part = offset+s.config.PartSize, part+1 {
+		end := offset + s.config.PartSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+
+		query := url.Values{
+			"partNumber": {strconv.Itoa(part)},
+			"uploadId":   {uploadID},
+		}
+
+		var header http.Header
+		if s.config.ObjectLock != nil {
+			header = withMD5(nil, data[offset:end])
+		}
+
+		resp, err := s.do(http.MethodPut, key, query, data[offset:end], header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			sum := md5.Sum(data[offset:end])
+			etag = `"` + hex.EncodeToString(sum[:]) + `"`
+		}
+
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: part, ETag: etag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// completion can fail after a 200 response, the error is in the body
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	e := &Error{StatusCode: resp.StatusCode}
+	if xml.Unmarshal(data, e) == nil && e.Code != "" {
+		return e
+	}
+
+	return nil
+}
+
+func (s *Store) Get(id string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, s.key(id), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s *Store) GetRange(id string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length <= 0 {
+		if length == 0 && offset >= 0 {
+			return []byte{}, nil
+		}
+		return nil, fmt.Errorf("invalid range [%d, %d) for %s", offset, offset+length, id)
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := s.do(http.MethodGet, s.key(id), nil, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("s3: expected a partial response for %s, got %d", id, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("range [%d, %d) is out of bounds for %s", offset, offset+length, id)
+	}
+
+	return data, nil
+}
+
+func (s *Store) Has(id string) (bool, error) {
+	_, err := s.Stat(id)
+	if err == chunkstore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *Store) Delete(id string) error {
+	if s.versioned() {
+		return s.deleteVersions(id)
+	}
+
+	// S3 deletes succeed for missing keys, check first to match the other stores
+	if ok, err := s.Has(id); err != nil {
+		return err
+	} else if !ok {
+		return chunkstore.ErrNotFound
+	}
+
+	return s.deleteVersion(s.key(id), "")
+}
+
+// deleteVersion deletes a version, or adds a delete marker without an ID
+func (s *Store) deleteVersion(key, versionID string) error {
+	var query url.Values
+	if versionID != "" {
+		query = url.Values{"versionId": {versionID}}
+	}
+
+	var header http.Header
+	if s.config.BypassGovernance {
+		header = http.Header{}
+		header.Set("x-amz-bypass-governance-retention", "true")
+	}
+
+	resp, err := s.do(http.MethodDelete, key, query, nil, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// deleteVersions removes every version and delete marker of id
+func (s *Store) deleteVersions(id string) error {
+	key := s.key(id)
+
+	versions, err := s.listVersions(key)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, version := range versions {
+		if version.Key != key {
+			continue
+		}
+		if version.IsLatest && !version.DeleteMarker {
+			found = true
+		}
+
+		if err := s.deleteVersion(key, version.VersionID); err != nil && err != chunkstore.ErrNotFound {
+			return err
+		}
+	}
+
+	if !found {
+		return chunkstore.ErrNotFound
+	}
+
+	return nil
+}
+
+type objectVersion struct {
+	Key          string `xml:"Key"`
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	Size         int64  `xml:"Size"`
+	DeleteMarker bool   `xml:"-"`
+}
+
+type listVersionsResult struct {
+	Versions            []objectVersion `xml:"Version"`
+	DeleteMarkers       []objectVersion `xml:"DeleteMarker"`
+	IsTruncated         bool            `xml:"IsTruncated"`
+	NextKeyMarker       string          `xml:"NextKeyMarker"`
+	NextVersionIDMarker string          `xml:"NextVersionIdMarker"`
+}
+
+// listVersions returns every version and delete marker under prefix
+func (s *Store) listVersions(prefix string) ([]objectVersion, error) {
+	versions := []objectVersion{}
+	keyMarker, versionMarker := "", ""
+
+	for {
+		query := url.Values{
+			"versions": {""},
+			"prefix":   {prefix},
+		}
+		if keyMarker != "" {
+			query.Set("key-marker", keyMarker)
+			query.Set("version-id-marker", versionMarker)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result := listVersionsResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, result.Versions...)
+		for _, marker := range result.DeleteMarkers {
+			marker.DeleteMarker = true
+			versions = append(versions, marker)
+		}
+
+		if !result.IsTruncated || result.NextKeyMarker == "" {
+			return versions, nil
+		}
+		keyMarker, versionMarker = result.NextKeyMarker, result.NextVersionIDMarker
+	}
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *Store) List() ([]string, error) {
+	ids := []string{}
+	token := ""
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.config.Prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			ids = append(ids, strings.TrimPrefix(object.Key, s.config.Prefix))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return ids, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *Store) Stat(id string) (chunkstore.ChunkInfo, error) {
+	resp, err := s.do(http.MethodHead, s.key(id), nil, nil, nil)
+	if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	}
+	resp.Body.Close()
+
+	return chunkstore.ChunkInfo{ID: id, Size: resp.ContentLength}, nil
+}
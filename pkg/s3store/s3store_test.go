@@ -0,0 +1,345 @@
+package s3store_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/s3store"
+	"fastcdc-backup/pkg/s3store/fakes3"
+)
+
+const (
+	accessKey = "AKIDEXAMPLE"
+	secretKey = "secret"
+	region    = "auto"
+	bucket    = "backups"
+)
+
+func startFake(t *testing.T) *fakes3.Server {
+	fake := fakes3.New(accessKey, secretKey, region, bucket)
+	if err := fake.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fake.Close() })
+
+	return fake
+}
+
+func newStore(t *testing.T, endpoint string, configure func(*s3store.Config)) *s3store.Store {
+	config := s3store.Config{}
+	config.SetDefaults()
+	config.Endpoint = endpoint
+	config.Bucket = bucket
+	config.Prefix = "chunks/"
+	config.AccessKeyID = accessKey
+	config.SecretAccessKey = secretKey
+	if configure != nil {
+		configure(&config)
+	}
+
+	store, err := s3store.NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestPutGetRange(t *testing.T) {
+	fake := startFake(t)
+	store := newStore(t, fake.URL(), nil)
+
+	data := []byte("hello chunk store")
+	if err := store.Put("a1", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, ok := fake.Object(bucket, "chunks/a1"); !ok || !bytes.Equal(stored, data) {
+		t.Fatalf("bucket holds %q under the prefixed key", stored)
+	}
+
+	got, err := store.Get("a1")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	part, err := store.GetRange("a1", 6, 5)
+	if err != nil || string(part) != "chunk" {
+		t.Fatalf("range read %q, %v", part, err)
+	}
+	if _, err := store.GetRange("a1", 10, 20); err == nil {
+		t.Fatal("range past the end succeeded")
+	}
+
+	info, err := store.Stat("a1")
+	if err != nil || info.Size != int64(len(data)) {
+		t.Fatalf("stat returned %+v, %v", info, err)
+	}
+
+	if _, err := store.Get("b2"); err != chunkstore.ErrNotFound {
+		t.Fatalf("get of a missing chunk returned %v, want ErrNotFound", err)
+	}
+	if ok, err := store.Has("b2"); ok || err != nil {
+		t.Fatalf("has of a missing chunk returned %v, %v", ok, err)
+	}
+
+	if err := store.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("a1"); err != chunkstore.ErrNotFound {
+		t.Fatalf("second delete returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	fake := startFake(t)
+	store := newStore(t, fake.URL(), func(config *s3store.Config) {
+		config.MultipartThreshold = 10
+		config.PartSize = 4
+	})
+
+	data := []byte("spread over several parts")
+	if err := store.Put("a1", data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get("a1")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	if fake.Requests[http.MethodPost] != 2 {
+		t.Fatalf("sent %d POST requests, want one to start and one to complete", fake.Requests[http.MethodPost])
+	}
+	if fake.Uploads() != 0 {
+		t.Fatalf("%d uploads left in progress", fake.Uploads())
+	}
+}
+
+func TestMultipartUploadAborted(t *testing.T) {
+	fake := startFake(t)
+
+	// the second part fails, the upload should then be aborted
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Query().Get("partNumber") == "2" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer failing.Close()
+
+	store := newStore(t, failing.URL, func(config *s3store.Config) {
+		config.MultipartThreshold = 10
+		config.PartSize = 4
+	})
+
+	if err := store.Put("a1", []byte("spread over several parts")); err == nil {
+		t.Fatal("upload with a failing part succeeded")
+	}
+
+	if fake.Uploads() != 0 {
+		t.Fatalf("%d uploads left in progress after the failure", fake.Uploads())
+	}
+	if _, ok := fake.Object(bucket, "chunks/a1"); ok {
+		t.Fatal("failed upload left an object behind")
+	}
+}
+
+func TestListPages(t *testing.T) {
+	fake := startFake(t)
+	store := newStore(t, fake.URL(), nil)
+
+	// more than the 1000 keys a page holds
+	for i := 0; i < 2500; i++ {
+		fake.SetObject(bucket, fmt.Sprintf("chunks/%04x", i), []byte{1})
+	}
+	fake.SetObject(bucket, "other/ffff", []byte{1})
+
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2500 {
+		t.Fatalf("listed %d ids, want 2500", len(ids))
+	}
+	for i, id := range ids {
+		if id != fmt.Sprintf("%04x", i) {
+			t.Fatalf("id %d is %q", i, id)
+		}
+	}
+}
+
+func TestSignatureRejected(t *testing.T) {
+	fake := startFake(t)
+	store := newStore(t, fake.URL(), func(config *s3store.Config) {
+		config.SecretAccessKey = "wrong"
+	})
+
+	err := store.Put("a1", []byte("data"))
+
+	var s3err *s3store.Error
+	if !errors.As(err, &s3err) || s3err.StatusCode != http.StatusForbidden || s3err.Code != "SignatureDoesNotMatch" {
+		t.Fatalf("got %v, want a SignatureDoesNotMatch error", err)
+	}
+	if _, ok := fake.Object(bucket, "chunks/a1"); ok {
+		t.Fatal("object written with a bad signature")
+	}
+}
+
+func TestRetentionRefusesDelete(t *testing.T) {
+	fake := startFake(t)
+	fake.EnableVersioning(bucket)
+	lock := &s3store.ObjectLock{Mode: "GOVERNANCE", Days: 1}
+
+	store := newStore(t, fake.URL(), func(config *s3store.Config) {
+		config.ObjectLock = lock
+	})
+
+	if err := store.Put("a1", []byte("retained")); err != nil {
+		t.Fatal(err)
+	}
+	if mode, _, ok := fake.Retention(bucket, "chunks/a1"); !ok || mode != "GOVERNANCE" {
+		t.Fatalf("object is under %q retention", mode)
+	}
+
+	var s3err *s3store.Error
+	if err := store.Delete("a1"); !errors.As(err, &s3err) || s3err.Code != "AccessDenied" {
+		t.Fatalf("delete under retention returned %v, want AccessDenied", err)
+	}
+
+	// the refused delete left no marker hiding the object
+	if _, ok := fake.Object(bucket, "chunks/a1"); !ok {
+		t.Fatal("object is gone after a refused delete")
+	}
+
+	maintenance := newStore(t, fake.URL(), func(config *s3store.Config) {
+		config.ObjectLock = lock
+		config.BypassGovernance = true
+	})
+	if err := maintenance.Delete("a1"); err != nil {
+		t.Fatalf("governance bypass failed: %v", err)
+	}
+	if n := fake.Versions(bucket, "chunks/a1"); n != 0 {
+		t.Fatalf("%d versions left after the delete", n)
+	}
+}
+
+func TestComplianceRetentionCantBeBypassed(t *testing.T) {
+	fake := startFake(t)
+	fake.EnableVersioning(bucket)
+	store := newStore(t, fake.URL(), func(config *s3store.Config) {
+		config.ObjectLock = &s3store.ObjectLock{Mode: "COMPLIANCE", Days: 1}
+		config.BypassGovernance = true
+	})
+
+	if err := store.Put("a1", []byte("retained")); err != nil {
+		t.Fatal(err)
+	}
+
+	var s3err *s3store.Error
+	if err := store.Delete("a1"); !errors.As(err, &s3err) || s3err.Code != "AccessDenied" {
+		t.Fatalf("delete under compliance retention returned %v, want AccessDenied", err)
+	}
+}
+
+func TestObjectLockNeedsVersioning(t *testing.T) {
+	fake := startFake(t)
+	store := newStore(t, fake.URL(), func(config *s3store.Config) {
+		config.ObjectLock = &s3store.ObjectLock{Mode: "GOVERNANCE", Days: 1}
+	})
+
+	if err := store.Put("a1", []byte("retained")); err == nil {
+		t.Fatal("retained upload to an unversioned bucket succeeded")
+	}
+}
+
+func TestVersionedDelete(t *testing.T) {
+	fake := startFake(t)
+	fake.EnableVersioning(bucket)
+
+	store := newStore(t, fake.URL(), func(config *s3store.Config) {
+		config.Versioned = true
+	})
+
+	for _, data := range []string{"first", "second"} {
+		if err := store.Put("a1", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fake.Versions(bucket, "chunks/a1"); n != 2 {
+		t.Fatalf("overwrite left %d versions, want 2", n)
+	}
+
+	if err := store.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Versions(bucket, "chunks/a1"); n != 0 {
+		t.Fatalf("%d versions left after the delete", n)
+	}
+	if err := store.Delete("a1"); err != chunkstore.ErrNotFound {
+		t.Fatalf("second delete returned %v, want ErrNotFound", err)
+	}
+
+	// a delete without version IDs only hides the data
+	plain := newStore(t, fake.URL(), nil)
+	if err := plain.Put("b2", []byte("hidden")); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Delete("b2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := plain.Has("b2"); ok {
+		t.Fatal("object is still visible behind a delete marker")
+	}
+	if n := fake.Versions(bucket, "chunks/b2"); n != 2 {
+		t.Fatalf("plain delete left %d versions, want the object and a marker", n)
+	}
+
+	// which the versioned store clears, though nothing was there to delete
+	if err := store.Delete("b2"); err != chunkstore.ErrNotFound {
+		t.Fatalf("delete behind a marker returned %v, want ErrNotFound", err)
+	}
+	if n := fake.Versions(bucket, "chunks/b2"); n != 0 {
+		t.Fatalf("%d versions left behind the marker", n)
+	}
+}
+
+func TestListVersionsPages(t *testing.T) {
+	fake := startFake(t)
+	fake.EnableVersioning(bucket)
+	store := newStore(t, fake.URL(), func(config *s3store.Config) {
+		config.Versioned = true
+	})
+
+	// more versions than a page holds, next to a key sharing the prefix
+	for i := 0; i < 2500; i++ {
+		fake.SetObject(bucket, "chunks/a1", []byte{byte(i)})
+	}
+	fake.SetObject(bucket, "chunks/a1.repair", []byte{1})
+
+	if err := store.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Versions(bucket, "chunks/a1"); n != 0 {
+		t.Fatalf("%d versions left after the delete", n)
+	}
+	if _, ok := fake.Object(bucket, "chunks/a1.repair"); !ok {
+		t.Fatal("delete removed a key it shares a prefix with")
+	}
+}
+
+func TestObjectLockValidate(t *testing.T) {
+	for _, lock := range []s3store.ObjectLock{{Mode: "LEGAL", Days: 1}, {Mode: "GOVERNANCE", Days: 0}} {
+		config := s3store.Config{Endpoint: "http://localhost", Bucket: bucket, ObjectLock: &lock}
+		if _, err := s3store.NewStore(config); err == nil {
+			t.Fatalf("object lock %+v was accepted", lock)
+		}
+	}
+}
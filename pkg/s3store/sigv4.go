@@ -0,0 +1,173 @@
+package s3store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	algorithm     = "AWS4-HMAC-SHA256"
+	service       = "s3"
+)
+
+// signed with any x-amz-* headers and Content-MD5
+var signedHeaders = []string{"host", "x-amz-content-sha256", "x-amz-date"}
+
+// headersToSign returns the sorted names of the headers signed for req
+func headersToSign(req *http.Request) []string {
+	names := append([]string{}, signedHeaders...)
+
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "x-amz-content-sha256" || lower == "x-amz-date" {
+			continue
+		}
+
+		if lower == "content-md5" || strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes as SigV4 requires, keeping '/' in paths
+func uriEncode(s string, path bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, false)+"="+uriEncode(value, false))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+func signature(req *http.Request, secretKey, region, amzDate string) string {
+	names := headersToSign(req)
+
+	headers := []string{}
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+
+		headers = append(headers, name+":"+strings.TrimSpace(value)+"\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, true),
+		canonicalQuery(req.URL.Query()),
+		strings.Join(headers, ""),
+		strings.Join(names, ";"),
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+
+	stringToSign := strings.Join([]string{
+		algorithm,
+		amzDate,
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// Sign adds SigV4 headers for a body with the given SHA-256
+func Sign(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, accessKey, scope, strings.Join(headersToSign(req), ";"), signature(req, secretKey, region, amzDate)))
+}
+
+// Verify checks a request signed by Sign
+func Verify(req *http.Request, accessKey, secretKey, region string) error {
+	auth := req.Header.Get("Authorization")
+	amzDate := req.Header.Get("x-amz-date")
+
+	if !strings.HasPrefix(auth, algorithm+" ") || len(amzDate) != len(amzDateFormat) {
+		return fmt.Errorf("request is not signed")
+	}
+
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+
+	if !strings.HasPrefix(fields["Credential"], accessKey+"/") {
+		return fmt.Errorf("unknown access key")
+	}
+
+	expected := signature(req, secretKey, region, amzDate)
+	if !hmac.Equal([]byte(fields["Signature"]), []byte(expected)) {
+		return fmt.Errorf("signature does not match")
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+package serve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// Client is a ChunkStore over a pair of streams, with the remote index
+type Client struct {
+	mu     sync.Mutex
+	r      *bufio.Reader
+	w      *bufio.Writer
+	closer io.Closer
+	cmd    *exec.Cmd
+}
+
+// NewClient performs the handshake over r and w, closing w on Close
+func NewClient(r io.Reader, w io.WriteCloser) (*Client, error) {
+	client := &Client{
+		r:      bufio.NewReader(r),
+		w:      bufio.NewWriter(w),
+		closer: w,
+	}
+
+	if _, err := client.w.WriteString(handshake); err != nil {
+		return nil, err
+	}
+	if err := client.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	line, err := client.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("serve: handshake: %w", err)
+	} else if line != handshake {
+		return nil, fmt.Errorf("serve: unexpected handshake %q", line)
+	}
+
+	return client, nil
+}
+
+// Dial runs command, e.g. ssh host fastcdc serve, over its stdin and stdout
+func Dial(command []string) (*Client, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("serve: empty command")
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(stdout, stdin)
+	if err != nil {
+		stdin.Close()
+		cmd.Wait()
+		return nil, err
+	}
+	client.cmd = cmd
+
+	return client, nil
+}
+
+// Close ends the session, waiting for a dialed command to exit
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.closer.Close()
+
+	if c.cmd != nil {
+		if waitErr := c.cmd.Wait(); err == nil {
+			err = waitErr
+		}
+	}
+
+	return err
+}
+
+func (c *Client) call(req *encoder) (*decoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := writeFrame(c.w, req.buf); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	payload, err := readFrame(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{buf: payload}
+
+	switch d.byte() {
+	case statusOK:
+		return d, nil
+	case statusNotFound:
+		return nil, chunkstore.ErrNotFound
+	case statusAppendOnly:
+		return nil, chunkstore.ErrAppendOnly
+	case statusError:
+		message := d.string()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, &RemoteError{Message: message}
+	default:
+		return nil, fmt.Errorf("serve: invalid response status")
+	}
+}
+
+func op(code byte) *encoder {
+	return (&encoder{}).byte(code)
+}
+
+func (c *Client) Put(id string, data []byte) error {
+	_, err := c.call(op(opPut).string(id).bytes(data))
+
+	return err
+}
+
+func (c *Client) Get(id string) ([]byte, error) {
+	d, err := c.call(op(opGet).string(id))
+	if err != nil {
+		return nil, err
+	}
+
+	data := d.bytes()
+
+	return data, d.err
+}
+
+func (c *Client) GetRange(id string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("range [%d, %d) is out of bounds for %s", offset, offset+length, id)
+	}
+
+	d, err := c.call(op(opGetRange).string(id).uint(uint64(offset)).uint(uint64(length)))
+	if err != nil {
+		return nil, err
+	}
+
+	data := d.bytes()
+
+	return data, d.err
+}
+
+func (c *Client) Has(id string) (bool, error) {
+	d, err := c.call(op(opHas).string(id))
+	if err != nil {
+		return false, err
+	}
+
+	ok := d.byte() == 1
+
+	return ok, d.err
+}
+
+func (c *Client) Delete(id string) error {
+	_, err := c.call(op(opDelete).string(id))
+
+	return err
+}
+
+func (c *Client) List() ([]string, error) {
+	d, err := c.call(op(opList))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := d.strings()
+
+	return ids, d.err
+}
+
+func (c *Client) Stat(id string) (chunkstore.ChunkInfo, error) {
+	d, err := c.call(op(opStat).string(id))
+	if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	}
+
+	size := d.uint()
+
+	return chunkstore.ChunkInfo{ID: id, Size: int64(size)}, d.err
+}
+
+func (c *Client) Missing(ids []string) ([]string, error) {
+	d, err := c.call(op(opMissing).strings(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	missing := d.strings()
+
+	return missing, d.err
+}
+
+// PutBatch only sends the chunks the remote store is missing
+func (c *Client) PutBatch(objects []chunkstore.Object) error {
+	ids := []string{}
+	for _, object := range objects {
+		ids = append(ids, object.ID)
+	}
+
+	missing, err := c.Missing(ids)
+	if err != nil {
+		return err
+	}
+
+	isMissing := map[string]bool{}
+	for _, id := range missing {
+		isMissing[id] = true
+	}
+
+	uploads := []chunkstore.Object{}
+	for _, object := range objects {
+		if isMissing[object.ID] {
+			uploads = append(uploads, object)
+			delete(isMissing, object.ID)
+		}
+	}
+
+	// keep every request well below the frame limit
+	for start := 0; start < len(uploads); {
+		end, size := start, 0
+		for end < len(uploads) && (end == start || size+len(uploads[end].Data) <= maxFrameSize/4) {
+			size += len(uploads[end].Data)
+			end++
+		}
+
+		req := op(opPutBatch).uint(uint64(end - start))
+		for _, object := range uploads[start:end] {
+			req.string(object.ID).bytes(object.Data)
+		}
+
+		if _, err := c.call(req); err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+func (c *Client) Flush() error {
+	_, err := c.call(op(opFlush))
+
+	return err
+}
+
+// IndexMissing returns the checksums the remote index has no entry for
+func (c *Client) IndexMissing(checksums []string) ([]string, error) {
+	d, err := c.call(op(opIndexMissing).strings(checksums))
+	if err != nil {
+		return nil, err
+	}
+
+	missing := d.strings()
+
+	return missing, d.err
+}
+
+// IndexAcquire adds a reference to each checksum in the remote index
+func (c *Client) IndexAcquire(checksums []string) error {
+	_, err := c.call(op(opIndexAcquire).strings(checksums))
+
+	return err
+}
+
+// IndexRelease drops a reference and returns the remaining count
+func (c *Client) IndexRelease(checksum string) (int64, error) {
+	d, err := c.call(op(opIndexRelease).string(checksum))
+	if err != nil {
+		return 0, err
+	}
+
+	count := d.uint()
+
+	return int64(count), d.err
+}
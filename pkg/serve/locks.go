@@ -0,0 +1,79 @@
+package serve
+
+import (
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// lockStore is the remote lock store
+type lockStore struct {
+	c *Client
+}
+
+// Locks returns the remote lock store, closing it ends the session
+func (c *Client) Locks() chunkstore.ChunkStore {
+	return &lockStore{c: c}
+}
+
+func lockOp(code byte) *encoder {
+	return op(opLocks).byte(code)
+}
+
+func (s *lockStore) Put(id string, data []byte) error {
+	_, err := s.c.call(lockOp(opPut).string(id).bytes(data))
+
+	return err
+}
+
+func (s *lockStore) Get(id string) ([]byte, error) {
+	d, err := s.c.call(lockOp(opGet).string(id))
+	if err != nil {
+		return nil, err
+	}
+
+	data := d.bytes()
+
+	return data, d.err
+}
+
+func (s *lockStore) Has(id string) (bool, error) {
+	d, err := s.c.call(lockOp(opHas).string(id))
+	if err != nil {
+		return false, err
+	}
+
+	ok := d.byte() == 1
+
+	return ok, d.err
+}
+
+func (s *lockStore) Delete(id string) error {
+	_, err := s.c.call(lockOp(opDelete).string(id))
+
+	return err
+}
+
+func (s *lockStore) List() ([]string, error) {
+	d, err := s.c.call(lockOp(opList))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := d.strings()
+
+	return ids, d.err
+}
+
+func (s *lockStore) Stat(id string) (chunkstore.ChunkInfo, error) {
+	d, err := s.c.call(lockOp(opStat).string(id))
+	if err != nil {
+		return chunkstore.ChunkInfo{}, err
+	}
+
+	size := d.uint()
+
+	return chunkstore.ChunkInfo{ID: id, Size: int64(size)}, d.err
+}
+
+func (s *lockStore) Close() error {
+	return s.c.Close()
+}
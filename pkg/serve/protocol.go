@@ -0,0 +1,191 @@
+package serve
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// both sides open with this line, so a shell banner fails fast
+const handshake = "FASTCDC-SERVE 1\n"
+
+// frames are a big-endian uint32 length and a payload led by an op or status byte
+const maxFrameSize = 256 << 20
+
+const (
+	opPut byte = iota + 1
+	opGet
+	opGetRange
+	opHas
+	opDelete
+	opList
+	opStat
+	opMissing
+	opPutBatch
+	opFlush
+	opIndexMissing
+	opIndexAcquire
+	opIndexRelease
+
+	// followed by one of the store ops above, applied to the lock store
+	opLocks
+)
+
+const (
+	statusOK byte = iota
+	statusNotFound
+	statusError
+	statusAppendOnly
+)
+
+var errFrameTooLarge = errors.New("serve: frame too large")
+
+func writeFrame(w io.Writer, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return errFrameTooLarge
+	}
+
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(payload)
+
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// encoder builds a payload out of uvarints and length-prefixed byte strings
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) byte(b byte) *encoder {
+	e.buf = append(e.buf, b)
+	return e
+}
+
+func (e *encoder) uint(n uint64) *encoder {
+	e.buf = binary.AppendUvarint(e.buf, n)
+	return e
+}
+
+func (e *encoder) bytes(b []byte) *encoder {
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+	return e
+}
+
+func (e *encoder) string(s string) *encoder {
+	return e.bytes([]byte(s))
+}
+
+func (e *encoder) strings(ss []string) *encoder {
+	e.uint(uint64(len(ss)))
+	for _, s := range ss {
+		e.string(s)
+	}
+	return e
+}
+
+// decoder reads a payload written by encoder, the first error sticks
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errShortPayload = errors.New("serve: truncated payload")
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+
+	return b
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	n, size := binary.Uvarint(d.buf)
+	if size <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[size:]
+
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint()
+	if d.err != nil || uint64(len(d.buf)) < n {
+		d.fail()
+		return nil
+	}
+
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) strings() []string {
+	n := d.uint()
+	if d.err != nil || n > uint64(len(d.buf)) { // every string takes at least a byte
+		d.fail()
+		return nil
+	}
+
+	ss := make([]string, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		ss = append(ss, d.string())
+	}
+
+	return ss
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errShortPayload
+	}
+}
+
+// RemoteError is an error reported by the serving side
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("serve: remote: %s", e.Message)
+}
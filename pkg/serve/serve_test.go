@@ -0,0 +1,286 @@
+package serve
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/lock"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+// connect serves store and index over a pair of pipes and returns the client
+func connect(t *testing.T, store chunkstore.ChunkStore, withIndex bool) *Client {
+	var server *Server
+	if withIndex {
+		db, err := sqlitechunks.OpenDB(filepath.Join(t.TempDir(), "chunks.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		if err := sqlitechunks.CreateTable(db); err != nil {
+			t.Fatal(err)
+		}
+		server = NewServer(store, db)
+	} else {
+		server = NewServer(store, nil)
+	}
+
+	return connectServer(t, server)
+}
+
+// connectServer serves server over a pair of pipes and returns the client
+func connectServer(t *testing.T, server *Server) *Client {
+	requests, requestWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseReader, responses, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := server.Serve(requests, responses)
+		responses.Close()
+		done <- err
+	}()
+
+	client, err := NewClient(responseReader, requestWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		if err := <-done; err != nil {
+			t.Errorf("server: %v", err)
+		}
+		requests.Close()
+		responseReader.Close()
+	})
+
+	return client
+}
+
+func TestRoundTrip(t *testing.T) {
+	store := chunkstore.NewMemoryStore()
+	client := connect(t, store, false)
+
+	if err := client.Put("a1", []byte("hello serve")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := client.Get("a1")
+	if err != nil || string(data) != "hello serve" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	part, err := client.GetRange("a1", 6, 5)
+	if err != nil || string(part) != "serve" {
+		t.Fatalf("range read %q, %v", part, err)
+	}
+
+	info, err := client.Stat("a1")
+	if err != nil || info.Size != 11 {
+		t.Fatalf("stat returned %+v, %v", info, err)
+	}
+
+	err = client.PutBatch([]chunkstore.Object{
+		{ID: "a1", Data: []byte("hello serve")},
+		{ID: "b2", Data: []byte("b")},
+		{ID: "c3", Data: []byte("c")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := client.Missing([]string{"a1", "b2", "d4"})
+	if err != nil || !reflect.DeepEqual(missing, []string{"d4"}) {
+		t.Fatalf("missing %v, %v", missing, err)
+	}
+
+	if ok, err := client.Has("c3"); !ok || err != nil {
+		t.Fatalf("has returned %v, %v", ok, err)
+	}
+
+	if err := client.Delete("b2"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := client.List()
+	if err != nil || !reflect.DeepEqual(ids, []string{"a1", "c3"}) {
+		t.Fatalf("listed %v, %v", ids, err)
+	}
+
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorFrames(t *testing.T) {
+	client := connect(t, chunkstore.NewAppendOnlyStore(chunkstore.NewMemoryStore()), false)
+
+	if _, err := client.Get("a1"); err != chunkstore.ErrNotFound {
+		t.Fatalf("get of a missing chunk returned %v, want ErrNotFound", err)
+	}
+	if ok, err := client.Has("a1"); ok || err != nil {
+		t.Fatalf("has of a missing chunk returned %v, %v", ok, err)
+	}
+
+	if err := client.Put("a1", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete("a1"); err != chunkstore.ErrAppendOnly {
+		t.Fatalf("delete from an append-only store returned %v, want ErrAppendOnly", err)
+	}
+
+	var remote *RemoteError
+	if _, err := client.GetRange("a1", 2, 10); !errors.As(err, &remote) {
+		t.Fatalf("range past the end returned %v, want a RemoteError", err)
+	}
+
+	if _, err := client.call(op(255)); !errors.As(err, &remote) {
+		t.Fatalf("unknown op returned %v, want a RemoteError", err)
+	}
+
+	// a truncated request is reported, the session carries on
+	if _, err := client.call(op(opPut)); !errors.As(err, &remote) {
+		t.Fatalf("truncated request returned %v, want a RemoteError", err)
+	}
+
+	if _, err := client.IndexMissing([]string{"a1"}); !errors.As(err, &remote) {
+		t.Fatalf("index request without an index returned %v, want a RemoteError", err)
+	}
+
+	if data, err := client.Get("a1"); err != nil || string(data) != "data" {
+		t.Fatalf("got %q, %v after the errors", data, err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	client := connect(t, chunkstore.NewMemoryStore(), true)
+
+	if err := client.IndexAcquire([]string{"a1", "a1", "b2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := client.IndexMissing([]string{"a1", "b2", "c3"})
+	if err != nil || !reflect.DeepEqual(missing, []string{"c3"}) {
+		t.Fatalf("missing %v, %v", missing, err)
+	}
+
+	count, err := client.IndexRelease("a1")
+	if err != nil || count != 1 {
+		t.Fatalf("release returned %d, %v", count, err)
+	}
+
+	if _, err := client.IndexRelease("c3"); err != chunkstore.ErrNotFound {
+		t.Fatalf("release of an unknown checksum returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestHandshakeMismatch(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	go func() {
+		io.WriteString(w, "Welcome to the backup host\n")
+		w.Close()
+	}()
+
+	if _, err := NewClient(r, nopCloser{io.Discard}); err == nil {
+		t.Fatal("client accepted a shell banner as the handshake")
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func TestLocks(t *testing.T) {
+	locks := chunkstore.NewMemoryStore()
+	server := NewServer(chunkstore.NewMemoryStore(), nil)
+	server.EnableLocks(locks)
+
+	remote := connectServer(t, server).Locks()
+
+	if err := remote.Put("a1b2-1", []byte("lock")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := locks.Get("a1b2-1"); string(data) != "lock" {
+		t.Fatalf("server's lock store holds %q", data)
+	}
+
+	if names, err := remote.List(); err != nil || !reflect.DeepEqual(names, []string{"a1b2-1"}) {
+		t.Fatalf("listed %v, %v", names, err)
+	}
+	if data, err := remote.Get("a1b2-1"); err != nil || string(data) != "lock" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if info, err := remote.Stat("a1b2-1"); err != nil || info.Size != 4 {
+		t.Fatalf("stat returned %+v, %v", info, err)
+	}
+
+	if err := remote.Delete("a1b2-1"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := remote.Has("a1b2-1"); err != nil || ok {
+		t.Fatalf("deleted lock is still there: %v, %v", ok, err)
+	}
+	if _, err := remote.Get("a1b2-1"); err != chunkstore.ErrNotFound {
+		t.Fatalf("get of a deleted lock returned %v", err)
+	}
+
+	if err := remote.Put("../chunks", []byte("lock")); err == nil {
+		t.Fatal("invalid lock name was accepted")
+	}
+}
+
+func TestExclusiveLockThroughServer(t *testing.T) {
+	locks := chunkstore.NewMemoryStore()
+
+	opt := lock.Options{}
+	opt.SetDefaults()
+	opt.Wait = 0
+
+	// the serve session's own lock
+	held, err := lock.Acquire(locks, false, "serve 1", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	server := NewServer(chunkstore.NewMemoryStore(), nil)
+	server.EnableLocks(lock.Hide(locks, held))
+
+	gc, err := lock.Acquire(connectServer(t, server).Locks(), true, "gc", opt)
+	if err != nil {
+		t.Fatalf("exclusive lock through the server: %v", err)
+	}
+
+	if _, err := lock.Acquire(connectServer(t, server).Locks(), false, "watcher", opt); !errors.Is(err, lock.ErrLocked) {
+		t.Fatalf("locking alongside an exclusive client lock returned %v, want ErrLocked", err)
+	}
+
+	if err := gc.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := locks.Has(held.Lock().ID + "-1"); err != nil || !ok {
+		t.Fatalf("the server's own lock was removed: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,313 @@
+package serve
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"fastcdc-backup/pkg/chunkstore"
+	"fastcdc-backup/pkg/sqlite-chunks"
+)
+
+// Server serves a chunk store and index over a pair of streams
+type Server struct {
+	store chunkstore.ChunkStore
+	db    *sql.DB
+
+	// the repository's lock store, so clients lock it through the server
+	locks chunkstore.ChunkStore
+}
+
+func NewServer(store chunkstore.ChunkStore, db *sql.DB) *Server {
+	server := &Server{
+		store: store,
+		db:    db,
+	}
+	return server
+}
+
+// EnableLocks serves the repository's locks as well
+func (s *Server) EnableLocks(locks chunkstore.ChunkStore) {
+	s.locks = locks
+}
+
+// Serve handles requests until the client closes r
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	} else if line != handshake {
+		return fmt.Errorf("serve: unexpected handshake %q", line)
+	}
+
+	if _, err := bw.WriteString(handshake); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		payload, err := readFrame(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := writeFrame(bw, s.handle(payload)); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func errorResponse(err error) []byte {
+	if err == chunkstore.ErrNotFound {
+		return (&encoder{}).byte(statusNotFound).buf
+	} else if err == chunkstore.ErrAppendOnly {
+		return (&encoder{}).byte(statusAppendOnly).buf
+	}
+
+	return (&encoder{}).byte(statusError).string(err.Error()).buf
+}
+
+func (s *Server) handle(payload []byte) []byte {
+	d := &decoder{buf: payload}
+	op := d.byte()
+
+	resp, err := s.dispatch(op, d)
+	if err == nil && d.err != nil {
+		err = d.err
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return append([]byte{statusOK}, resp.buf...)
+}
+
+func (s *Server) index() (*sql.DB, error) {
+	if s.db == nil {
+		return nil, errors.New("no index is being served")
+	}
+
+	return s.db, nil
+}
+
+func (s *Server) dispatch(op byte, d *decoder) (*encoder, error) {
+	resp := &encoder{}
+
+	switch op {
+	case opPut:
+		id, data := d.string(), d.bytes()
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		return resp, s.store.Put(id, data)
+
+	case opGet:
+		data, err := s.store.Get(d.string())
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.bytes(data), nil
+
+	case opGetRange:
+		id, offset, length := d.string(), d.uint(), d.uint()
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		data, err := chunkstore.GetRange(s.store, id, int64(offset), int64(length))
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.bytes(data), nil
+
+	case opHas:
+		ok, err := s.store.Has(d.string())
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return resp.byte(1), nil
+		}
+		return resp.byte(0), nil
+
+	case opDelete:
+		return resp, s.store.Delete(d.string())
+
+	case opList:
+		ids, err := s.store.List()
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.strings(ids), nil
+
+	case opStat:
+		info, err := s.store.Stat(d.string())
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.uint(uint64(info.Size)), nil
+
+	case opMissing:
+		missing, err := chunkstore.Missing(s.store, d.strings())
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.strings(missing), nil
+
+	case opPutBatch:
+		n := d.uint()
+		objects := []chunkstore.Object{}
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			objects = append(objects, chunkstore.Object{ID: d.string(), Data: d.bytes()})
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		return resp, chunkstore.PutBatch(s.store, objects)
+
+	case opFlush:
+		if flusher, ok := s.store.(chunkstore.Flusher); ok {
+			return resp, flusher.Flush()
+		}
+
+		return resp, nil
+
+	case opIndexMissing:
+		db, err := s.index()
+		if err != nil {
+			return nil, err
+		}
+
+		missing, err := sqlitechunks.Missing(db, d.strings())
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.strings(missing), nil
+
+	case opIndexAcquire:
+		db, err := s.index()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, checksum := range d.strings() {
+			if sqlitechunks.Exists(db, checksum) {
+				sqlitechunks.IncreaseCount(db, checksum)
+			} else {
+				sqlitechunks.InsertChunk(db, checksum)
+			}
+		}
+
+		return resp, nil
+
+	case opIndexRelease:
+		db, err := s.index()
+		if err != nil {
+			return nil, err
+		}
+
+		checksum := d.string()
+		if !sqlitechunks.Exists(db, checksum) {
+			return nil, chunkstore.ErrNotFound
+		}
+
+		sqlitechunks.DecreaseCount(db, checksum)
+
+		return resp.uint(uint64(sqlitechunks.GetCount(db, checksum))), nil
+
+	case opLocks:
+		if s.locks == nil {
+			return nil, errors.New("no lock store is being served")
+		}
+
+		return serveLock(s.locks, d.byte(), d)
+
+	default:
+		return nil, fmt.Errorf("unknown op %d", op)
+	}
+}
+
+// serveLock applies a store op to the lock store
+func serveLock(locks chunkstore.ChunkStore, op byte, d *decoder) (*encoder, error) {
+	resp := &encoder{}
+
+	if op == opList {
+		ids, err := locks.List()
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.strings(ids), nil
+	}
+
+	name := d.string()
+	if d.err != nil {
+		return nil, d.err
+	} else if !chunkstore.ValidID(name) {
+		return nil, fmt.Errorf("invalid lock object %q", name)
+	}
+
+	switch op {
+	case opPut:
+		data := d.bytes()
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		return resp, locks.Put(name, data)
+
+	case opGet:
+		data, err := locks.Get(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.bytes(data), nil
+
+	case opHas:
+		ok, err := locks.Has(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return resp.byte(1), nil
+		}
+		return resp.byte(0), nil
+
+	case opDelete:
+		return resp, locks.Delete(name)
+
+	case opStat:
+		info, err := locks.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.uint(uint64(info.Size)), nil
+
+	default:
+		return nil, fmt.Errorf("unknown lock op %d", op)
+	}
+}
@@ -0,0 +1,72 @@
+package sqlitechunks
+
+import (
+	"database/sql"
+)
+
+// CreateCandidateTable holds unreferenced chunks and since when
+func CreateCandidateTable(db *sql.DB) error {
+	const create string = `
+	CREATE TABLE IF NOT EXISTS gc_candidates (
+		checksum TEXT NOT NULL PRIMARY KEY,
+		since INTEGER NOT NULL
+	);`
+
+	_, err := db.Exec(create)
+
+	return err
+}
+
+func ListCandidates(db *sql.DB) (map[string]int64, error) {
+	const query = `
+	SELECT checksum, since FROM gc_candidates;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := map[string]int64{}
+	for rows.Next() {
+		var checksum string
+		var since int64
+		if err := rows.Scan(&checksum, &since); err != nil {
+			return nil, err
+		}
+
+		candidates[checksum] = since
+	}
+
+	return candidates, rows.Err()
+}
+
+// ReplaceCandidates swaps the candidates for a new set in one transaction
+func ReplaceCandidates(db *sql.DB, candidates map[string]int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const delete = `
+	DELETE FROM gc_candidates;
+	`
+
+	if _, err := tx.Exec(delete); err != nil {
+		return err
+	}
+
+	const insert = `
+	INSERT INTO gc_candidates (checksum, since) VALUES (?, ?);
+	`
+
+	for checksum, since := range candidates {
+		if _, err := tx.Exec(insert, checksum, since); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package sqlitechunks
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "chunks.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := CreateTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateSizeTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestReplaceCandidates(t *testing.T) {
+	db := openDB(t)
+
+	if err := CreateCandidateTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReplaceCandidates(db, map[string]int64{"a1": 10, "b2": 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplaceCandidates(db, map[string]int64{"b2": 20, "c3": 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates, err := ListCandidates(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 || candidates["b2"] != 20 || candidates["c3"] != 30 {
+		t.Fatalf("candidates are %v, want b2 and c3", candidates)
+	}
+}
+
+func TestReplaceCounts(t *testing.T) {
+	db := openDB(t)
+
+	for _, checksum := range []string{"a1", "a1", "b2", "c3"} {
+		if err := AddReference(db, checksum); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ReplaceCounts(db, map[string]int64{"a1": 1, "b2": 1, "d4": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := ListCounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{"a1": 1, "b2": 1, "d4": 3}
+	if len(counts) != len(want) {
+		t.Fatalf("counts are %v, want %v", counts, want)
+	}
+	for checksum, count := range want {
+		if counts[checksum] != count {
+			t.Fatalf("counts are %v, want %v", counts, want)
+		}
+	}
+}
+
+func TestReleaseRemovesLastReference(t *testing.T) {
+	db := openDB(t)
+
+	AddReference(db, "a1")
+	AddReference(db, "a1")
+
+	if instances, err := Release(db, "a1"); err != nil || instances != 1 {
+		t.Fatalf("first release left %d, %v", instances, err)
+	}
+	if instances, err := Release(db, "a1"); err != nil || instances != 0 {
+		t.Fatalf("second release left %d, %v", instances, err)
+	}
+	if Exists(db, "a1") {
+		t.Fatal("chunk without references is still indexed")
+	}
+}
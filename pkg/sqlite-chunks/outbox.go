@@ -0,0 +1,222 @@
+package sqlitechunks
+
+import (
+	"database/sql"
+)
+
+// OutboxEntry is a queued change to the store, applied strictly in Seq order
+type OutboxEntry struct {
+	Seq         int64
+	Op          string
+	Checksum    string
+	Data        []byte
+	QueuedAt    int64
+	Attempts    int
+	NextAttempt int64
+	LastError   string
+}
+
+func CreateOutboxTable(db *sql.DB) error {
+	const create string = `
+	CREATE TABLE IF NOT EXISTS outbox (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		op TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		data BLOB,
+		queued_at INTEGER NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS outbox_checksum ON outbox (checksum);
+	`
+
+	_, err := db.Exec(create)
+
+	return err
+}
+
+// Enqueue appends entries to the outbox in a single transaction
+func Enqueue(db *sql.DB, entries []OutboxEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const insert = `
+	INSERT INTO outbox (op, checksum, data, queued_at) VALUES (?, ?, ?, ?);
+	`
+
+	for _, entry := range entries {
+		if _, err := tx.Exec(insert, entry.Op, entry.Checksum, entry.Data, entry.QueuedAt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func scanOutbox(rows *sql.Rows) ([]OutboxEntry, error) {
+	defer rows.Close()
+
+	entries := []OutboxEntry{}
+	for rows.Next() {
+		entry := OutboxEntry{}
+		err := rows.Scan(&entry.Seq, &entry.Op, &entry.Checksum, &entry.Data, &entry.QueuedAt, &entry.Attempts, &entry.NextAttempt, &entry.LastError)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// OutboxHead returns the oldest entries still queued
+func OutboxHead(db *sql.DB, limit int) ([]OutboxEntry, error) {
+	const query = `
+	SELECT seq, op, checksum, data, queued_at, attempts, next_attempt, last_error
+	FROM outbox ORDER BY seq LIMIT ?;
+	`
+
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanOutbox(rows)
+}
+
+// LatestOutboxEntry returns sql.ErrNoRows when nothing is queued for checksum
+func LatestOutboxEntry(db *sql.DB, checksum string) (OutboxEntry, error) {
+	const query = `
+	SELECT seq, op, checksum, data, queued_at, attempts, next_attempt, last_error
+	FROM outbox WHERE checksum = ? ORDER BY seq DESC LIMIT 1;
+	`
+
+	rows, err := db.Query(query, checksum)
+	if err != nil {
+		return OutboxEntry{}, err
+	}
+
+	entries, err := scanOutbox(rows)
+	if err != nil {
+		return OutboxEntry{}, err
+	} else if len(entries) == 0 {
+		return OutboxEntry{}, sql.ErrNoRows
+	}
+
+	return entries[0], nil
+}
+
+// LatestOutboxOps returns the last op queued for every checksum in the outbox
+func LatestOutboxOps(db *sql.DB) (map[string]string, error) {
+	const query = `
+	SELECT checksum, op FROM outbox ORDER BY seq;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ops := map[string]string{}
+	for rows.Next() {
+		var checksum, op string
+		if err := rows.Scan(&checksum, &op); err != nil {
+			return nil, err
+		}
+
+		ops[checksum] = op
+	}
+
+	return ops, rows.Err()
+}
+
+// ConfirmOutbox removes entries that have been applied to the store
+func ConfirmOutbox(db *sql.DB, seqs []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const delete = `
+	DELETE FROM outbox WHERE seq = ?;
+	`
+
+	for _, seq := range seqs {
+		if _, err := tx.Exec(delete, seq); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeferOutbox records a failed attempt and when to try again
+func DeferOutbox(db *sql.DB, seq int64, nextAttempt int64, lastError string) error {
+	const update = `
+	UPDATE outbox
+	SET attempts = attempts + 1, next_attempt = ?, last_error = ?
+	WHERE seq = ?;
+	`
+
+	_, err := db.Exec(update, nextAttempt, lastError, seq)
+
+	return err
+}
+
+// RetryOutbox clears the backoff so the next drain tries straight away
+func RetryOutbox(db *sql.DB) error {
+	const update = `
+	UPDATE outbox SET next_attempt = 0;
+	`
+
+	_, err := db.Exec(update)
+
+	return err
+}
+
+// OutboxBacklog summarizes what is still waiting to be applied
+type OutboxBacklog struct {
+	Puts        int
+	Deletes     int
+	Bytes       int64
+	Oldest      int64
+	Attempts    int
+	NextAttempt int64
+	LastError   string
+}
+
+func GetOutboxBacklog(db *sql.DB) (OutboxBacklog, error) {
+	const totals = `
+	SELECT
+		COALESCE(SUM(CASE WHEN op = 'put' THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN op = 'delete' THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(LENGTH(data)), 0),
+		COALESCE(MIN(queued_at), 0)
+	FROM outbox;
+	`
+
+	backlog := OutboxBacklog{}
+	err := db.QueryRow(totals).Scan(&backlog.Puts, &backlog.Deletes, &backlog.Bytes, &backlog.Oldest)
+	if err != nil {
+		return backlog, err
+	}
+
+	// the head blocks everything behind it, its retry state is the backlog's
+	const head = `
+	SELECT attempts, next_attempt, last_error FROM outbox ORDER BY seq LIMIT 1;
+	`
+
+	err = db.QueryRow(head).Scan(&backlog.Attempts, &backlog.NextAttempt, &backlog.LastError)
+	if err == sql.ErrNoRows {
+		return backlog, nil
+	}
+
+	return backlog, err
+}
@@ -0,0 +1,246 @@
+package sqlitechunks
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Location is where a chunk's bytes live inside a pack file
+type Location struct {
+	Checksum string
+	PackID   string
+	Offset   int64
+	Length   int64
+}
+
+func CreatePackTables(db *sql.DB) error {
+	const create string = `
+	CREATE TABLE IF NOT EXISTS packs (
+		id TEXT NOT NULL PRIMARY KEY,
+		size INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS pack_entries (
+		checksum TEXT NOT NULL PRIMARY KEY,
+		pack_id TEXT NOT NULL,
+		pack_offset INTEGER NOT NULL,
+		pack_length INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS pack_entries_pack_id ON pack_entries (pack_id);
+	CREATE TABLE IF NOT EXISTS pack_parity (
+		pack_id TEXT NOT NULL PRIMARY KEY,
+		size INTEGER NOT NULL,
+		shard_size INTEGER NOT NULL,
+		data_shards INTEGER NOT NULL,
+		parity_shards INTEGER NOT NULL,
+		hashes BLOB NOT NULL
+	);
+	`
+
+	_, err := db.Exec(create)
+
+	return err
+}
+
+// AddPack records a newly written pack and the location of every chunk in it
+func AddPack(db *sql.DB, packID string, size int64, locations []Location) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const insertPack = `
+	INSERT OR REPLACE INTO packs (id, size) VALUES (?, ?);
+	`
+
+	if _, err := tx.Exec(insertPack, packID, size); err != nil {
+		return err
+	}
+
+	const insertEntry = `
+	INSERT OR REPLACE INTO pack_entries (checksum, pack_id, pack_offset, pack_length) VALUES (?, ?, ?, ?);
+	`
+
+	for _, location := range locations {
+		if _, err := tx.Exec(insertEntry, location.Checksum, packID, location.Offset, location.Length); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func GetLocation(db *sql.DB, checksum string) (Location, error) {
+	const query = `
+	SELECT pack_id, pack_offset, pack_length FROM pack_entries WHERE checksum = ?;
+	`
+
+	location := Location{Checksum: checksum}
+	err := db.QueryRow(query, checksum).Scan(&location.PackID, &location.Offset, &location.Length)
+
+	return location, err
+}
+
+// DeleteLocation drops a chunk from the pack index, its bytes stay until repack
+func DeleteLocation(db *sql.DB, checksum string) error {
+	const delete = `
+	DELETE FROM pack_entries WHERE checksum = ?;
+	`
+
+	_, err := db.Exec(delete, checksum)
+
+	return err
+}
+
+func ListLocations(db *sql.DB) ([]Location, error) {
+	const query = `
+	SELECT checksum, pack_id, pack_offset, pack_length FROM pack_entries ORDER BY checksum;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := []Location{}
+	for rows.Next() {
+		location := Location{}
+		if err := rows.Scan(&location.Checksum, &location.PackID, &location.Offset, &location.Length); err != nil {
+			return nil, err
+		}
+
+		locations = append(locations, location)
+	}
+
+	return locations, rows.Err()
+}
+
+// PackUsage compares a pack's size with the bytes still referenced in it
+type PackUsage struct {
+	PackID string
+	Size   int64
+	Live   int64
+}
+
+func (u PackUsage) DeadFraction() float64 {
+	if u.Size == 0 {
+		return 0
+	}
+
+	return 1 - float64(u.Live)/float64(u.Size)
+}
+
+func ListPackUsage(db *sql.DB) ([]PackUsage, error) {
+	const query = `
+	SELECT packs.id, packs.size, COALESCE(SUM(pack_entries.pack_length), 0)
+	FROM packs LEFT JOIN pack_entries ON pack_entries.pack_id = packs.id
+	GROUP BY packs.id
+	ORDER BY packs.id;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []PackUsage{}
+	for rows.Next() {
+		u := PackUsage{}
+		if err := rows.Scan(&u.PackID, &u.Size, &u.Live); err != nil {
+			return nil, err
+		}
+
+		usage = append(usage, u)
+	}
+
+	return usage, rows.Err()
+}
+
+func ListPackEntries(db *sql.DB, packID string) ([]Location, error) {
+	const query = `
+	SELECT checksum, pack_id, pack_offset, pack_length FROM pack_entries WHERE pack_id = ? ORDER BY pack_offset;
+	`
+
+	rows, err := db.Query(query, packID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := []Location{}
+	for rows.Next() {
+		location := Location{}
+		if err := rows.Scan(&location.Checksum, &location.PackID, &location.Offset, &location.Length); err != nil {
+			return nil, err
+		}
+
+		locations = append(locations, location)
+	}
+
+	return locations, rows.Err()
+}
+
+// DeletePack removes a pack that no chunk is located in anymore
+func DeletePack(db *sql.DB, packID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const count = `
+	SELECT COUNT(*) FROM pack_entries WHERE pack_id = ?;
+	`
+
+	var entries int64
+	if err := tx.QueryRow(count, packID).Scan(&entries); err != nil {
+		return err
+	} else if entries > 0 {
+		return fmt.Errorf("pack %s still holds %d chunks", packID, entries)
+	}
+
+	const delete = `
+	DELETE FROM packs WHERE id = ?;
+	DELETE FROM pack_parity WHERE pack_id = ?;
+	`
+
+	if _, err := tx.Exec(delete, packID, packID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Parity is a pack's Reed-Solomon parity, Hashes are SHA-256s of data then parity shards
+type Parity struct {
+	PackID       string
+	Size         int64
+	ShardSize    int64
+	DataShards   int
+	ParityShards int
+	Hashes       []byte
+}
+
+func AddParity(db *sql.DB, parity Parity) error {
+	const insert = `
+	INSERT OR REPLACE INTO pack_parity (pack_id, size, shard_size, data_shards, parity_shards, hashes) VALUES (?, ?, ?, ?, ?, ?);
+	`
+
+	_, err := db.Exec(insert, parity.PackID, parity.Size, parity.ShardSize, parity.DataShards, parity.ParityShards, parity.Hashes)
+
+	return err
+}
+
+// GetParity returns sql.ErrNoRows for packs written without parity
+func GetParity(db *sql.DB, packID string) (Parity, error) {
+	const query = `
+	SELECT size, shard_size, data_shards, parity_shards, hashes FROM pack_parity WHERE pack_id = ?;
+	`
+
+	parity := Parity{PackID: packID}
+	err := db.QueryRow(query, packID).Scan(&parity.Size, &parity.ShardSize, &parity.DataShards, &parity.ParityShards, &parity.Hashes)
+
+	return parity, err
+}
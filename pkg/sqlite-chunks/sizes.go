@@ -0,0 +1,113 @@
+package sqlitechunks
+
+import (
+	"database/sql"
+)
+
+// ChunkSize is how large a chunk is and how many bytes the store holds for it
+type ChunkSize struct {
+	Checksum string
+	Size     int64
+	Stored   int64
+}
+
+func CreateSizeTable(db *sql.DB) error {
+	const create string = `
+	CREATE TABLE IF NOT EXISTS chunk_sizes (
+		checksum TEXT NOT NULL PRIMARY KEY,
+		size INTEGER NOT NULL,
+		stored_size INTEGER NOT NULL
+	);`
+
+	_, err := db.Exec(create)
+
+	return err
+}
+
+// SetSizes records the sizes of chunks in a single transaction
+func SetSizes(db *sql.DB, sizes []ChunkSize) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const upsert = `
+	INSERT INTO chunk_sizes (checksum, size, stored_size) VALUES (?, ?, ?)
+	ON CONFLICT (checksum) DO UPDATE SET size = excluded.size, stored_size = excluded.stored_size;
+	`
+
+	for _, size := range sizes {
+		if _, err := tx.Exec(upsert, size.Checksum, size.Size, size.Stored); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListSizes returns the sizes of the indexed chunks that have one
+func ListSizes(db *sql.DB) (map[string]ChunkSize, error) {
+	const query = `
+	SELECT s.checksum, s.size, s.stored_size
+	FROM chunk_sizes s JOIN chunks c ON c.checksum = s.checksum;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := map[string]ChunkSize{}
+	for rows.Next() {
+		size := ChunkSize{}
+		if err := rows.Scan(&size.Checksum, &size.Size, &size.Stored); err != nil {
+			return nil, err
+		}
+
+		sizes[size.Checksum] = size
+	}
+
+	return sizes, rows.Err()
+}
+
+// StoredBytes sums what the store holds for the indexed chunks
+func StoredBytes(db *sql.DB) (int64, error) {
+	const query = `
+	SELECT COALESCE(SUM(s.stored_size), 0)
+	FROM chunk_sizes s JOIN chunks c ON c.checksum = s.checksum;
+	`
+
+	var stored int64
+	err := db.QueryRow(query).Scan(&stored)
+
+	return stored, err
+}
+
+// Unsized returns the indexed chunks whose sizes were never recorded
+func Unsized(db *sql.DB) ([]string, error) {
+	const query = `
+	SELECT c.checksum
+	FROM chunks c LEFT JOIN chunk_sizes s ON s.checksum = c.checksum
+	WHERE s.checksum IS NULL ORDER BY c.checksum;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := []string{}
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return nil, err
+		}
+
+		checksums = append(checksums, checksum)
+	}
+
+	return checksums, rows.Err()
+}
@@ -0,0 +1,152 @@
+package sqlitechunks
+
+import (
+	"database/sql"
+)
+
+func CreateSnapshotTables(db *sql.DB) error {
+	const create string = `
+	CREATE TABLE IF NOT EXISTS snapshot_chunks (
+		snapshot TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		PRIMARY KEY (snapshot, checksum)
+	);
+	CREATE INDEX IF NOT EXISTS snapshot_chunks_checksum ON snapshot_chunks (checksum);
+	`
+
+	_, err := db.Exec(create)
+
+	return err
+}
+
+// ReplaceSnapshot sets the chunks a cached snapshot references
+func ReplaceSnapshot(db *sql.DB, snapshot string, checksums []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const delete = `
+	DELETE FROM snapshot_chunks WHERE snapshot = ?;
+	`
+
+	if _, err := tx.Exec(delete, snapshot); err != nil {
+		return err
+	}
+
+	const insert = `
+	INSERT OR IGNORE INTO snapshot_chunks (snapshot, checksum) VALUES (?, ?);
+	`
+
+	for _, checksum := range checksums {
+		if _, err := tx.Exec(insert, snapshot, checksum); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func DeleteSnapshot(db *sql.DB, snapshot string) error {
+	const delete = `
+	DELETE FROM snapshot_chunks WHERE snapshot = ?;
+	`
+
+	_, err := db.Exec(delete, snapshot)
+
+	return err
+}
+
+func ListSnapshots(db *sql.DB) ([]string, error) {
+	const query = `
+	SELECT DISTINCT snapshot FROM snapshot_chunks ORDER BY snapshot;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []string{}
+	for rows.Next() {
+		var snapshot string
+		if err := rows.Scan(&snapshot); err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, rows.Err()
+}
+
+// InSnapshot reports whether any cached snapshot references checksum
+func InSnapshot(db *sql.DB, checksum string) (bool, error) {
+	const query = `
+	SELECT 1 FROM snapshot_chunks WHERE checksum = ? LIMIT 1;
+	`
+
+	var found int
+	err := db.QueryRow(query, checksum).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ListUnreferenced returns chunks no client and no cached snapshot holds
+func ListUnreferenced(db *sql.DB) ([]string, error) {
+	const query = `
+	SELECT checksum FROM chunks
+	WHERE instance_count <= 0 AND checksum NOT IN (SELECT checksum FROM snapshot_chunks)
+	ORDER BY checksum;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := []string{}
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return nil, err
+		}
+
+		checksums = append(checksums, checksum)
+	}
+
+	return checksums, rows.Err()
+}
+
+// ListSnapshotChunks returns every chunk some cached snapshot references
+func ListSnapshotChunks(db *sql.DB) ([]string, error) {
+	const query = `
+	SELECT DISTINCT checksum FROM snapshot_chunks ORDER BY checksum;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := []string{}
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return nil, err
+		}
+
+		checksums = append(checksums, checksum)
+	}
+
+	return checksums, rows.Err()
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -23,6 +24,19 @@ func OpenDB(dbFile string) (*sql.DB, error) {
 	return db, nil
 }
 
+func CreateTable(db *sql.DB) error {
+	const create string = `
+	CREATE TABLE IF NOT EXISTS chunks (
+		id INTEGER NOT NULL PRIMARY KEY, 
+		checksum TEXT NOT NULL UNIQUE,
+		instance_count INTEGER NOT NULL DEFAULT 1
+	);`
+
+	_, err := db.Exec(create)
+
+	return err
+}
+
 func PopulateDB(db *sql.DB, dataSource string) error {
 	fi, err := os.Open(dataSource)
 	if err != nil {
@@ -80,14 +94,27 @@ func Exists(db *sql.DB, checksum string) bool {
 	return err != sql.ErrNoRows && err == nil
 }
 
+// InsertChunk adds a row for checksum, instance_count starts at 1
 func InsertChunk(db *sql.DB, checksum string) {
 	const insert = `
-	INSERT INTO chunks (instance_count) VALUES (?);
+	INSERT INTO chunks (checksum) VALUES (?);
 	`
 
 	db.Exec(insert, checksum)
 }
 
+// InsertUnreferenced adds a row at instance_count 0 unless checksum has one
+func InsertUnreferenced(db *sql.DB, checksum string) error {
+	const insert = `
+	INSERT INTO chunks (checksum, instance_count) VALUES (?, 0)
+	ON CONFLICT (checksum) DO NOTHING;
+	`
+
+	_, err := db.Exec(insert, checksum)
+
+	return err
+}
+
 func GetCount(db *sql.DB, checksum string) int64 {
 	const query = `
 	SELECT instance_count FROM chunks WHERE checksum = ?;
@@ -121,8 +148,201 @@ func DecreaseCount(db *sql.DB, checksum string) {
 
 func Delete(db *sql.DB, checksum string) {
 	const delete = `
-	DELETE FROM chunk WHERE checksum = ?;
+	DELETE FROM chunks WHERE checksum = ?;
 	`
 
 	db.Exec(delete, checksum)
+
+	const deleteSize = `
+	DELETE FROM chunk_sizes WHERE checksum = ?;
+	`
+
+	db.Exec(deleteSize, checksum)
+}
+
+// Missing returns the checksums that have no entry
+func Missing(db *sql.DB, checksums []string) ([]string, error) {
+	const group = 500
+
+	found := map[string]bool{}
+
+	for start := 0; start < len(checksums); start += group {
+		end := start + group
+		if end > len(checksums) {
+			end = len(checksums)
+		}
+
+		args := []interface{}{}
+		for _, checksum := range checksums[start:end] {
+			args = append(args, checksum)
+		}
+
+		query := `SELECT checksum FROM chunks WHERE checksum IN (?` + strings.Repeat(", ?", len(args)-1) + `);`
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var checksum string
+			if err := rows.Scan(&checksum); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			found[checksum] = true
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	missing := []string{}
+	seen := map[string]bool{}
+	for _, checksum := range checksums {
+		if !found[checksum] && !seen[checksum] {
+			missing = append(missing, checksum)
+			seen[checksum] = true
+		}
+	}
+
+	return missing, nil
+}
+
+// ListCounts returns instance_count for every chunk in the index
+func ListCounts(db *sql.DB) (map[string]int64, error) {
+	const query = `
+	SELECT checksum, instance_count FROM chunks;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var checksum string
+		var instances int64
+		if err := rows.Scan(&checksum, &instances); err != nil {
+			return nil, err
+		}
+
+		counts[checksum] = instances
+	}
+
+	return counts, rows.Err()
+}
+
+// ReplaceCounts makes the index hold exactly counts, in one transaction
+func ReplaceCounts(db *sql.DB, counts map[string]int64) error {
+	current, err := ListCounts(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const delete = `
+	DELETE FROM chunks WHERE checksum = ?;
+	`
+
+	for checksum := range current {
+		if _, ok := counts[checksum]; ok {
+			continue
+		}
+
+		if _, err := tx.Exec(delete, checksum); err != nil {
+			return err
+		}
+	}
+
+	const upsert = `
+	INSERT INTO chunks (checksum, instance_count) VALUES (?, ?)
+	ON CONFLICT (checksum) DO UPDATE SET instance_count = excluded.instance_count;
+	`
+
+	for checksum, instances := range counts {
+		if indexed, ok := current[checksum]; ok && indexed == instances {
+			continue
+		}
+
+		if _, err := tx.Exec(upsert, checksum, instances); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AddReference upserts in one statement so concurrent writers can't lose a count
+func AddReference(db *sql.DB, checksum string) error {
+	const upsert = `
+	INSERT INTO chunks (checksum) VALUES (?)
+	ON CONFLICT (checksum) DO UPDATE SET instance_count = instance_count + 1;
+	`
+
+	_, err := db.Exec(upsert, checksum)
+
+	return err
+}
+
+// Release drops a reference and returns how many remain, removing the row at 0
+func Release(db *sql.DB, checksum string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	const update = `
+	UPDATE chunks
+	SET instance_count = instance_count - 1
+	WHERE checksum = ?;
+	`
+
+	if _, err := tx.Exec(update, checksum); err != nil {
+		return 0, err
+	}
+
+	const query = `
+	SELECT instance_count FROM chunks WHERE checksum = ?;
+	`
+
+	var instances int64
+	err = tx.QueryRow(query, checksum).Scan(&instances)
+	if err == sql.ErrNoRows {
+		return 0, tx.Commit()
+	} else if err != nil {
+		return 0, err
+	}
+
+	if instances <= 0 {
+		const delete = `
+		DELETE FROM chunks WHERE checksum = ?;
+		`
+
+		if _, err := tx.Exec(delete, checksum); err != nil {
+			return 0, err
+		}
+
+		const deleteSize = `
+		DELETE FROM chunk_sizes WHERE checksum = ?;
+		`
+
+		if _, err := tx.Exec(deleteSize, checksum); err != nil {
+			return 0, err
+		}
+	}
+
+	return instances, tx.Commit()
 }
@@ -0,0 +1,331 @@
+package throttle
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+// Limits caps transfers, a zero value means no limit
+type Limits struct {
+	UploadBytesPerSec   int64
+	DownloadBytesPerSec int64
+	MaxRequests         int
+}
+
+// Schedule applies between From and To, "15:04" local, wrapping midnight
+type Schedule struct {
+	From string
+	To   string
+	Limits
+}
+
+type Options struct {
+	// limits outside every schedule
+	Limits
+
+	// the first schedule whose window contains the current time wins
+	Schedules []Schedule
+}
+
+func (o *Options) SetDefaults() {
+	o.Limits = Limits{}
+	o.Schedules = []Schedule{}
+}
+
+func (l Limits) Validate() error {
+	if l.UploadBytesPerSec < 0 || l.DownloadBytesPerSec < 0 || l.MaxRequests < 0 {
+		return fmt.Errorf("negative limit in %+v", l)
+	}
+
+	return nil
+}
+
+func (o Options) Validate() error {
+	if err := o.Limits.Validate(); err != nil {
+		return err
+	}
+
+	for _, schedule := range o.Schedules {
+		if _, err := time.Parse("15:04", schedule.From); err != nil {
+			return fmt.Errorf("invalid schedule start %q", schedule.From)
+		}
+		if _, err := time.Parse("15:04", schedule.To); err != nil {
+			return fmt.Errorf("invalid schedule end %q", schedule.To)
+		}
+		if schedule.From == schedule.To {
+			return fmt.Errorf("empty schedule window %s-%s", schedule.From, schedule.To)
+		}
+		if err := schedule.Limits.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// minutes since midnight of a validated "15:04" time
+func minutes(clock string) int {
+	t, _ := time.Parse("15:04", clock)
+
+	return t.Hour()*60 + t.Minute()
+}
+
+// LimitsAt returns the limits in force at t
+func (o Options) LimitsAt(t time.Time) Limits {
+	now := t.Hour()*60 + t.Minute()
+
+	for _, schedule := range o.Schedules {
+		from, to := minutes(schedule.From), minutes(schedule.To)
+
+		if from <= to && now >= from && now < to {
+			return schedule.Limits
+		} else if from > to && (now >= from || now < to) {
+			return schedule.Limits
+		}
+	}
+
+	return o.Limits
+}
+
+// NextChange returns the next schedule boundary, zero without schedules
+func (o Options) NextChange(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	next := time.Time{}
+	for _, schedule := range o.Schedules {
+		for _, clock := range []string{schedule.From, schedule.To} {
+			at := midnight.Add(time.Duration(minutes(clock)) * time.Minute)
+			if !at.After(t) {
+				at = at.AddDate(0, 0, 1)
+			}
+
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+		}
+	}
+
+	return next
+}
+
+// bucket paces transfers by letting callers go into debt and sleep it off
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(n int64, rate int64) {
+	if rate <= 0 || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	}
+	// allow at most a second's worth of burst after being idle
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / float64(rate) * float64(time.Second)))
+	}
+}
+
+// Limiter is shared so limits hold across a repository's stores
+type Limiter struct {
+	opt Options
+	now func() time.Time
+
+	upload   bucket
+	download bucket
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+}
+
+func NewLimiter(opt Options) (*Limiter, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+
+	limiter := &Limiter{opt: opt, now: time.Now}
+	limiter.cond = sync.NewCond(&limiter.mu)
+
+	return limiter, nil
+}
+
+func (l *Limiter) limits() Limits {
+	return l.opt.LimitsAt(l.now())
+}
+
+// acquire waits for a slot, woken when requests end or the schedule changes
+func (l *Limiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		max := l.limits().MaxRequests
+		if max <= 0 || l.active < max {
+			break
+		}
+
+		var timer *time.Timer
+		if next := l.opt.NextChange(l.now()); !next.IsZero() {
+			timer = time.AfterFunc(next.Sub(l.now()), func() {
+				l.mu.Lock()
+				l.cond.Broadcast()
+				l.mu.Unlock()
+			})
+		}
+
+		l.cond.Wait()
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	l.active++
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+
+	l.cond.Broadcast()
+}
+
+func (l *Limiter) Upload(n int64) {
+	l.upload.take(n, l.limits().UploadBytesPerSec)
+}
+
+func (l *Limiter) Download(n int64) {
+	l.download.take(n, l.limits().DownloadBytesPerSec)
+}
+
+// Store paces uploads before sending and downloads after they arrive
+type Store struct {
+	inner   chunkstore.ChunkStore
+	limiter *Limiter
+}
+
+func NewStore(inner chunkstore.ChunkStore, limiter *Limiter) *Store {
+	store := &Store{
+		inner:   inner,
+		limiter: limiter,
+	}
+	return store
+}
+
+func (s *Store) Put(id string, data []byte) error {
+	s.limiter.Upload(int64(len(data)))
+
+	s.limiter.acquire()
+	defer s.limiter.release()
+
+	return s.inner.Put(id, data)
+}
+
+func (s *Store) Get(id string) ([]byte, error) {
+	s.limiter.acquire()
+	data, err := s.inner.Get(id)
+	s.limiter.release()
+
+	s.limiter.Download(int64(len(data)))
+
+	return data, err
+}
+
+func (s *Store) GetRange(id string, offset, length int64) ([]byte, error) {
+	s.limiter.Download(length)
+
+	s.limiter.acquire()
+	defer s.limiter.release()
+
+	return chunkstore.GetRange(s.inner, id, offset, length)
+}
+
+func (s *Store) Has(id string) (bool, error) {
+	s.limiter.acquire()
+	defer s.limiter.release()
+
+	return s.inner.Has(id)
+}
+
+func (s *Store) Delete(id string) error {
+	s.limiter.acquire()
+	defer s.limiter.release()
+
+	return s.inner.Delete(id)
+}
+
+func (s *Store) List() ([]string, error) {
+	s.limiter.acquire()
+	defer s.limiter.release()
+
+	return s.inner.List()
+}
+
+func (s *Store) Stat(id string) (chunkstore.ChunkInfo, error) {
+	s.limiter.acquire()
+	defer s.limiter.release()
+
+	return s.inner.Stat(id)
+}
+
+func (s *Store) Missing(ids []string) ([]string, error) {
+	s.limiter.acquire()
+	defer s.limiter.release()
+
+	return chunkstore.Missing(s.inner, ids)
+}
+
+func (s *Store) PutBatch(objects []chunkstore.Object) error {
+	size := int64(0)
+	for _, object := range objects {
+		size += int64(len(object.Data))
+	}
+	s.limiter.Upload(size)
+
+	s.limiter.acquire()
+	defer s.limiter.release()
+
+	return chunkstore.PutBatch(s.inner, objects)
+}
+
+func (s *Store) Flush() error {
+	if flusher, ok := s.inner.(chunkstore.Flusher); ok {
+		s.limiter.acquire()
+		defer s.limiter.release()
+
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+func (s *Store) Close() error {
+	if closer, ok := s.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (s *Store) Unwrap() chunkstore.ChunkStore {
+	return s.inner
+}
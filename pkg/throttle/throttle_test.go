@@ -0,0 +1,204 @@
+package throttle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"fastcdc-backup/pkg/chunkstore"
+)
+
+func at(clock string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04", "2024-03-01 "+clock, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func scheduled() Options {
+	opt := Options{}
+	opt.SetDefaults()
+	opt.Limits = Limits{UploadBytesPerSec: 100}
+	opt.Schedules = []Schedule{
+		{From: "09:00", To: "17:00", Limits: Limits{UploadBytesPerSec: 10}},
+		{From: "22:00", To: "06:00", Limits: Limits{UploadBytesPerSec: 1000}},
+	}
+	return opt
+}
+
+func TestLimitsAt(t *testing.T) {
+	opt := scheduled()
+
+	for clock, want := range map[string]int64{
+		"08:59": 100,
+		"09:00": 10,
+		"16:59": 10,
+		"17:00": 100,
+		"22:00": 1000,
+		"23:59": 1000,
+		"00:00": 1000,
+		"05:59": 1000,
+		"06:00": 100,
+	} {
+		if got := opt.LimitsAt(at(clock)).UploadBytesPerSec; got != want {
+			t.Errorf("at %s the upload limit is %d, want %d", clock, got, want)
+		}
+	}
+}
+
+func TestNextChange(t *testing.T) {
+	opt := scheduled()
+
+	for clock, want := range map[string]time.Time{
+		"08:00": at("09:00"),
+		"09:00": at("17:00"),
+		"20:00": at("22:00"),
+		"23:00": at("06:00").AddDate(0, 0, 1),
+	} {
+		if got := opt.NextChange(at(clock)); !got.Equal(want) {
+			t.Errorf("after %s the next change is %v, want %v", clock, got, want)
+		}
+	}
+
+	if !(Options{}).NextChange(at("12:00")).IsZero() {
+		t.Error("options without schedules have a next change")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, opt := range []Options{
+		{Limits: Limits{UploadBytesPerSec: -1}},
+		{Limits: Limits{MaxRequests: -1}},
+		{Schedules: []Schedule{{From: "9:00", To: "25:00"}}},
+		{Schedules: []Schedule{{From: "09:00", To: "09:00"}}},
+		{Schedules: []Schedule{{From: "09:00", To: "17:00", Limits: Limits{DownloadBytesPerSec: -5}}}},
+	} {
+		if opt.Validate() == nil {
+			t.Errorf("%+v passed validation", opt)
+		}
+	}
+
+	if err := scheduled().Validate(); err != nil {
+		t.Errorf("valid options failed validation: %v", err)
+	}
+}
+
+func TestBucketPaces(t *testing.T) {
+	b := &bucket{}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		b.take(100, 1000)
+	}
+
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("300 bytes at 1000 bytes/s took %v", elapsed)
+	}
+
+	// no limit never waits
+	start = time.Now()
+	b.take(1<<30, 0)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("an unlimited take waited %v", elapsed)
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	opt := Options{}
+	opt.SetDefaults()
+	opt.MaxRequests = 2
+
+	limiter, err := NewLimiter(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter.acquire()
+	limiter.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		limiter.acquire()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("a third request started past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	limiter.release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("a released slot was not handed on")
+	}
+}
+
+func TestScheduleChangeWakesWaiters(t *testing.T) {
+	opt := Options{}
+	opt.SetDefaults()
+	opt.MaxRequests = 5
+	opt.Schedules = []Schedule{{From: "09:00", To: "17:00", Limits: Limits{MaxRequests: 1}}}
+
+	limiter, err := NewLimiter(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the window closes shortly after the test starts
+	start, end := time.Now(), at("17:00").Add(-100*time.Millisecond)
+	limiter.now = func() time.Time {
+		return end.Add(time.Since(start))
+	}
+
+	limiter.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		limiter.acquire()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiter was not woken when the window closed")
+	}
+}
+
+func TestStorePassesThrough(t *testing.T) {
+	opt := Options{}
+	opt.SetDefaults()
+	opt.MaxRequests = 1
+
+	limiter, err := NewLimiter(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := chunkstore.NewMemoryStore()
+	store := NewStore(inner, limiter)
+
+	var wg sync.WaitGroup
+	for _, id := range []string{"a1", "b2", "c3"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := store.Put(id, []byte(id)); err != nil {
+				t.Error(err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	data, err := store.Get("b2")
+	if err != nil || string(data) != "b2" {
+		t.Fatalf("get returned %q, %v", data, err)
+	}
+	if limiter.active != 0 {
+		t.Fatalf("%d requests still hold a slot", limiter.active)
+	}
+}